@@ -0,0 +1,193 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"errors"
+)
+
+// Capabilities describes the features supported by a card, as returned by
+// YubiKey.Capabilities.
+type Capabilities struct {
+	// Algorithms lists the algorithms of keys that can be generated on the
+	// card.
+	Algorithms []Algorithm
+	// PINPolicies and TouchPolicies list the policies that can be set when
+	// generating or importing keys.
+	PINPolicies   []PINPolicy
+	TouchPolicies []TouchPolicy
+
+	// KeyInfo indicates KeyInfo is supported, allowing the policies and
+	// public keys of slots to be read.
+	KeyInfo bool
+	// Attestation indicates Attest and AttestationCertificate are supported.
+	Attestation bool
+	// MoveKey indicates MoveKey and DeleteKey are supported, allowing keys to
+	// be moved between slots or deleted.
+	MoveKey bool
+	// AESManagementKey indicates the management key can be an AES key.
+	AESManagementKey bool
+	// OCC indicates on card biometric comparison is supported, such as by
+	// VerifyOCC and PINPolicyMatchOnce.
+	OCC bool
+	// FIPS indicates the card is a FIPS series YubiKey, which restricts
+	// some algorithms and policies.
+	FIPS bool
+}
+
+// SupportsKey reports whether a key with the given algorithm and policies can
+// be generated on the card. Unset policies, which use the card's defaults, are
+// always supported.
+func (c *Capabilities) SupportsKey(key Key) bool {
+	return c.supportsAlgorithm(key.Algorithm) &&
+		c.supportsPINPolicy(key.PINPolicy) &&
+		c.supportsTouchPolicy(key.TouchPolicy)
+}
+
+func (c *Capabilities) supportsAlgorithm(a Algorithm) bool {
+	for _, alg := range c.Algorithms {
+		if alg == a {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capabilities) supportsPINPolicy(p PINPolicy) bool {
+	if p == 0 {
+		return true
+	}
+	for _, pp := range c.PINPolicies {
+		if pp == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capabilities) supportsTouchPolicy(p TouchPolicy) bool {
+	if p == 0 {
+		return true
+	}
+	for _, tp := range c.TouchPolicies {
+		if tp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities reports the features supported by the card. Features are
+// determined by the card's firmware version and device information, and by
+// probing for on card biometric comparison.
+//
+//	caps, err := yk.Capabilities()
+//	if err != nil {
+//		// ...
+//	}
+//	key := piv.Key{
+//		Algorithm:   piv.AlgorithmEC384,
+//		PINPolicy:   piv.PINPolicyOnce,
+//		TouchPolicy: piv.TouchPolicyCached,
+//	}
+//	if !caps.SupportsKey(key) {
+//		// ...
+//	}
+//
+// Reading the device information requires selecting the management applet,
+// which resets the PIN's verification status.
+func (yk *YubiKey) Capabilities() (*Capabilities, error) {
+	if yk.generic {
+		// NIST SP 800-73-4 algorithms, without Yubico's extensions. Keys
+		// can only be generated with the card's default policies.
+		return &Capabilities{
+			Algorithms: []Algorithm{AlgorithmRSA1024, AlgorithmRSA2048, AlgorithmEC256, AlgorithmEC384},
+		}, nil
+	}
+	var c *Capabilities
+	err := yk.do(context.Background(), func(tx *scTx) error {
+		var fips, occ bool
+		if info, err := ykDeviceInfo(tx); err == nil {
+			fips = info.IsFIPS
+		}
+		if _, _, err := ykOCCRetries(tx); err == nil || errors.Is(err, ErrOCCTemplateNotFound) {
+			occ = true
+		}
+		c = capabilities(yk.Version(), fips, occ)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// capabilities derives the features supported by a card from its firmware
+// version. fips indicates the card reported being a FIPS series YubiKey, and
+// occ that it supports on card biometric comparison.
+//
+// https://github.com/Yubico/yubikey-manager/blob/main/yubikit/piv.py
+func capabilities(v Version, fips, occ bool) *Capabilities {
+	// YubiKey 4 FIPS series keys don't report device information over the
+	// smart card interface.
+	if supportsVersion(v, 4, 4, 0) && !supportsVersion(v, 4, 5, 0) {
+		fips = true
+	}
+	c := &Capabilities{
+		KeyInfo:          supportsVersion(v, 5, 3, 0),
+		Attestation:      supportsVersion(v, 4, 3, 0),
+		MoveKey:          supportsVersion(v, 5, 7, 0),
+		AESManagementKey: supportsVersion(v, 5, 4, 0),
+		OCC:              occ,
+		FIPS:             fips,
+	}
+
+	// Firmware affected by ROCA can't generate RSA keys securely.
+	//
+	// https://www.yubico.com/support/security-advisories/ysa-2017-01/
+	roca := supportsVersion(v, 4, 2, 6) && !supportsVersion(v, 4, 3, 5)
+	if !roca {
+		if !fips {
+			c.Algorithms = append(c.Algorithms, AlgorithmRSA1024)
+		}
+		c.Algorithms = append(c.Algorithms, AlgorithmRSA2048)
+		if supportsVersion(v, 5, 7, 0) {
+			c.Algorithms = append(c.Algorithms, AlgorithmRSA3072, AlgorithmRSA4096)
+		}
+	}
+	if supportsVersion(v, 4, 0, 0) {
+		c.Algorithms = append(c.Algorithms, AlgorithmEC256, AlgorithmEC384)
+	}
+	if supportsVersion(v, 5, 7, 0) {
+		c.Algorithms = append(c.Algorithms, AlgorithmEd25519, AlgorithmX25519)
+	}
+
+	// Older YubiKeys don't support setting policies.
+	if supportsVersion(v, 4, 0, 0) {
+		if !fips {
+			c.PINPolicies = append(c.PINPolicies, PINPolicyNever)
+		}
+		c.PINPolicies = append(c.PINPolicies, PINPolicyOnce, PINPolicyAlways)
+		c.TouchPolicies = append(c.TouchPolicies, TouchPolicyNever, TouchPolicyAlways)
+	}
+	if occ {
+		c.PINPolicies = append(c.PINPolicies, PINPolicyMatchOnce, PINPolicyMatchAlways)
+	}
+	if supportsVersion(v, 4, 3, 0) {
+		c.TouchPolicies = append(c.TouchPolicies, TouchPolicyCached)
+	}
+	return c
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
+)
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  pivtest.Config
+		want Capabilities
+	}{
+		{
+			name: "5.4.3",
+			cfg:  pivtest.Config{Version: [3]byte{5, 4, 3}},
+			want: Capabilities{
+				Algorithms:       []Algorithm{AlgorithmRSA1024, AlgorithmRSA2048, AlgorithmEC256, AlgorithmEC384},
+				PINPolicies:      []PINPolicy{PINPolicyNever, PINPolicyOnce, PINPolicyAlways},
+				TouchPolicies:    []TouchPolicy{TouchPolicyNever, TouchPolicyAlways, TouchPolicyCached},
+				KeyInfo:          true,
+				Attestation:      true,
+				AESManagementKey: true,
+			},
+		},
+		{
+			name: "5.4.3 FIPS",
+			cfg:  pivtest.Config{Version: [3]byte{5, 4, 3}, Formfactor: FormfactorUSBCNanoFIPS},
+			want: Capabilities{
+				Algorithms:       []Algorithm{AlgorithmRSA2048, AlgorithmEC256, AlgorithmEC384},
+				PINPolicies:      []PINPolicy{PINPolicyOnce, PINPolicyAlways},
+				TouchPolicies:    []TouchPolicy{TouchPolicyNever, TouchPolicyAlways, TouchPolicyCached},
+				KeyInfo:          true,
+				Attestation:      true,
+				AESManagementKey: true,
+				FIPS:             true,
+			},
+		},
+		{
+			name: "4.3.0",
+			cfg:  pivtest.Config{Version: [3]byte{4, 3, 0}},
+			want: Capabilities{
+				Algorithms:    []Algorithm{AlgorithmEC256, AlgorithmEC384},
+				PINPolicies:   []PINPolicy{PINPolicyNever, PINPolicyOnce, PINPolicyAlways},
+				TouchPolicies: []TouchPolicy{TouchPolicyNever, TouchPolicyAlways, TouchPolicyCached},
+				Attestation:   true,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			yk, err := OpenTransport(pivtest.New(test.cfg))
+			if err != nil {
+				t.Fatalf("opening yubikey: %v", err)
+			}
+			defer yk.Close()
+
+			got, err := yk.Capabilities()
+			if err != nil {
+				t.Fatalf("getting capabilities: %v", err)
+			}
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("capabilities got=%+v, want=%+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesVersions(t *testing.T) {
+	tests := []struct {
+		v        Version
+		occ      bool
+		supports Key
+		rejects  Key
+	}{
+		{
+			v:        Version{5, 7, 1},
+			supports: Key{AlgorithmEd25519, PINPolicyNever, TouchPolicyCached},
+			rejects:  Key{AlgorithmEC256, PINPolicyMatchOnce, TouchPolicyNever},
+		},
+		{
+			v:        Version{5, 7, 1},
+			occ:      true,
+			supports: Key{AlgorithmEC256, PINPolicyMatchAlways, TouchPolicyNever},
+		},
+		{
+			v:        Version{5, 7, 1},
+			supports: Key{AlgorithmRSA4096, PINPolicyOnce, TouchPolicyAlways},
+		},
+		{
+			v:        Version{5, 7, 1},
+			supports: Key{AlgorithmX25519, PINPolicyOnce, TouchPolicyNever},
+		},
+		{
+			v:       Version{5, 4, 3},
+			rejects: Key{AlgorithmRSA3072, PINPolicyOnce, TouchPolicyAlways},
+		},
+		{
+			// Default policies.
+			v:        Version{5, 4, 3},
+			supports: Key{Algorithm: AlgorithmEC256},
+			rejects:  Key{Algorithm: AlgorithmEd25519},
+		},
+		{
+			v:       Version{4, 4, 5},
+			rejects: Key{AlgorithmEC256, PINPolicyNever, TouchPolicyNever},
+		},
+		{
+			v:        Version{4, 2, 7},
+			supports: Key{AlgorithmEC256, PINPolicyAlways, TouchPolicyAlways},
+			rejects:  Key{AlgorithmRSA2048, PINPolicyAlways, TouchPolicyAlways},
+		},
+		{
+			v:       Version{4, 2, 7},
+			rejects: Key{AlgorithmEC256, PINPolicyAlways, TouchPolicyCached},
+		},
+	}
+	for _, test := range tests {
+		c := capabilities(test.v, false, test.occ)
+		if test.supports != (Key{}) && !c.SupportsKey(test.supports) {
+			t.Errorf("%v (occ=%v): expected %+v to be supported", test.v, test.occ, test.supports)
+		}
+		if test.rejects != (Key{}) && c.SupportsKey(test.rejects) {
+			t.Errorf("%v (occ=%v): expected %+v to be unsupported", test.v, test.occ, test.rejects)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"io"
+)
+
+// ErrCanceled is returned when an operation's context is cancelled or its
+// deadline expires before the operation completes. The returned error also
+// wraps the context's error, so callers can use errors.Is to distinguish
+// context.Canceled from context.DeadlineExceeded.
+var ErrCanceled = errors.New("operation canceled")
+
+// cancelErr is returned by context-aware operations that were interrupted.
+type cancelErr struct {
+	// err is the context's error.
+	err error
+}
+
+func (e *cancelErr) Error() string {
+	return ErrCanceled.Error() + ": " + e.err.Error()
+}
+
+func (e *cancelErr) Unwrap() error {
+	return e.err
+}
+
+func (e *cancelErr) Is(target error) bool {
+	return target == ErrCanceled
+}
+
+// canceler is implemented by transports that can interrupt a blocking call,
+// such as a command waiting for the user to touch the card.
+type canceler interface {
+	Cancel() error
+}
+
+// ContextSigner is implemented by private keys returned by PrivateKey that
+// support signing. SignContext is equivalent to Sign, but returns an error
+// wrapping ErrCanceled if the context is done before the card responds.
+type ContextSigner interface {
+	crypto.Signer
+	SignContext(ctx context.Context, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// ContextDecrypter is implemented by private keys returned by PrivateKey that
+// support decryption. DecryptContext is equivalent to Decrypt, but returns an
+// error wrapping ErrCanceled if the context is done before the card responds.
+type ContextDecrypter interface {
+	crypto.Decrypter
+	DecryptContext(ctx context.Context, rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error)
+}
+
+// do runs an operation against the card, holding exclusive use of the
+// YubiKey's transaction until it completes. Operations must not call methods
+// that use do themselves, or they'll deadlock. If the card was reset or removed,
+// do reconnects to it and retries the operation, so operations must be safe to
+// repeat. Otherwise, use doOnce.
+//
+// If the context is done first, do asks the transport to cancel any blocking
+// call and returns immediately with an error wrapping ErrCanceled. Since
+// commands can't always be interrupted, the operation may continue in the
+// background, and later operations wait for it to finish before using the
+// card.
+func (yk *YubiKey) do(ctx context.Context, f func(tx *scTx) error) error {
+	return yk.exec(ctx, true, f)
+}
+
+// doOnce is like do, but doesn't retry the operation after reconnecting to a
+// card that was reset or removed.
+func (yk *YubiKey) doOnce(ctx context.Context, f func(tx *scTx) error) error {
+	return yk.exec(ctx, false, f)
+}
+
+func (yk *YubiKey) exec(ctx context.Context, retry bool, f func(tx *scTx) error) error {
+	if yk.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, yk.timeout)
+		defer cancel()
+	}
+	select {
+	case yk.busy <- struct{}{}:
+	case <-ctx.Done():
+		return &cancelErr{ctx.Err()}
+	}
+	if ctx.Done() == nil {
+		// The context can't be cancelled, avoid starting a goroutine.
+		defer func() { <-yk.busy }()
+		return yk.recoverRun(retry, f)
+	}
+	if err := ctx.Err(); err != nil {
+		<-yk.busy
+		return &cancelErr{err}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-yk.busy }()
+		done <- yk.recoverRun(retry, f)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if c, ok := yk.t.(canceler); ok {
+			c.Cancel()
+		}
+		return &cancelErr{ctx.Err()}
+	}
+}
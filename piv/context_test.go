@@ -0,0 +1,273 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
+)
+
+// blockingTransport wraps a Transport, holding commands with a given
+// instruction until released, as a card waiting for touch would.
+type blockingTransport struct {
+	Transport
+
+	// ins is the instruction to block, or zero to block nothing.
+	ins     byte
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+
+	transmits int32
+	cancels   int32
+}
+
+func newBlockingTransport(t Transport) *blockingTransport {
+	return &blockingTransport{
+		Transport: t,
+		started:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+}
+
+func (b *blockingTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	atomic.AddInt32(&b.transmits, 1)
+	if b.ins != 0 && len(req) > 1 && req[1] == b.ins {
+		b.once.Do(func() { close(b.started) })
+		<-b.release
+	}
+	return b.Transport.Transmit(req)
+}
+
+func (b *blockingTransport) Cancel() error {
+	atomic.AddInt32(&b.cancels, 1)
+	return nil
+}
+
+func TestSignContextCanceled(t *testing.T) {
+	bt := newBlockingTransport(pivtest.New(pivtest.Config{}))
+	yk, err := OpenTransport(bt)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	key := Key{
+		Algorithm:   AlgorithmEC256,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyAlways,
+	}
+	pub, err := yk.GenerateKeyContext(context.Background(), DefaultManagementKey(), SlotAuthentication, key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	priv, err := yk.PrivateKey(SlotAuthentication, pub, KeyAuth{})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	signer, ok := priv.(ContextSigner)
+	if !ok {
+		t.Fatalf("private key doesn't implement ContextSigner")
+	}
+
+	// Block signing, simulating a key nobody touches.
+	bt.ins = insAuthenticate
+	digest := sha256.Sum256([]byte("hello"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = signer.SignContext(ctx, rand.Reader, digest[:], crypto.SHA256)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("sign got err=%v, want ErrCanceled wrapping context.DeadlineExceeded", err)
+	}
+	<-bt.started
+	if n := atomic.LoadInt32(&bt.cancels); n != 1 {
+		t.Errorf("transport cancelled %d times, want 1", n)
+	}
+
+	// Later operations wait for the interrupted command to complete.
+	errc := make(chan error, 1)
+	go func() { errc <- yk.VerifyPIN(DefaultPIN) }()
+	select {
+	case err := <-errc:
+		t.Fatalf("verify pin returned before interrupted command completed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	bt.ins = 0
+	close(bt.release)
+	if err := <-errc; err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+
+	sig, err := signer.SignContext(context.Background(), rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+		t.Errorf("signature didn't verify")
+	}
+}
+
+func TestContextCanceledBeforeStart(t *testing.T) {
+	bt := newBlockingTransport(pivtest.New(pivtest.Config{}))
+	yk, err := OpenTransport(bt)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := atomic.LoadInt32(&bt.transmits)
+	if err := yk.VerifyPINContext(ctx, DefaultPIN); !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("verify pin got err=%v, want ErrCanceled wrapping context.Canceled", err)
+	}
+	if _, err := yk.AttestContext(ctx, SlotAuthentication); !errors.Is(err, ErrCanceled) {
+		t.Errorf("attest got err=%v, want ErrCanceled", err)
+	}
+	if n := atomic.LoadInt32(&bt.transmits) - before; n != 0 {
+		t.Errorf("cancelled operations sent %d commands, want 0", n)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	bt := newBlockingTransport(pivtest.New(pivtest.Config{}))
+	c := Client{Timeout: 50 * time.Millisecond}
+	yk, err := c.OpenTransport(bt)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	key := Key{
+		Algorithm:   AlgorithmEC256,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyAlways,
+	}
+	pub, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	priv, err := yk.PrivateKey(SlotAuthentication, pub, KeyAuth{})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+
+	bt.ins = insAuthenticate
+	digest := sha256.Sum256([]byte("hello"))
+	_, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("sign got err=%v, want ErrCanceled wrapping context.DeadlineExceeded", err)
+	}
+	<-bt.started
+	bt.ins = 0
+	close(bt.release)
+	if _, err := yk.Serial(); err != nil {
+		t.Fatalf("getting serial after timeout: %v", err)
+	}
+}
+
+// delayTransport wraps a Transport, delaying the first command with a given
+// instruction as a slow card would. Unlike blockingTransport, the delayed
+// command completes without synchronizing with the test.
+type delayTransport struct {
+	Transport
+
+	ins     byte
+	delay   time.Duration
+	delayed bool
+}
+
+func (d *delayTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	// Commands are serialized by the YubiKey, so delayed doesn't need a lock.
+	if !d.delayed && len(req) > 1 && req[1] == d.ins {
+		d.delayed = true
+		time.Sleep(d.delay)
+	}
+	return d.Transport.Transmit(req)
+}
+
+func TestTimeoutResult(t *testing.T) {
+	tests := []struct {
+		name string
+		ins  byte
+		op   func(yk *YubiKey) error
+	}{
+		{"Serial", insGetSerial, func(yk *YubiKey) error {
+			_, err := yk.Serial()
+			return err
+		}},
+		{"KeyInfo", insGetMetadata, func(yk *YubiKey) error {
+			_, err := yk.KeyInfo(SlotAuthentication)
+			return err
+		}},
+		{"Retries", insVerify, func(yk *YubiKey) error {
+			_, err := yk.Retries()
+			return err
+		}},
+		{"PINMetadata", insGetMetadata, func(yk *YubiKey) error {
+			_, err := yk.PINMetadata()
+			return err
+		}},
+		{"ManagementKeyMetadata", insGetMetadata, func(yk *YubiKey) error {
+			_, err := yk.ManagementKeyMetadata()
+			return err
+		}},
+		{"OCCRetries", insGetMetadata, func(yk *YubiKey) error {
+			_, _, err := yk.OCCRetries()
+			return err
+		}},
+		{"DeviceInfo", insGetDeviceInfo, func(yk *YubiKey) error {
+			_, err := yk.DeviceInfo()
+			return err
+		}},
+		{"Capabilities", insGetDeviceInfo, func(yk *YubiKey) error {
+			_, err := yk.Capabilities()
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dt := &delayTransport{
+				Transport: pivtest.New(pivtest.Config{}),
+				ins:       test.ins,
+				delay:     100 * time.Millisecond,
+			}
+			c := Client{Timeout: 20 * time.Millisecond}
+			yk, err := c.OpenTransport(dt)
+			if err != nil {
+				t.Fatalf("opening yubikey: %v", err)
+			}
+			// The result of the interrupted command is written after the
+			// operation returns, which the race detector reports if the
+			// operation also reads it.
+			if err := test.op(yk); !errors.Is(err, ErrCanceled) {
+				t.Errorf("operation got err=%v, want ErrCanceled", err)
+			}
+			if err := yk.Close(); err != nil {
+				t.Errorf("closing yubikey: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Application is a set of YubiKey applications, such as those supported or
+// enabled over an interface.
+type Application uint16
+
+// Applications of a YubiKey. See the reference for more information:
+// https://developers.yubico.com/yubikey-manager/Config_Reference.html
+const (
+	ApplicationOTP     Application = 0x0001
+	ApplicationU2F     Application = 0x0002
+	ApplicationOpenPGP Application = 0x0008
+	ApplicationPIV     Application = 0x0010
+	ApplicationOATH    Application = 0x0020
+	ApplicationHSMAuth Application = 0x0100
+	ApplicationFIDO2   Application = 0x0200
+)
+
+// applicationsKnown holds all applications recognized by this package.
+const applicationsKnown = ApplicationOTP | ApplicationU2F | ApplicationOpenPGP |
+	ApplicationPIV | ApplicationOATH | ApplicationHSMAuth | ApplicationFIDO2
+
+var applicationStrings = []struct {
+	a Application
+	s string
+}{
+	{ApplicationOTP, "OTP"},
+	{ApplicationU2F, "U2F"},
+	{ApplicationOpenPGP, "OpenPGP"},
+	{ApplicationPIV, "PIV"},
+	{ApplicationOATH, "OATH"},
+	{ApplicationHSMAuth, "HSMAuth"},
+	{ApplicationFIDO2, "FIDO2"},
+}
+
+// String returns the names of the applications in the set, separated by "|".
+func (a Application) String() string {
+	var names []string
+	for _, as := range applicationStrings {
+		if a&as.a != 0 {
+			names = append(names, as.s)
+		}
+	}
+	if u := a &^ applicationsKnown; u != 0 {
+		names = append(names, fmt.Sprintf("unknown(0x%04x)", uint16(u)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// DeviceFlag is a set of flags configuring the behavior of a YubiKey.
+type DeviceFlag uint8
+
+// Device flags supported by YubiKeys.
+const (
+	// DeviceFlagRemoteWakeup allows the YubiKey to wake the host from sleep.
+	DeviceFlagRemoteWakeup DeviceFlag = 0x40
+	// DeviceFlagTouchEject causes touching the YubiKey to eject and insert
+	// the smart card, when only the CCID interface is enabled.
+	DeviceFlagTouchEject DeviceFlag = 0x80
+)
+
+// DeviceInfo holds information about a YubiKey reported by its management
+// applet. Fields not reported by the YubiKey are left as their zero value.
+type DeviceInfo struct {
+	// Serial is the YubiKey's serial number.
+	Serial uint32
+	// Version is the firmware version of the YubiKey.
+	Version Version
+	// Formfactor is the physical form of the YubiKey. FIPS variants are
+	// reported using the FIPS form factors, such as FormfactorUSBAKeychainFIPS.
+	Formfactor Formfactor
+	// IsFIPS indicates the YubiKey is a FIPS series key.
+	IsFIPS bool
+	// IsSKY indicates the YubiKey is a Security Key series key.
+	IsSKY bool
+
+	// USBSupported and USBEnabled are the applications supported and
+	// enabled over USB.
+	USBSupported Application
+	USBEnabled   Application
+	// NFCSupported and NFCEnabled are the applications supported and enabled
+	// over NFC. Both are zero for YubiKeys without NFC.
+	NFCSupported Application
+	NFCEnabled   Application
+
+	// ConfigLocked indicates the configuration is protected by a lock code.
+	ConfigLocked bool
+	// AutoEjectTimeout is how long the smart card remains inserted when
+	// DeviceFlagTouchEject is set, or zero if it's never ejected.
+	AutoEjectTimeout time.Duration
+	// ChallengeResponseTimeout is how long the OTP applet waits for touch
+	// during a challenge-response operation.
+	ChallengeResponseTimeout time.Duration
+	// Flags holds additional device configuration.
+	Flags DeviceFlag
+
+	// ResetBlocked is the set of applications that can't currently be reset
+	// individually. On YubiKey Bio Multi-protocol Edition keys, the PIV
+	// applet can't be reset while ApplicationPIV is set, and DeviceReset
+	// must be used instead.
+	ResetBlocked Application
+}
+
+// Device information tags returned by the management applet.
+//
+// https://github.com/Yubico/yubikey-manager/blob/main/yubikit/management.py
+const (
+	deviceInfoUSBSupported     = 0x01
+	deviceInfoSerial           = 0x02
+	deviceInfoUSBEnabled       = 0x03
+	deviceInfoFormfactor       = 0x04
+	deviceInfoVersion          = 0x05
+	deviceInfoAutoEjectTimeout = 0x06
+	deviceInfoChalRespTimeout  = 0x07
+	deviceInfoFlags            = 0x08
+	deviceInfoConfigLock       = 0x0a
+	deviceInfoUnlock           = 0x0b
+	deviceInfoReboot           = 0x0c
+	deviceInfoNFCSupported     = 0x0d
+	deviceInfoNFCEnabled       = 0x0e
+	deviceInfoMoreData         = 0x10
+	deviceInfoResetBlocked     = 0x18
+)
+
+// Bits of the form factor reported by the management applet that don't
+// identify the form factor itself.
+const (
+	formfactorFIPS = 0x80
+	formfactorSKY  = 0x40
+)
+
+// isBio reports whether a form factor is a YubiKey Bio.
+func isBio(f Formfactor) bool {
+	return f == FormfactorUSBABio || f == FormfactorUSBCBio
+}
+
+// mayBeBio reports whether a YubiKey with the given firmware version may be a
+// YubiKey Bio, which requires firmware 5.5.0 or later. Only then is it worth
+// reading the device information to check, since doing so resets the PIN's
+// verification status.
+func mayBeBio(v Version) bool {
+	return supportsVersion(v, 5, 5, 0)
+}
+
+// requireDeviceInfo returns an error wrapping ErrMissingCapability if the card
+// doesn't have a management applet reporting its device information, which
+// requires a YubiKey with firmware 5.0.0 or later.
+func (yk *YubiKey) requireDeviceInfo(op string) error {
+	if err := yk.requireYubico(op); err != nil {
+		return err
+	}
+	if !supportsVersion(yk.Version(), 5, 0, 0) {
+		return fmt.Errorf("%s requires firmware 5.0.0: %w", op, ErrMissingCapability)
+	}
+	return nil
+}
+
+// DeviceInfo returns information about the YubiKey reported by its management
+// applet, such as its form factor and the applications enabled over each
+// interface. DeviceInfo requires a YubiKey with firmware 5.0.0 or later, and
+// returns an error wrapping ErrMissingCapability for older cards.
+//
+// Querying the management applet requires selecting it, which resets the PIN's
+// verification status.
+func (yk *YubiKey) DeviceInfo() (*DeviceInfo, error) {
+	if err := yk.requireDeviceInfo("getting device info"); err != nil {
+		return nil, err
+	}
+	var info *DeviceInfo
+	err := yk.do(context.Background(), func(tx *scTx) error {
+		var err error
+		info, err = ykDeviceInfo(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ykDeviceInfo selects the management applet to read the device information,
+// then reselects the PIV applet.
+func ykDeviceInfo(tx *scTx) (*DeviceInfo, error) {
+	defer ykSelectApplication(tx, aidPIV[:])
+	if err := ykSelectApplication(tx, aidManagement[:]); err != nil {
+		return nil, fmt.Errorf("selecting management applet: %w", err)
+	}
+	return ykReadDeviceInfo(tx)
+}
+
+// ykReadDeviceInfo reads the device information from the management applet,
+// which must already be selected.
+func ykReadDeviceInfo(tx *scTx) (*DeviceInfo, error) {
+	fields := map[byte][]byte{}
+	// Newer YubiKeys split device information across multiple pages.
+	for page := byte(0); ; page++ {
+		resp, err := tx.Transmit(apdu{instruction: insGetDeviceInfo, param1: page})
+		if err != nil {
+			return nil, fmt.Errorf("getting device info: %w", err)
+		}
+		pageFields, err := parseDeviceInfo(resp)
+		if err != nil {
+			return nil, err
+		}
+		for tag, val := range pageFields {
+			fields[tag] = val
+		}
+		if more := pageFields[deviceInfoMoreData]; len(more) != 1 || more[0] != 0x01 {
+			break
+		}
+	}
+	return decodeDeviceInfo(fields)
+}
+
+// parseDeviceInfo decodes device information, a length byte followed by
+// TLV encoded fields with single byte tags and lengths.
+func parseDeviceInfo(b []byte) (map[byte][]byte, error) {
+	if len(b) == 0 || int(b[0]) != len(b)-1 {
+		return nil, errors.New("invalid device info length")
+	}
+	fields := map[byte][]byte{}
+	for b = b[1:]; len(b) > 0; {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errors.New("invalid device info encoding")
+		}
+		tag, n := b[0], int(b[1])
+		fields[tag] = b[2 : 2+n]
+		b = b[2+n:]
+	}
+	return fields, nil
+}
+
+// decodeDeviceInfo interprets the fields of the device information.
+func decodeDeviceInfo(fields map[byte][]byte) (*DeviceInfo, error) {
+	var info DeviceInfo
+	var err error
+	num := func(tag byte, max int) uint64 {
+		b := fields[tag]
+		if err != nil || len(b) == 0 {
+			return 0
+		}
+		if len(b) > max {
+			err = fmt.Errorf("invalid device info field 0x%02x: %x", tag, b)
+			return 0
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n
+	}
+
+	if b, ok := fields[deviceInfoSerial]; ok {
+		if len(b) != 4 {
+			return nil, fmt.Errorf("invalid serial number: %x", b)
+		}
+		info.Serial = binary.BigEndian.Uint32(b)
+	}
+	if b, ok := fields[deviceInfoVersion]; ok {
+		if len(b) != 3 {
+			return nil, fmt.Errorf("invalid firmware version: %x", b)
+		}
+		info.Version = Version{int(b[0]), int(b[1]), int(b[2])}
+	}
+	if b, ok := fields[deviceInfoFormfactor]; ok {
+		if len(b) != 1 {
+			return nil, fmt.Errorf("invalid form factor: %x", b)
+		}
+		info.Formfactor = Formfactor(b[0] &^ formfactorSKY)
+		info.IsFIPS = b[0]&formfactorFIPS != 0
+		info.IsSKY = b[0]&formfactorSKY != 0
+	}
+
+	info.USBSupported = Application(num(deviceInfoUSBSupported, 2))
+	info.USBEnabled = Application(num(deviceInfoUSBEnabled, 2))
+	info.NFCSupported = Application(num(deviceInfoNFCSupported, 2))
+	info.NFCEnabled = Application(num(deviceInfoNFCEnabled, 2))
+	info.ConfigLocked = num(deviceInfoConfigLock, 1) != 0
+	info.AutoEjectTimeout = time.Duration(num(deviceInfoAutoEjectTimeout, 2)) * time.Second
+	info.ChallengeResponseTimeout = time.Duration(num(deviceInfoChalRespTimeout, 1)) * time.Second
+	info.Flags = DeviceFlag(num(deviceInfoFlags, 1))
+	info.ResetBlocked = Application(num(deviceInfoResetBlocked, 2))
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// DeviceConfig holds changes to a YubiKey's configuration, applied using
+// SetDeviceConfig. Nil fields are left unchanged.
+type DeviceConfig struct {
+	// USBEnabled and NFCEnabled set the applications enabled over USB and
+	// NFC. Applications not supported over an interface can't be enabled,
+	// and at least one application must remain enabled over USB.
+	USBEnabled *Application
+	NFCEnabled *Application
+
+	// AutoEjectTimeout sets how long the smart card remains inserted when
+	// DeviceFlagTouchEject is set. Zero never ejects it. The timeout is
+	// rounded down to a whole number of seconds, up to 65535.
+	AutoEjectTimeout *time.Duration
+	// ChallengeResponseTimeout sets how long the OTP applet waits for touch
+	// during a challenge-response operation, up to 255 seconds.
+	ChallengeResponseTimeout *time.Duration
+	// Flags sets additional device configuration, such as
+	// DeviceFlagTouchEject.
+	Flags *DeviceFlag
+
+	// Reboot restarts the YubiKey after applying the configuration, which is
+	// required for changes to the applications enabled over USB to take
+	// effect. Rebooting disconnects the YubiKey, which must be closed and
+	// opened again.
+	Reboot bool
+}
+
+// SetDeviceConfig changes the YubiKey's configuration through its management
+// applet. If the configuration is protected by a lock code, lockCode must hold
+// it; otherwise pass a zero lock code. SetDeviceConfig requires a YubiKey with
+// firmware 5.0.0 or later, and returns an error wrapping ErrMissingCapability
+// for older cards.
+//
+//	// Only allow PIV and FIDO over USB, and disable NFC.
+//	usb := piv.ApplicationPIV | piv.ApplicationU2F | piv.ApplicationFIDO2
+//	var nfc piv.Application
+//	config := &piv.DeviceConfig{USBEnabled: &usb, NFCEnabled: &nfc, Reboot: true}
+//	if err := yk.SetDeviceConfig([16]byte{}, config); err != nil {
+//		// ...
+//	}
+//
+// Selecting the management applet resets the PIN's verification status.
+func (yk *YubiKey) SetDeviceConfig(lockCode [16]byte, c *DeviceConfig) error {
+	if err := yk.requireDeviceInfo("setting device config"); err != nil {
+		return err
+	}
+	data, err := encodeDeviceConfig(lockCode, c, nil)
+	if err != nil {
+		return err
+	}
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		return ykSetDeviceInfo(tx, data)
+	})
+}
+
+// SetConfigLock sets the lock code protecting the YubiKey's configuration. If
+// the configuration is already locked, oldCode must hold the current lock code;
+// otherwise pass a zero lock code. Setting a zero newCode removes the lock.
+//
+// Changing the lock code requires a YubiKey with firmware 5.0.0 or later, and
+// returns an error wrapping ErrMissingCapability for older cards. The lock code
+// can't be recovered, and a YubiKey whose configuration is locked
+// can't have its enabled applications changed without it.
+func (yk *YubiKey) SetConfigLock(oldCode, newCode [16]byte) error {
+	if err := yk.requireDeviceInfo("setting config lock"); err != nil {
+		return err
+	}
+	data, err := encodeDeviceConfig(oldCode, &DeviceConfig{}, &newCode)
+	if err != nil {
+		return err
+	}
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		return ykSetDeviceInfo(tx, data)
+	})
+}
+
+// encodeDeviceConfig encodes a configuration change, prefixed by its length.
+// If newCode is non-nil, the lock code is changed to it.
+func encodeDeviceConfig(lockCode [16]byte, c *DeviceConfig, newCode *[16]byte) ([]byte, error) {
+	var b []byte
+	field := func(tag byte, val []byte) {
+		b = append(b, tag, byte(len(val)))
+		b = append(b, val...)
+	}
+	if c.Reboot {
+		field(deviceInfoReboot, nil)
+	}
+	if lockCode != ([16]byte{}) {
+		field(deviceInfoUnlock, lockCode[:])
+	}
+	if c.USBEnabled != nil {
+		field(deviceInfoUSBEnabled, []byte{byte(*c.USBEnabled >> 8), byte(*c.USBEnabled)})
+	}
+	if c.NFCEnabled != nil {
+		field(deviceInfoNFCEnabled, []byte{byte(*c.NFCEnabled >> 8), byte(*c.NFCEnabled)})
+	}
+	if c.AutoEjectTimeout != nil {
+		secs := *c.AutoEjectTimeout / time.Second
+		if secs < 0 || secs > 0xffff {
+			return nil, fmt.Errorf("auto-eject timeout out of range: %v", *c.AutoEjectTimeout)
+		}
+		field(deviceInfoAutoEjectTimeout, []byte{byte(secs >> 8), byte(secs)})
+	}
+	if c.ChallengeResponseTimeout != nil {
+		secs := *c.ChallengeResponseTimeout / time.Second
+		if secs < 0 || secs > 0xff {
+			return nil, fmt.Errorf("challenge-response timeout out of range: %v", *c.ChallengeResponseTimeout)
+		}
+		field(deviceInfoChalRespTimeout, []byte{byte(secs)})
+	}
+	if c.Flags != nil {
+		field(deviceInfoFlags, []byte{byte(*c.Flags)})
+	}
+	if newCode != nil {
+		field(deviceInfoConfigLock, newCode[:])
+	}
+	return append([]byte{byte(len(b))}, b...), nil
+}
+
+// ykSetDeviceInfo selects the management applet to write a configuration
+// change, then reselects the PIV applet.
+func ykSetDeviceInfo(tx *scTx, data []byte) error {
+	defer ykSelectApplication(tx, aidPIV[:])
+	if err := ykSelectApplication(tx, aidManagement[:]); err != nil {
+		return fmt.Errorf("selecting management applet: %w", err)
+	}
+	if _, err := tx.Transmit(apdu{instruction: insSetDeviceInfo, data: data}); err != nil {
+		return fmt.Errorf("setting device config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
+)
+
+func TestDeviceInfo(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{
+		Version:    [3]byte{5, 4, 3},
+		Serial:     87654321,
+		Formfactor: FormfactorUSBAKeychain,
+	})
+
+	info, err := yk.DeviceInfo()
+	if err != nil {
+		t.Fatalf("getting device info: %v", err)
+	}
+	// The PIV applet is reselected afterwards.
+	serial, err := yk.Serial()
+	if err != nil {
+		t.Fatalf("getting serial after device info: %v", err)
+	}
+	if info.Serial != serial || info.Version != yk.Version() {
+		t.Errorf("device info got serial=%d version=%v, want serial=%d version=%v", info.Serial, info.Version, serial, yk.Version())
+	}
+
+	if _, ok := yk.t.(*pivtest.Card); !ok {
+		return
+	}
+	apps := ApplicationOTP | ApplicationU2F | ApplicationOpenPGP | ApplicationPIV | ApplicationOATH | ApplicationFIDO2
+	want := DeviceInfo{
+		Serial:                   87654321,
+		Version:                  Version{5, 4, 3},
+		Formfactor:               FormfactorUSBAKeychain,
+		USBSupported:             apps,
+		USBEnabled:               apps,
+		NFCSupported:             apps,
+		NFCEnabled:               apps,
+		ChallengeResponseTimeout: 15 * time.Second,
+	}
+	if *info != want {
+		t.Errorf("device info got=%+v, want=%+v", *info, want)
+	}
+}
+
+func TestDeviceInfoUnsupported(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{4, 3, 0}})
+	testRequiresVersionBefore(t, yk, 5, 0, 0)
+
+	if _, err := yk.DeviceInfo(); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("getting device info got err=%v, want ErrMissingCapability", err)
+	}
+	var usb Application
+	if err := yk.SetDeviceConfig([16]byte{}, &DeviceConfig{USBEnabled: &usb}); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("setting device config got err=%v, want ErrMissingCapability", err)
+	}
+	if err := yk.SetConfigLock([16]byte{}, [16]byte{}); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("setting config lock got err=%v, want ErrMissingCapability", err)
+	}
+}
+
+func TestParseDeviceInfo(t *testing.T) {
+	b := []byte{
+		0x08,
+		0x04, 0x01, 0x03,
+		0x05, 0x03, 0x05, 0x04, 0x03,
+	}
+	fields, err := parseDeviceInfo(b)
+	if err != nil {
+		t.Fatalf("parsing device info: %v", err)
+	}
+	if got := fields[deviceInfoFormfactor]; !bytes.Equal(got, []byte{0x03}) {
+		t.Errorf("form factor got=%x, want=03", got)
+	}
+	if got := fields[deviceInfoVersion]; !bytes.Equal(got, []byte{5, 4, 3}) {
+		t.Errorf("version got=%x, want=050403", got)
+	}
+
+	for _, b := range [][]byte{
+		nil,
+		{0x03, 0x04, 0x01},
+		{0x03, 0x04, 0x02, 0x03},
+		{0x01, 0x04},
+	} {
+		if _, err := parseDeviceInfo(b); err == nil {
+			t.Errorf("parsing %x: expected error", b)
+		}
+	}
+}
+
+func TestDecodeDeviceInfo(t *testing.T) {
+	fields := map[byte][]byte{
+		deviceInfoUSBSupported:     {0x02, 0x3b},
+		deviceInfoSerial:           {0x01, 0x02, 0x03, 0x04},
+		deviceInfoUSBEnabled:       {0x02, 0x12},
+		deviceInfoFormfactor:       {0xc3},
+		deviceInfoVersion:          {5, 7, 1},
+		deviceInfoAutoEjectTimeout: {0x01, 0x2c},
+		deviceInfoChalRespTimeout:  {0x0f},
+		deviceInfoFlags:            {0x80},
+		deviceInfoConfigLock:       {0x01},
+		deviceInfoNFCSupported:     {0x00, 0x3b},
+		deviceInfoNFCEnabled:       {0x00},
+		deviceInfoResetBlocked:     {0x00, 0x10},
+	}
+	got, err := decodeDeviceInfo(fields)
+	if err != nil {
+		t.Fatalf("decoding device info: %v", err)
+	}
+	want := DeviceInfo{
+		Serial:                   0x01020304,
+		Version:                  Version{5, 7, 1},
+		Formfactor:               FormfactorUSBCKeychainFIPS,
+		IsFIPS:                   true,
+		IsSKY:                    true,
+		USBSupported:             ApplicationOTP | ApplicationU2F | ApplicationOpenPGP | ApplicationPIV | ApplicationOATH | ApplicationFIDO2,
+		USBEnabled:               ApplicationU2F | ApplicationPIV | ApplicationFIDO2,
+		NFCSupported:             ApplicationOTP | ApplicationU2F | ApplicationOpenPGP | ApplicationPIV | ApplicationOATH,
+		ConfigLocked:             true,
+		AutoEjectTimeout:         300 * time.Second,
+		ChallengeResponseTimeout: 15 * time.Second,
+		Flags:                    DeviceFlagTouchEject,
+		ResetBlocked:             ApplicationPIV,
+	}
+	if *got != want {
+		t.Errorf("device info got=%+v, want=%+v", *got, want)
+	}
+
+	for _, f := range []map[byte][]byte{
+		{deviceInfoSerial: {0x01, 0x02}},
+		{deviceInfoVersion: {5, 7}},
+		{deviceInfoFormfactor: {}},
+		{deviceInfoUSBEnabled: {0x00, 0x00, 0x10}},
+	} {
+		if _, err := decodeDeviceInfo(f); err == nil {
+			t.Errorf("decoding %x: expected error", f)
+		}
+	}
+}
+
+func TestApplicationString(t *testing.T) {
+	tests := []struct {
+		a    Application
+		want string
+	}{
+		{0, "none"},
+		{ApplicationPIV, "PIV"},
+		{ApplicationOTP | ApplicationFIDO2, "OTP|FIDO2"},
+		{ApplicationPIV | 0x4000, "PIV|unknown(0x4000)"},
+	}
+	for _, test := range tests {
+		if got := test.a.String(); got != test.want {
+			t.Errorf("Application(0x%04x).String() got=%q, want=%q", uint16(test.a), got, test.want)
+		}
+	}
+}
+
+// deviceInfoTransport wraps a Transport, replacing the device information
+// reported by the management applet.
+type deviceInfoTransport struct {
+	Transport
+	info []byte
+}
+
+func (d *deviceInfoTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	if len(req) > 1 && req[1] == insGetDeviceInfo {
+		return d.info, 0x9000, nil
+	}
+	return d.Transport.Transmit(req)
+}
+
+func TestResetBlocked(t *testing.T) {
+	dt := &deviceInfoTransport{
+		Transport: pivtest.New(pivtest.Config{Version: [3]byte{5, 7, 1}, Formfactor: FormfactorUSBCBio}),
+		info: []byte{
+			0x07,
+			deviceInfoFormfactor, 0x01, FormfactorUSBCBio,
+			deviceInfoResetBlocked, 0x02, 0x00, 0x10,
+		},
+	}
+	yk, err := OpenTransport(dt)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	if err := yk.Reset(); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("reset got err=%v, want ErrMissingCapability", err)
+	}
+	// Resetting is allowed once the YubiKey no longer blocks it.
+	dt.info = []byte{0x03, deviceInfoFormfactor, 0x01, FormfactorUSBCBio}
+	if err := yk.Reset(); err != nil {
+		t.Errorf("reset: %v", err)
+	}
+}
+
+func TestUnblockBio(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 7, 1}, Formfactor: FormfactorUSBABio})
+	info, err := yk.DeviceInfo()
+	if err != nil {
+		t.Fatalf("getting device info: %v", err)
+	}
+	if !isBio(info.Formfactor) {
+		t.Skipf("test requires a yubikey bio: got form factor %v", info.Formfactor)
+	}
+
+	if err := yk.Unblock(DefaultPUK, DefaultPIN); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("unblock got err=%v, want ErrMissingCapability", err)
+	}
+}
+
+func TestUnblockOlderFirmware(t *testing.T) {
+	// YubiKeys with firmware older than 5.5.0 can't be a YubiKey Bio, and
+	// aren't checked.
+	dt := &deviceInfoTransport{
+		Transport: pivtest.New(pivtest.Config{Version: [3]byte{5, 4, 3}}),
+		info:      []byte{0x03, deviceInfoFormfactor, 0x01, FormfactorUSBABio},
+	}
+	yk, err := OpenTransport(dt)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	if err := yk.Unblock(DefaultPUK, DefaultPIN); err != nil {
+		t.Errorf("unblock: %v", err)
+	}
+}
+
+// restoreDeviceConfig restores the YubiKey's device configuration when the
+// test completes.
+func restoreDeviceConfig(t *testing.T, yk *YubiKey) *DeviceInfo {
+	t.Helper()
+	info, err := yk.DeviceInfo()
+	if err != nil {
+		t.Fatalf("getting device info: %v", err)
+	}
+	t.Cleanup(func() {
+		config := &DeviceConfig{
+			USBEnabled:               &info.USBEnabled,
+			NFCEnabled:               &info.NFCEnabled,
+			AutoEjectTimeout:         &info.AutoEjectTimeout,
+			ChallengeResponseTimeout: &info.ChallengeResponseTimeout,
+			Flags:                    &info.Flags,
+		}
+		if err := yk.SetDeviceConfig([16]byte{}, config); err != nil {
+			t.Errorf("restoring device config: %v", err)
+		}
+	})
+	return info
+}
+
+func TestSetDeviceConfig(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{})
+	orig := restoreDeviceConfig(t, yk)
+
+	usb := ApplicationPIV | ApplicationU2F | ApplicationFIDO2
+	var nfc Application
+	eject := 30 * time.Second
+	flags := DeviceFlagTouchEject
+	config := &DeviceConfig{
+		USBEnabled:       &usb,
+		NFCEnabled:       &nfc,
+		AutoEjectTimeout: &eject,
+		Flags:            &flags,
+	}
+	if err := yk.SetDeviceConfig([16]byte{}, config); err != nil {
+		t.Fatalf("setting device config: %v", err)
+	}
+	info, err := yk.DeviceInfo()
+	if err != nil {
+		t.Fatalf("getting device info: %v", err)
+	}
+	if info.USBEnabled != usb || info.NFCEnabled != nfc {
+		t.Errorf("enabled applications got usb=%v nfc=%v, want usb=%v nfc=%v", info.USBEnabled, info.NFCEnabled, usb, nfc)
+	}
+	if info.AutoEjectTimeout != eject || info.Flags != flags {
+		t.Errorf("eject config got timeout=%v flags=0x%02x, want timeout=%v flags=0x%02x", info.AutoEjectTimeout, info.Flags, eject, flags)
+	}
+	// Unchanged fields keep their values.
+	if info.ChallengeResponseTimeout != orig.ChallengeResponseTimeout {
+		t.Errorf("challenge-response timeout got=%v, want=%v", info.ChallengeResponseTimeout, orig.ChallengeResponseTimeout)
+	}
+
+	var none Application
+	if err := yk.SetDeviceConfig([16]byte{}, &DeviceConfig{USBEnabled: &none}); err == nil {
+		t.Errorf("disabling all applications over usb succeeded")
+	}
+}
+
+func TestSetConfigLock(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{})
+	restoreDeviceConfig(t, yk)
+
+	code := [16]byte{0: 0x01, 15: 0xff}
+	if err := yk.SetConfigLock([16]byte{}, code); err != nil {
+		t.Fatalf("setting lock code: %v", err)
+	}
+	locked := true
+	t.Cleanup(func() {
+		if !locked {
+			return
+		}
+		if err := yk.SetConfigLock(code, [16]byte{}); err != nil {
+			t.Errorf("clearing lock code: %v", err)
+		}
+	})
+	if info, err := yk.DeviceInfo(); err != nil || !info.ConfigLocked {
+		t.Fatalf("expected config to be locked, got info=%+v, err=%v", info, err)
+	}
+
+	timeout := 10 * time.Second
+	config := &DeviceConfig{ChallengeResponseTimeout: &timeout}
+	if err := yk.SetDeviceConfig([16]byte{}, config); err == nil {
+		t.Errorf("setting locked device config without lock code succeeded")
+	}
+	if err := yk.SetDeviceConfig(code, config); err != nil {
+		t.Errorf("setting locked device config: %v", err)
+	}
+
+	if err := yk.SetConfigLock(code, [16]byte{}); err != nil {
+		t.Fatalf("clearing lock code: %v", err)
+	}
+	locked = false
+	info, err := yk.DeviceInfo()
+	if err != nil {
+		t.Fatalf("getting device info: %v", err)
+	}
+	if info.ConfigLocked {
+		t.Errorf("config still locked after clearing lock code")
+	}
+	if info.ChallengeResponseTimeout != timeout {
+		t.Errorf("challenge-response timeout got=%v, want=%v", info.ChallengeResponseTimeout, timeout)
+	}
+}
+
+func TestEncodeDeviceConfig(t *testing.T) {
+	usb := ApplicationPIV
+	code := [16]byte{0: 0x01}
+	got, err := encodeDeviceConfig(code, &DeviceConfig{USBEnabled: &usb, Reboot: true}, nil)
+	if err != nil {
+		t.Fatalf("encoding device config: %v", err)
+	}
+	want := []byte{
+		0x18,
+		deviceInfoReboot, 0x00,
+		deviceInfoUnlock, 0x10, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		deviceInfoUSBEnabled, 0x02, 0x00, 0x10,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("encoded device config got=%x, want=%x", got, want)
+	}
+
+	long := 256 * time.Second
+	if _, err := encodeDeviceConfig([16]byte{}, &DeviceConfig{ChallengeResponseTimeout: &long}, nil); err == nil {
+		t.Errorf("encoding challenge-response timeout of %v succeeded", long)
+	}
+	neg := -time.Second
+	if _, err := encodeDeviceConfig([16]byte{}, &DeviceConfig{AutoEjectTimeout: &neg}, nil); err == nil {
+		t.Errorf("encoding auto-eject timeout of %v succeeded", neg)
+	}
+}
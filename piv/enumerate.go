@@ -0,0 +1,162 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"fmt"
+)
+
+// CardInfo identifies a card connected to the system, as returned by
+// Enumerate.
+type CardInfo struct {
+	// Reader is the name of the reader holding the card, as accepted by Open.
+	Reader string
+	// IsYubiKey reports whether the card implements Yubico's management or
+	// OTP applets, and is therefore a YubiKey rather than another PIV card.
+	IsYubiKey bool
+	// Serial is the card's serial number, or zero if the card doesn't report
+	// one.
+	Serial uint32
+	// Version is the version reported by the card's PIV applet, or zero if
+	// the card doesn't report one. See YubiKey.Version for details.
+	Version Version
+	// Formfactor is the YubiKey's form factor, or zero if unknown. Only
+	// YubiKeys with firmware 5.0.0 or later report their form factor.
+	Formfactor Formfactor
+
+	// Err is set if the card couldn't be queried, for example because the
+	// reader is empty or another application holds exclusive access to it.
+	// Only Reader is set if Err is non-nil.
+	Err error
+}
+
+// Enumerate lists the cards available via PC/SC, along with information
+// identifying each one, such as its serial number.
+//
+// Cards are queried without exclusive access, so cards already opened by other
+// applications in shared mode can still be listed. Querying a card selects
+// applets other than PIV, which resets the card's PIN verification status for
+// other applications.
+//
+//	cards, err := piv.Enumerate()
+//	if err != nil {
+//		// ...
+//	}
+//	for _, card := range cards {
+//		if card.Err == nil && card.IsYubiKey {
+//			fmt.Printf("%s: serial %d, firmware %v\n", card.Reader, card.Serial, card.Version)
+//		}
+//	}
+func Enumerate() ([]CardInfo, error) {
+	var c Client
+	return c.Enumerate()
+}
+
+// OpenSerial opens the YubiKey with the provided serial number. If no card
+// with the serial number is connected, the returned error wraps ErrNotFound.
+func OpenSerial(serial uint32) (*YubiKey, error) {
+	var c Client
+	return c.OpenSerial(serial)
+}
+
+// Enumerate lists the cards matching the client's ReaderFilter. See the package
+// level Enumerate function for details.
+func (c *Client) Enumerate() ([]CardInfo, error) {
+	readers, err := c.Cards()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]CardInfo, 0, len(readers))
+	for _, reader := range readers {
+		info, err := c.cardInfo(reader)
+		if err != nil {
+			info = CardInfo{Reader: reader, Err: err}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// OpenSerial opens the YubiKey with the provided serial number using the
+// client's configuration. See the package level OpenSerial function for
+// details.
+func (c *Client) OpenSerial(serial uint32) (*YubiKey, error) {
+	infos, err := c.Enumerate()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Err != nil || info.Serial != serial {
+			continue
+		}
+		yk, err := c.Open(info.Reader)
+		if err != nil {
+			return nil, err
+		}
+		// The card may have been replaced since it was enumerated.
+		got, err := yk.Serial()
+		if err != nil {
+			yk.Close()
+			return nil, fmt.Errorf("getting serial number: %w", err)
+		}
+		if got != serial {
+			yk.Close()
+			break
+		}
+		return yk, nil
+	}
+	return nil, fmt.Errorf("no card with serial number %d: %w", serial, ErrNotFound)
+}
+
+// cardInfo connects to the card in a reader and queries its identity.
+func (c *Client) cardInfo(reader string) (CardInfo, error) {
+	t, err := c.connect(reader, true)
+	if err != nil {
+		return CardInfo{}, err
+	}
+	defer t.Close()
+	if err := t.Begin(); err != nil {
+		return CardInfo{}, fmt.Errorf("beginning smart card transaction: %w", err)
+	}
+	defer t.End()
+
+	info := ykCardInfo(&scTx{t: t, trace: c.Tracer})
+	info.Reader = reader
+	return info, nil
+}
+
+// ykCardInfo queries the identity of a card. Cards aren't required to support
+// any of the commands used, so errors are ignored and the corresponding fields
+// left unset.
+func ykCardInfo(tx *scTx) CardInfo {
+	var info CardInfo
+	if err := ykSelectApplication(tx, aidPIV[:]); err == nil {
+		if v, err := ykVersion(tx); err == nil {
+			info.Version = Version{int(v.major), int(v.minor), int(v.patch)}
+			if serial, err := ykSerial(tx, v); err == nil {
+				info.Serial = serial
+			}
+		}
+	}
+	if err := ykSelectApplication(tx, aidManagement[:]); err == nil {
+		info.IsYubiKey = true
+		if d, err := ykReadDeviceInfo(tx); err == nil {
+			info.Formfactor = d.Formfactor
+		}
+	} else if err := ykSelectApplication(tx, aidYubiKey[:]); err == nil {
+		info.IsYubiKey = true
+	}
+	return info
+}
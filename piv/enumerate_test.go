@@ -0,0 +1,70 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"testing"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
+)
+
+func TestCardInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  pivtest.Config
+		want CardInfo
+	}{
+		{
+			name: "5.4.3",
+			cfg: pivtest.Config{
+				Version:    [3]byte{5, 4, 3},
+				Serial:     11111111,
+				Formfactor: FormfactorUSBCNano,
+			},
+			want: CardInfo{
+				IsYubiKey:  true,
+				Serial:     11111111,
+				Version:    Version{5, 4, 3},
+				Formfactor: FormfactorUSBCNano,
+			},
+		},
+		{
+			// Form factor isn't reported before 5.0.0.
+			name: "4.3.0",
+			cfg: pivtest.Config{
+				Version:    [3]byte{4, 3, 0},
+				Serial:     22222222,
+				Formfactor: FormfactorUSBCNano,
+			},
+			want: CardInfo{
+				IsYubiKey: true,
+				Serial:    22222222,
+				Version:   Version{4, 3, 0},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			card := pivtest.New(test.cfg)
+			if err := card.Begin(); err != nil {
+				t.Fatalf("beginning transaction: %v", err)
+			}
+			defer card.End()
+			if got := ykCardInfo(&scTx{t: card}); got != test.want {
+				t.Errorf("card info got=%+v, want=%+v", got, test.want)
+			}
+		})
+	}
+}
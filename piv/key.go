@@ -16,7 +16,9 @@ package piv
 
 import (
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
@@ -447,15 +449,26 @@ type Algorithm int
 // Algorithms supported by this package. Note that not all cards will support
 // every algorithm.
 //
-// AlgorithmEd25519 is currently only implemented by SoloKeys.
+// AlgorithmEd25519 is implemented by SoloKeys and by YubiKeys with firmware
+// 5.7.0 or later, which use different identifiers for the algorithm. The
+// identifier is chosen based on the version reported by the card.
 //
-// For algorithm discovery, see: https://github.com/ericchiang/piv-go/issues/1
+// AlgorithmX25519 keys are used for key agreement, see X25519PrivateKey. They
+// require a YubiKey with firmware 5.7.0 or later.
+//
+// AlgorithmRSA3072 and AlgorithmRSA4096 require a YubiKey with firmware 5.7.0
+// or later.
+//
+// To discover the algorithms supported by a card, use YubiKey.Capabilities.
 const (
 	AlgorithmEC256 Algorithm = iota + 1
 	AlgorithmEC384
 	AlgorithmEd25519
 	AlgorithmRSA1024
 	AlgorithmRSA2048
+	AlgorithmRSA3072
+	AlgorithmRSA4096
+	AlgorithmX25519
 )
 
 // PINPolicy represents PIN requirements when signing or decrypting with an
@@ -545,6 +558,9 @@ var algorithmsMap = map[Algorithm]byte{
 	AlgorithmEd25519: algEd25519,
 	AlgorithmRSA1024: algRSA1024,
 	AlgorithmRSA2048: algRSA2048,
+	AlgorithmRSA3072: algRSA3072,
+	AlgorithmRSA4096: algRSA4096,
+	AlgorithmX25519:  algX25519,
 }
 
 var algorithmsMapInv = map[byte]Algorithm{
@@ -553,11 +569,35 @@ var algorithmsMapInv = map[byte]Algorithm{
 	algEd25519: AlgorithmEd25519,
 	algRSA1024: AlgorithmRSA1024,
 	algRSA2048: AlgorithmRSA2048,
+	algRSA3072: AlgorithmRSA3072,
+	algRSA4096: AlgorithmRSA4096,
+
+	algYubicoEd25519: AlgorithmEd25519,
+	algX25519:        AlgorithmX25519,
+}
+
+// algorithmID returns the identifier used by the card for an algorithm.
+// YubiKeys identify Ed25519 keys differently than SoloKeys.
+func (yk *YubiKey) algorithmID(a Algorithm) (byte, bool) {
+	if a == AlgorithmEd25519 && yk.yubicoEd25519() {
+		return algYubicoEd25519, true
+	}
+	alg, ok := algorithmsMap[a]
+	return alg, ok
+}
+
+// yubicoEd25519 reports whether the card uses Yubico's identifier for Ed25519
+// keys.
+func (yk *YubiKey) yubicoEd25519() bool {
+	return !yk.generic && supportsVersion(yk.Version(), 5, 7, 0)
 }
 
 // AttestationCertificate returns the YubiKey's attestation certificate, which
 // is unique to the key and signed by Yubico.
 func (yk *YubiKey) AttestationCertificate() (*x509.Certificate, error) {
+	if err := yk.requireYubico("getting attestation certificate"); err != nil {
+		return nil, err
+	}
 	return yk.Certificate(slotAttestation)
 }
 
@@ -573,8 +613,25 @@ func (yk *YubiKey) AttestationCertificate() (*x509.Certificate, error) {
 // is NOT suitable for TLS.
 //
 // If the slot doesn't have a key, the returned error wraps ErrNotFound.
+//
+// For X25519 keys, the certificate's PublicKey is set to an *ecdh.PublicKey,
+// which x509.ParseCertificate doesn't do.
 func (yk *YubiKey) Attest(slot Slot) (*x509.Certificate, error) {
-	cert, err := ykAttest(yk.tx, slot)
+	return yk.AttestContext(context.Background(), slot)
+}
+
+// AttestContext is like Attest, but returns an error wrapping ErrCanceled if the
+// context is done before the card responds.
+func (yk *YubiKey) AttestContext(ctx context.Context, slot Slot) (*x509.Certificate, error) {
+	if err := yk.requireYubico("attestation"); err != nil {
+		return nil, err
+	}
+	var cert *x509.Certificate
+	err := yk.do(ctx, func(tx *scTx) error {
+		var err error
+		cert, err = ykAttest(tx, slot)
+		return err
+	})
 	if err == nil {
 		return cert, nil
 	}
@@ -601,7 +658,7 @@ func ykAttest(tx *scTx, slot Slot) (*x509.Certificate, error) {
 		}
 		resp = b
 	}
-	cert, err := x509.ParseCertificate(resp)
+	cert, err := parseCertificate(resp)
 	if err != nil {
 		return nil, fmt.Errorf("parsing certificate: %v", err)
 	}
@@ -660,15 +717,9 @@ func (ki *KeyInfo) unmarshal(b []byte) error {
 				return fmt.Errorf("parse public key: %w", err)
 			}
 		default:
-			// TODO: According to the Yubico website, we get two more fields,
-			// if we pass 0x80 or 0x81 as slots:
-			//     1. Default value (for PIN/PUK and management key): Whether the
-			//        default value is used.
-			//     2. Retries (for PIN/PUK): The number of retries remaining
-			// However, it seems the reference implementation does not expect
-			// these and can not parse them out:
-			// https://github.com/Yubico/yubico-piv-tool/blob/yubico-piv-tool-2.3.1/lib/util.c#L1529
-			// For now, we just ignore them.
+			// The PIN and PUK slots (0x80 and 0x81) also return whether the
+			// default value is set and the number of retries. These are
+			// exposed through PINMetadata and PUKMetadata instead.
 		}
 	}
 	return nil
@@ -677,13 +728,29 @@ func (ki *KeyInfo) unmarshal(b []byte) error {
 // KeyInfo returns public information about the given key slot. It is only
 // supported by YubiKeys with a version >= 5.3.0.
 func (yk *YubiKey) KeyInfo(slot Slot) (KeyInfo, error) {
+	if err := yk.requireYubico("getting key info"); err != nil {
+		return KeyInfo{}, err
+	}
+	var ki KeyInfo
+	err := yk.do(context.Background(), func(tx *scTx) error {
+		var err error
+		ki, err = ykKeyInfo(tx, slot)
+		return err
+	})
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	return ki, nil
+}
+
+func ykKeyInfo(tx *scTx, slot Slot) (KeyInfo, error) {
 	// https://developers.yubico.com/PIV/Introduction/Yubico_extensions.html#_get_metadata
 	cmd := apdu{
 		instruction: insGetMetadata,
 		param1:      0x00,
 		param2:      byte(slot.Key),
 	}
-	resp, err := yk.tx.Transmit(cmd)
+	resp, err := tx.Transmit(cmd)
 	if err != nil {
 		return KeyInfo{}, fmt.Errorf("command failed: %w", err)
 	}
@@ -699,32 +766,28 @@ func (yk *YubiKey) KeyInfo(slot Slot) (KeyInfo, error) {
 // If a certificate hasn't been set in the provided slot, the returned error
 // wraps ErrNotFound.
 func (yk *YubiKey) Certificate(slot Slot) (*x509.Certificate, error) {
-	cmd := apdu{
-		instruction: insGetData,
-		param1:      0x3f,
-		param2:      0xff,
-		data: []byte{
-			0x5c, // Tag list
-			0x03, // Length of tag
-			byte(slot.Object >> 16),
-			byte(slot.Object >> 8),
-			byte(slot.Object),
-		},
-	}
-	resp, err := yk.tx.Transmit(cmd)
+	var cert *x509.Certificate
+	err := yk.do(context.Background(), func(tx *scTx) error {
+		var err error
+		cert, err = ykCertificate(tx, slot)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("command failed: %w", err)
+		return nil, err
 	}
-	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=85
-	obj, _, err := unmarshalASN1(resp, 1, 0x13) // tag 0x53
+	return cert, nil
+}
+
+func ykCertificate(tx *scTx, slot Slot) (*x509.Certificate, error) {
+	obj, err := ykObject(tx, slot.Object)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshaling response: %v", err)
+		return nil, err
 	}
 	certDER, _, err := unmarshalASN1(obj, 1, 0x10) // tag 0x70
 	if err != nil {
 		return nil, fmt.Errorf("unmarshaling certificate: %v", err)
 	}
-	cert, err := x509.ParseCertificate(certDER)
+	cert, err := parseCertificate(certDER)
 	if err != nil {
 		return nil, fmt.Errorf("parsing certificate: %v", err)
 	}
@@ -757,11 +820,13 @@ func marshalASN1(tag byte, data []byte) []byte {
 // SetCertificate stores a certificate object in the provided slot. Setting a
 // certificate isn't required to use the associated key for signing or
 // decryption.
-func (yk *YubiKey) SetCertificate(key [24]byte, slot Slot, cert *x509.Certificate) error {
-	if err := ykAuthenticate(yk.tx, key, yk.rand); err != nil {
-		return fmt.Errorf("authenticating with management key: %w", err)
-	}
-	return ykStoreCertificate(yk.tx, slot, cert)
+func (yk *YubiKey) SetCertificate(key ManagementKey, slot Slot, cert *x509.Certificate) error {
+	return yk.do(context.Background(), func(tx *scTx) error {
+		if err := yk.authenticate(tx, key); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykStoreCertificate(tx, slot, cert)
+	})
 }
 
 func ykStoreCertificate(tx *scTx, slot Slot, cert *x509.Certificate) error {
@@ -771,14 +836,46 @@ func ykStoreCertificate(tx *scTx, slot Slot, cert *x509.Certificate) error {
 	data = append(data, marshalASN1(0x71, []byte{0x00})...)
 	// Error Detection Code
 	data = append(data, marshalASN1(0xfe, nil)...)
+	return ykSetObject(tx, slot.Object, data)
+}
+
+// ykObject returns the contents of a data object.
+func ykObject(tx *scTx, id uint32) ([]byte, error) {
+	cmd := apdu{
+		instruction: insGetData,
+		param1:      0x3f,
+		param2:      0xff,
+		data: []byte{
+			0x5c, // Tag list
+			0x03, // Length of tag
+			byte(id >> 16),
+			byte(id >> 8),
+			byte(id),
+		},
+	}
+	resp, err := tx.Transmit(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=85
+	obj, _, err := unmarshalASN1(resp, 1, 0x13) // tag 0x53
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling response: %v", err)
+	}
+	return obj, nil
+}
+
+// ykSetObject stores the contents of a data object. Empty contents delete the
+// object.
+func ykSetObject(tx *scTx, id uint32, obj []byte) error {
 	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=94
-	data = append([]byte{
+	data := append([]byte{
 		0x5c, // Tag list
 		0x03, // Length of tag
-		byte(slot.Object >> 16),
-		byte(slot.Object >> 8),
-		byte(slot.Object),
-	}, marshalASN1(0x53, data)...)
+		byte(id >> 16),
+		byte(id >> 8),
+		byte(id),
+	}, marshalASN1(0x53, obj)...)
 	cmd := apdu{
 		instruction: insPutData,
 		param1:      0x3f,
@@ -791,10 +888,123 @@ func ykStoreCertificate(tx *scTx, slot Slot, cert *x509.Certificate) error {
 	return nil
 }
 
+// MoveKey moves the private key in one slot to another slot, leaving the
+// original slot empty. The destination slot must not already hold a key, and
+// keys can't be moved into or out of the attestation slot. Certificates aren't
+// moved, use MoveKeyAndCertificate to move both.
+//
+// This method is only supported for YubiKey versions >= 5.7.0, and returns an
+// error wrapping ErrMissingCapability for older cards.
+func (yk *YubiKey) MoveKey(key ManagementKey, from, to Slot) error {
+	return yk.moveKey(key, from, to, false)
+}
+
+// MoveKeyAndCertificate is like MoveKey, but also moves the certificate stored
+// in the original slot. If the original slot doesn't have a certificate, any
+// certificate in the destination slot is deleted.
+func (yk *YubiKey) MoveKeyAndCertificate(key ManagementKey, from, to Slot) error {
+	return yk.moveKey(key, from, to, true)
+}
+
+func (yk *YubiKey) moveKey(key ManagementKey, from, to Slot, cert bool) error {
+	if err := yk.requireMoveKey("moving keys"); err != nil {
+		return err
+	}
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		if err := yk.authenticate(tx, key); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		if err := ykMoveKey(tx, byte(from.Key), byte(to.Key)); err != nil {
+			return err
+		}
+		if !cert {
+			return nil
+		}
+		obj, err := ykObject(tx, from.Object)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("getting certificate: %w", err)
+		}
+		if err := ykSetObject(tx, to.Object, obj); err != nil {
+			return fmt.Errorf("storing certificate: %w", err)
+		}
+		if obj == nil {
+			return nil
+		}
+		if err := ykSetObject(tx, from.Object, nil); err != nil {
+			return fmt.Errorf("deleting certificate: %w", err)
+		}
+		return nil
+	})
+}
+
+// DeleteKey deletes the private key in a slot. Certificates aren't deleted,
+// use DeleteKeyAndCertificate to delete both.
+//
+// This method is only supported for YubiKey versions >= 5.7.0, and returns an
+// error wrapping ErrMissingCapability for older cards.
+func (yk *YubiKey) DeleteKey(key ManagementKey, slot Slot) error {
+	return yk.deleteKey(key, slot, false)
+}
+
+// DeleteKeyAndCertificate is like DeleteKey, but also deletes the certificate
+// stored in the slot.
+func (yk *YubiKey) DeleteKeyAndCertificate(key ManagementKey, slot Slot) error {
+	return yk.deleteKey(key, slot, true)
+}
+
+func (yk *YubiKey) deleteKey(key ManagementKey, slot Slot, cert bool) error {
+	if err := yk.requireMoveKey("deleting keys"); err != nil {
+		return err
+	}
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		if err := yk.authenticate(tx, key); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		// Deleting is a move to slot 0xff.
+		if err := ykMoveKey(tx, byte(slot.Key), 0xff); err != nil {
+			return err
+		}
+		if !cert {
+			return nil
+		}
+		if err := ykSetObject(tx, slot.Object, nil); err != nil {
+			return fmt.Errorf("deleting certificate: %w", err)
+		}
+		return nil
+	})
+}
+
+func (yk *YubiKey) requireMoveKey(op string) error {
+	if err := yk.requireYubico(op); err != nil {
+		return err
+	}
+	if !supportsVersion(yk.Version(), 5, 7, 0) {
+		return fmt.Errorf("%s requires firmware 5.7.0: %w", op, ErrMissingCapability)
+	}
+	return nil
+}
+
+// ykMoveKey moves the key in slot from to slot to. If to is 0xff, the key is
+// deleted.
+//
+// https://docs.yubico.com/yesdk/users-manual/application-piv/apdu/move-key.html
+func ykMoveKey(tx *scTx, from, to byte) error {
+	cmd := apdu{
+		instruction: insMoveKey,
+		param1:      to,
+		param2:      from,
+	}
+	if _, err := tx.Transmit(cmd); err != nil {
+		return fmt.Errorf("command failed: %w", err)
+	}
+	return nil
+}
+
 // Key is used for key generation and holds different options for the key.
 //
-// While keys can have default PIN and touch policies, this package currently
-// doesn't support this option, and all fields must be provided.
+// If both PINPolicy and TouchPolicy are unset, the card's default policies for
+// the slot are used. Policies are Yubico extensions, and must be unset when
+// generating keys on other PIV cards.
 type Key struct {
 	// Algorithm to use when generating the key.
 	Algorithm Algorithm
@@ -811,37 +1021,59 @@ type Key struct {
 
 // GenerateKey generates an asymmetric key on the card, returning the key's
 // public key.
-func (yk *YubiKey) GenerateKey(key [24]byte, slot Slot, opts Key) (crypto.PublicKey, error) {
-	if err := ykAuthenticate(yk.tx, key, yk.rand); err != nil {
-		return nil, fmt.Errorf("authenticating with management key: %w", err)
-	}
-	return ykGenerateKey(yk.tx, slot, opts)
+func (yk *YubiKey) GenerateKey(key ManagementKey, slot Slot, opts Key) (crypto.PublicKey, error) {
+	return yk.GenerateKeyContext(context.Background(), key, slot, opts)
 }
 
-func ykGenerateKey(tx *scTx, slot Slot, o Key) (crypto.PublicKey, error) {
-	alg, ok := algorithmsMap[o.Algorithm]
-	if !ok {
-		return nil, fmt.Errorf("unsupported algorithm")
+// GenerateKeyContext is like GenerateKey, but returns an error wrapping
+// ErrCanceled if the context is done before the card responds.
+func (yk *YubiKey) GenerateKeyContext(ctx context.Context, key ManagementKey, slot Slot, opts Key) (crypto.PublicKey, error) {
+	if opts.PINPolicy != 0 || opts.TouchPolicy != 0 {
+		if err := yk.requireYubico("setting pin or touch policy"); err != nil {
+			return nil, err
+		}
 	}
-	tp, ok := touchPolicyMap[o.TouchPolicy]
+	alg, ok := yk.algorithmID(opts.Algorithm)
 	if !ok {
-		return nil, fmt.Errorf("unsupported touch policy")
+		return nil, fmt.Errorf("unsupported algorithm")
 	}
-	pp, ok := pinPolicyMap[o.PINPolicy]
-	if !ok {
-		return nil, fmt.Errorf("unsupported pin policy")
+	var pub crypto.PublicKey
+	err := yk.doOnce(ctx, func(tx *scTx) error {
+		if err := yk.authenticate(tx, key); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		var err error
+		pub, err = ykGenerateKey(tx, slot, alg, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return pub, nil
+}
+
+func ykGenerateKey(tx *scTx, slot Slot, alg byte, o Key) (crypto.PublicKey, error) {
 	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=95
+	params := []byte{algTag, 0x01, alg}
+	// Policies are Yubico extensions. If unset, omit them for generic cards.
+	if o.PINPolicy != 0 || o.TouchPolicy != 0 {
+		tp, ok := touchPolicyMap[o.TouchPolicy]
+		if !ok {
+			return nil, fmt.Errorf("unsupported touch policy")
+		}
+		pp, ok := pinPolicyMap[o.PINPolicy]
+		if !ok {
+			return nil, fmt.Errorf("unsupported pin policy")
+		}
+		params = append(params,
+			tagPINPolicy, 0x01, pp,
+			tagTouchPolicy, 0x01, tp,
+		)
+	}
 	cmd := apdu{
 		instruction: insGenerateAsymmetric,
 		param2:      byte(slot.Key),
-		data: []byte{
-			0xac,
-			0x09, // length of remaining data
-			algTag, 0x01, alg,
-			tagPINPolicy, 0x01, pp,
-			tagTouchPolicy, 0x01, tp,
-		},
+		data:        append([]byte{0xac, byte(len(params))}, params...),
 	}
 	resp, err := tx.Transmit(cmd)
 	if err != nil {
@@ -860,7 +1092,7 @@ func ykGenerateKey(tx *scTx, slot Slot, o Key) (crypto.PublicKey, error) {
 func decodePublic(b []byte, alg Algorithm) (crypto.PublicKey, error) {
 	var curve elliptic.Curve
 	switch alg {
-	case AlgorithmRSA1024, AlgorithmRSA2048:
+	case AlgorithmRSA1024, AlgorithmRSA2048, AlgorithmRSA3072, AlgorithmRSA4096:
 		pub, err := decodeRSAPublic(b)
 		if err != nil {
 			return nil, fmt.Errorf("decoding rsa public key: %v", err)
@@ -876,6 +1108,12 @@ func decodePublic(b []byte, alg Algorithm) (crypto.PublicKey, error) {
 			return nil, fmt.Errorf("decoding ed25519 public key: %v", err)
 		}
 		return pub, nil
+	case AlgorithmX25519:
+		pub, err := decodeX25519Public(b)
+		if err != nil {
+			return nil, fmt.Errorf("decoding x25519 public key: %v", err)
+		}
+		return pub, nil
 	default:
 		return nil, fmt.Errorf("unsupported algorithm")
 	}
@@ -917,7 +1155,7 @@ type KeyAuth struct {
 	PINPolicy PINPolicy
 }
 
-func (k KeyAuth) authTx(yk *YubiKey, pp PINPolicy) error {
+func (k KeyAuth) authTx(tx *scTx, pp PINPolicy) error {
 	// PINPolicyNever shouldn't require a PIN.
 	if pp == PINPolicyNever {
 		return nil
@@ -926,13 +1164,13 @@ func (k KeyAuth) authTx(yk *YubiKey, pp PINPolicy) error {
 	// PINPolicyAlways should always prompt a PIN even if the key says that
 	// login isn't needed.
 	// https://github.com/go-piv/piv-go/issues/49
-	if pp != PINPolicyAlways && !ykLoginNeeded(yk.tx) {
+	if pp != PINPolicyAlways && !ykLoginNeeded(tx) {
 		return nil
 	}
 
 	// Check if OCC biometric verification is required.
 	if pp == PINPolicyMatchOnce || pp == PINPolicyMatchAlways {
-		occNeeded, err := ykOCCLoginNeeded(yk.tx)
+		occNeeded, err := ykOCCLoginNeeded(tx)
 		if err != nil {
 			return err
 		}
@@ -947,7 +1185,7 @@ func (k KeyAuth) authTx(yk *YubiKey, pp PINPolicy) error {
 			}
 		}
 
-		_, err = ykOCCLogin(yk.tx, false, k.PIN)
+		_, err = ykOCCLogin(tx, false, k.PIN)
 		return err
 	}
 
@@ -963,17 +1201,36 @@ func (k KeyAuth) authTx(yk *YubiKey, pp PINPolicy) error {
 	if pin == "" {
 		return fmt.Errorf("pin required but wasn't provided")
 	}
-	return ykLogin(yk.tx, pin)
+	return ykLogin(tx, pin)
 }
 
-func (k KeyAuth) do(yk *YubiKey, pp PINPolicy, f func(tx *scTx) ([]byte, error)) ([]byte, error) {
-	if err := k.authTx(yk, pp); err != nil {
+func (k KeyAuth) do(ctx context.Context, yk *YubiKey, pp PINPolicy, f func(tx *scTx) ([]byte, error)) ([]byte, error) {
+	var b []byte
+	err := yk.do(ctx, func(tx *scTx) error {
+		if yk.perOp && pp == PINPolicyOnce && k.PIN == "" && k.PINPrompt == nil {
+			// Reuse the PIN passed to VerifyPIN if another application reset
+			// its verification status.
+			k.PIN = yk.pin
+		}
+		if err := k.authTx(tx, pp); err != nil {
+			return err
+		}
+		var err error
+		b, err = f(tx)
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
-	return f(yk.tx)
+	return b, nil
 }
 
 func pinPolicy(yk *YubiKey, slot Slot) (PINPolicy, error) {
+	if yk.generic {
+		// Without Yubico's extensions, there's no way to query a key's PIN
+		// policy. Guess PINPolicyAlways, verifying the PIN before each use.
+		return PINPolicyAlways, nil
+	}
 	if supportsVersion(yk.Version(), 5, 3, 0) {
 		info, err := yk.KeyInfo(slot)
 		if err != nil {
@@ -1005,7 +1262,15 @@ func pinPolicy(yk *YubiKey, slot Slot) (PINPolicy, error) {
 
 // PrivateKey is used to access signing and decryption options for the key
 // stored in the slot. The returned key implements crypto.Signer and/or
-// crypto.Decrypter depending on the key type.
+// crypto.Decrypter depending on the key type, as well as ContextSigner and/or
+// ContextDecrypter.
+//
+// X25519 keys can't sign or decrypt, and are returned as *X25519PrivateKey for
+// key agreement.
+//
+// RSA keys accept the same decryption options as rsa.PrivateKey: nil or
+// *rsa.PKCS1v15DecryptOptions for PKCS #1 v1.5 padding, and *rsa.OAEPOptions
+// for OAEP padding. Padding is checked in constant time.
 //
 // If the public key hasn't been stored externally, it can be provided by
 // fetching the slot's attestation certificate:
@@ -1021,9 +1286,10 @@ func (yk *YubiKey) PrivateKey(slot Slot, public crypto.PublicKey, auth KeyAuth)
 		// If the PIN policy is manually specified, trust that value instead of
 		// trying to use the attestation certificate.
 		pp = auth.PINPolicy
-	} else if auth.PIN != "" || auth.PINPrompt != nil {
+	} else if auth.PIN != "" || auth.PINPrompt != nil || yk.perOp {
 		// Attempt to determine the key's PIN policy. This helps inform the
-		// strategy for when to prompt for a PIN.
+		// strategy for when to prompt for a PIN, or for shared connections,
+		// when to verify the PIN passed to VerifyPIN again.
 		policy, err := pinPolicy(yk, slot)
 		if err != nil {
 			return nil, err
@@ -1035,9 +1301,18 @@ func (yk *YubiKey) PrivateKey(slot Slot, public crypto.PublicKey, auth KeyAuth)
 	case *ecdsa.PublicKey:
 		return &ECDSAPrivateKey{yk, slot, pub, auth, pp}, nil
 	case ed25519.PublicKey:
-		return &keyEd25519{yk, slot, pub, auth, pp}, nil
+		alg := byte(algEd25519)
+		if yk.yubicoEd25519() {
+			alg = algYubicoEd25519
+		}
+		return &keyEd25519{yk, slot, alg, pub, auth, pp}, nil
+	case *ecdh.PublicKey:
+		if pub.Curve() != ecdh.X25519() {
+			return nil, fmt.Errorf("unsupported ecdh curve: %v", pub.Curve())
+		}
+		return &X25519PrivateKey{yk, slot, pub, auth, pp}, nil
 	case *rsa.PublicKey:
-		return &keyRSA{yk, slot, pub, auth, pp}, nil
+		return &RSAPrivateKey{yk, slot, pub, auth, pp}, nil
 	default:
 		return nil, fmt.Errorf("unsupported public key type: %T", public)
 	}
@@ -1053,7 +1328,11 @@ func (yk *YubiKey) PrivateKey(slot Slot, public crypto.PublicKey, auth KeyAuth)
 // Keys generated outside of the YubiKey should not be considered hardware-backed,
 // as there's no way to prove the key wasn't copied, exfiltrated, or replaced with malicious
 // material before being imported.
-func (yk *YubiKey) SetPrivateKeyInsecure(key [24]byte, slot Slot, private crypto.PrivateKey, policy Key) error {
+func (yk *YubiKey) SetPrivateKeyInsecure(key ManagementKey, slot Slot, private crypto.PrivateKey, policy Key) error {
+	if err := yk.requireYubico("importing key"); err != nil {
+		return err
+	}
+
 	// Reference implementation
 	// https://github.com/Yubico/yubico-piv-tool/blob/671a5740ef09d6c5d9d33f6e5575450750b58bde/lib/ykpiv.c#L1812
 
@@ -1072,6 +1351,12 @@ func (yk *YubiKey) SetPrivateKeyInsecure(key [24]byte, slot Slot, private crypto
 		case 2048:
 			policy.Algorithm = AlgorithmRSA2048
 			elemLen = 128
+		case 3072:
+			policy.Algorithm = AlgorithmRSA3072
+			elemLen = 192
+		case 4096:
+			policy.Algorithm = AlgorithmRSA4096
+			elemLen = 256
 		default:
 			return errUnsupportedKeySize
 		}
@@ -1104,9 +1389,26 @@ func (yk *YubiKey) SetPrivateKeyInsecure(key [24]byte, slot Slot, private crypto
 		copy(privateKey[padding:], valueBytes)
 
 		params = append(params, privateKey)
+	case ed25519.PrivateKey:
+		paramTag = 0x07
+		policy.Algorithm = AlgorithmEd25519
+		elemLen = ed25519.SeedSize
+		params = append(params, priv.Seed())
+	case *ecdh.PrivateKey:
+		if priv.Curve() != ecdh.X25519() {
+			return fmt.Errorf("unsupported ecdh curve: %v", priv.Curve())
+		}
+		paramTag = 0x08
+		policy.Algorithm = AlgorithmX25519
+		elemLen = 32
+		params = append(params, priv.Bytes())
 	default:
 		return errors.New("unsupported private key type")
 	}
+	alg, ok := yk.algorithmID(policy.Algorithm)
+	if !ok {
+		return fmt.Errorf("unsupported algorithm")
+	}
 
 	elemLenASN1 := marshalASN1Length(uint64(elemLen))
 
@@ -1121,18 +1423,15 @@ func (yk *YubiKey) SetPrivateKeyInsecure(key [24]byte, slot Slot, private crypto
 		tags = append(tags, param...)
 	}
 
-	if err := ykAuthenticate(yk.tx, key, yk.rand); err != nil {
-		return fmt.Errorf("authenticating with management key: %w", err)
-	}
-
-	return ykImportKey(yk.tx, tags, slot, policy)
+	return yk.do(context.Background(), func(tx *scTx) error {
+		if err := yk.authenticate(tx, key); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykImportKey(tx, tags, slot, alg, policy)
+	})
 }
 
-func ykImportKey(tx *scTx, tags []byte, slot Slot, o Key) error {
-	alg, ok := algorithmsMap[o.Algorithm]
-	if !ok {
-		return fmt.Errorf("unsupported algorithm")
-	}
+func ykImportKey(tx *scTx, tags []byte, slot Slot, alg byte, o Key) error {
 	tp, ok := touchPolicyMap[o.TouchPolicy]
 	if !ok {
 		return fmt.Errorf("unsupported touch policy")
@@ -1180,11 +1479,16 @@ func (k *ECDSAPrivateKey) Public() crypto.PublicKey {
 	return k.pub
 }
 
-var _ crypto.Signer = (*ECDSAPrivateKey)(nil)
+var _ ContextSigner = (*ECDSAPrivateKey)(nil)
 
 // Sign implements crypto.Signer.
 func (k *ECDSAPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+	return k.SignContext(context.Background(), rand, digest, opts)
+}
+
+// SignContext implements ContextSigner.
+func (k *ECDSAPrivateKey) SignContext(ctx context.Context, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.auth.do(ctx, k.yk, k.pp, func(tx *scTx) ([]byte, error) {
 		return ykSignECDSA(tx, k.slot, k.pub, digest)
 	})
 }
@@ -1199,11 +1503,17 @@ func (k *ECDSAPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.Signer
 // used for the operation. Callers should use a cryptographic key
 // derivation function to extract the amount of bytes they need.
 func (k *ECDSAPrivateKey) SharedKey(peer *ecdsa.PublicKey) ([]byte, error) {
+	return k.SharedKeyContext(context.Background(), peer)
+}
+
+// SharedKeyContext is like SharedKey, but returns an error wrapping ErrCanceled
+// if the context is done before the card responds.
+func (k *ECDSAPrivateKey) SharedKeyContext(ctx context.Context, peer *ecdsa.PublicKey) ([]byte, error) {
 	if peer.Curve.Params().BitSize != k.pub.Curve.Params().BitSize {
 		return nil, errMismatchingAlgorithms
 	}
 	msg := elliptic.Marshal(peer.Curve, peer.X, peer.Y)
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+	return k.auth.do(ctx, k.yk, k.pp, func(tx *scTx) ([]byte, error) {
 		var alg byte
 		size := k.pub.Params().BitSize
 		switch size {
@@ -1241,25 +1551,99 @@ func (k *ECDSAPrivateKey) SharedKey(peer *ecdsa.PublicKey) ([]byte, error) {
 	})
 }
 
+// X25519PrivateKey is a crypto.PrivateKey implementation for X25519 keys. It
+// doesn't support signing, instead the method SharedKey performs
+// Diffie-Hellman key agreements.
+//
+// Keys returned by YubiKey.PrivateKey() may be type asserted to
+// *X25519PrivateKey, if the slot contains an X25519 key.
+type X25519PrivateKey struct {
+	yk   *YubiKey
+	slot Slot
+	pub  *ecdh.PublicKey
+	auth KeyAuth
+	pp   PINPolicy
+}
+
+// Public returns the public key associated with this private key.
+func (k *X25519PrivateKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// SharedKey performs a Diffie-Hellman key agreement with the peer to produce
+// a shared secret key. The result is the same as ecdh.PrivateKey.ECDH.
+//
+// Peer's public key must be an X25519 key, or an error will be returned.
+// Callers should use a cryptographic key derivation function to derive keys
+// from the result.
+func (k *X25519PrivateKey) SharedKey(peer *ecdh.PublicKey) ([]byte, error) {
+	return k.SharedKeyContext(context.Background(), peer)
+}
+
+// SharedKeyContext is like SharedKey, but returns an error wrapping ErrCanceled
+// if the context is done before the card responds.
+func (k *X25519PrivateKey) SharedKeyContext(ctx context.Context, peer *ecdh.PublicKey) ([]byte, error) {
+	if peer.Curve() != k.pub.Curve() {
+		return nil, errMismatchingAlgorithms
+	}
+	return k.auth.do(ctx, k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+		// https://docs.yubico.com/yesdk/users-manual/application-piv/apdu/auth-key-agree.html
+		cmd := apdu{
+			instruction: insAuthenticate,
+			param1:      algX25519,
+			param2:      byte(k.slot.Key),
+			data: marshalASN1(0x7c,
+				append([]byte{0x82, 0x00},
+					marshalASN1(0x85, peer.Bytes())...)),
+		}
+		resp, err := tx.Transmit(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("command failed: %w", err)
+		}
+		sig, _, err := unmarshalASN1(resp, 1, 0x1c) // 0x7c
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal response: %v", err)
+		}
+		secret, _, err := unmarshalASN1(sig, 2, 0x02) // 0x82
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal response shared key: %v", err)
+		}
+		return secret, nil
+	})
+}
+
 type keyEd25519 struct {
 	yk   *YubiKey
 	slot Slot
+	alg  byte
 	pub  ed25519.PublicKey
 	auth KeyAuth
 	pp   PINPolicy
 }
 
+var _ ContextSigner = (*keyEd25519)(nil)
+
 func (k *keyEd25519) Public() crypto.PublicKey {
 	return k.pub
 }
 
 func (k *keyEd25519) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
-		return skSignEd25519(tx, k.slot, k.pub, digest)
+	return k.SignContext(context.Background(), rand, digest, opts)
+}
+
+func (k *keyEd25519) SignContext(ctx context.Context, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.auth.do(ctx, k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+		return skSignEd25519(tx, k.alg, k.slot, k.pub, digest)
 	})
 }
 
-type keyRSA struct {
+// RSAPrivateKey is a crypto.PrivateKey implementation for RSA keys. It
+// implements crypto.Signer and crypto.Decrypter, and the method Raw performs
+// the RSA private key operation without any padding.
+//
+// Keys returned by YubiKey.PrivateKey() may be type asserted to
+// *RSAPrivateKey, if the slot contains an RSA key.
+type RSAPrivateKey struct {
 	yk   *YubiKey
 	slot Slot
 	pub  *rsa.PublicKey
@@ -1267,19 +1651,59 @@ type keyRSA struct {
 	pp   PINPolicy
 }
 
-func (k *keyRSA) Public() crypto.PublicKey {
+var (
+	_ ContextSigner    = (*RSAPrivateKey)(nil)
+	_ ContextDecrypter = (*RSAPrivateKey)(nil)
+)
+
+// Public returns the public key associated with this private key.
+func (k *RSAPrivateKey) Public() crypto.PublicKey {
 	return k.pub
 }
 
-func (k *keyRSA) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+// Sign implements crypto.Signer.
+func (k *RSAPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.SignContext(context.Background(), rand, digest, opts)
+}
+
+// SignContext implements ContextSigner.
+func (k *RSAPrivateKey) SignContext(ctx context.Context, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.auth.do(ctx, k.yk, k.pp, func(tx *scTx) ([]byte, error) {
 		return ykSignRSA(tx, rand, k.slot, k.pub, digest, opts)
 	})
 }
 
-func (k *keyRSA) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
-		return ykDecryptRSA(tx, k.slot, k.pub, msg)
+// Decrypt implements crypto.Decrypter.
+func (k *RSAPrivateKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return k.DecryptContext(context.Background(), rand, msg, opts)
+}
+
+// DecryptContext implements ContextDecrypter.
+func (k *RSAPrivateKey) DecryptContext(ctx context.Context, rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return k.auth.do(ctx, k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+		return ykDecryptRSA(tx, rand, k.slot, k.pub, msg, opts)
+	})
+}
+
+// Raw performs the RSA private key operation, computing in^d mod N, without
+// adding or removing any padding. This allows implementing protocols such as
+// blind signatures or custom padding schemes, and must be used with care.
+//
+// in is interpreted as a big-endian integer. It must be less than the modulus,
+// and no longer than the modulus in bytes. The result is always the size of
+// the modulus.
+func (k *RSAPrivateKey) Raw(in []byte) ([]byte, error) {
+	return k.RawContext(context.Background(), in)
+}
+
+// RawContext is like Raw, but returns an error wrapping ErrCanceled if the
+// context is done before the card responds.
+func (k *RSAPrivateKey) RawContext(ctx context.Context, in []byte) ([]byte, error) {
+	if new(big.Int).SetBytes(in).Cmp(k.pub.N) >= 0 {
+		return nil, errors.New("input must be less than the modulus")
+	}
+	return k.auth.do(ctx, k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+		return ykRSAPrivate(tx, k.slot, k.pub, in)
 	})
 }
 
@@ -1326,14 +1750,15 @@ func ykSignECDSA(tx *scTx, slot Slot, pub *ecdsa.PublicKey, digest []byte) ([]by
 	return rs, nil
 }
 
-// This function only works on SoloKeys prototypes and other PIV devices that choose
-// to implement Ed25519 signatures under alg 0x22.
-func skSignEd25519(tx *scTx, slot Slot, pub ed25519.PublicKey, digest []byte) ([]byte, error) {
+// This function works on SoloKeys prototypes and other PIV devices that choose
+// to implement Ed25519 signatures under alg 0x22, and on YubiKeys 5.7 and
+// later under alg 0xe0.
+func skSignEd25519(tx *scTx, alg byte, slot Slot, pub ed25519.PublicKey, digest []byte) ([]byte, error) {
 	// Adaptation of
 	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=118
 	cmd := apdu{
 		instruction: insAuthenticate,
-		param1:      algEd25519,
+		param1:      alg,
 		param2:      byte(slot.Key),
 		data: marshalASN1(0x7c,
 			append([]byte{0x82, 0x00},
@@ -1354,6 +1779,21 @@ func skSignEd25519(tx *scTx, slot Slot, pub ed25519.PublicKey, digest []byte) ([
 	return rs, nil
 }
 
+// parseCertificate is like x509.ParseCertificate, but also sets the public key
+// of certificates for X25519 keys, which the x509 package leaves empty.
+func parseCertificate(der []byte) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if cert.PublicKey == nil {
+		if pub, err := x509.ParsePKIXPublicKey(cert.RawSubjectPublicKeyInfo); err == nil {
+			cert.PublicKey = pub
+		}
+	}
+	return cert, nil
+}
+
 func unmarshalASN1(b []byte, class, tag int) (obj, rest []byte, err error) {
 	var v asn1.RawValue
 	rest, err = asn1.Unmarshal(b, &v)
@@ -1404,6 +1844,14 @@ func decodeEd25519Public(b []byte) (ed25519.PublicKey, error) {
 	return ed25519.PublicKey(p), nil
 }
 
+func decodeX25519Public(b []byte) (*ecdh.PublicKey, error) {
+	p, _, err := unmarshalASN1(b, 2, 0x06)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal points: %v", err)
+	}
+	return ecdh.X25519().NewPublicKey(p)
+}
+
 func decodeRSAPublic(b []byte) (*rsa.PublicKey, error) {
 	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=95
 	mod, r, err := unmarshalASN1(b, 2, 0x01)
@@ -1430,23 +1878,89 @@ func rsaAlg(pub *rsa.PublicKey) (byte, error) {
 		return algRSA1024, nil
 	case 2048:
 		return algRSA2048, nil
+	case 3072:
+		return algRSA3072, nil
+	case 4096:
+		return algRSA4096, nil
 	default:
 		return 0, fmt.Errorf("unsupported rsa key size: %d", size)
 	}
 }
 
-func ykDecryptRSA(tx *scTx, slot Slot, pub *rsa.PublicKey, data []byte) ([]byte, error) {
+// ykDecryptRSA decrypts data with the key in the slot. opts may be nil,
+// *rsa.PKCS1v15DecryptOptions or *rsa.OAEPOptions, matching
+// rsa.PrivateKey.Decrypt. The card only performs the raw RSA operation, and the
+// padding is removed locally.
+func ykDecryptRSA(tx *scTx, rand io.Reader, slot Slot, pub *rsa.PublicKey, data []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	var (
+		oaep       *rsa.OAEPOptions
+		sessionKey []byte
+	)
+	switch o := opts.(type) {
+	case nil:
+	case *rsa.PKCS1v15DecryptOptions:
+		if o.SessionKeyLen > 0 {
+			// Generate a random key to return if the padding is invalid, to
+			// avoid revealing whether it was valid.
+			sessionKey = make([]byte, o.SessionKeyLen)
+			if _, err := io.ReadFull(rand, sessionKey); err != nil {
+				return nil, fmt.Errorf("generating session key: %w", err)
+			}
+		}
+	case *rsa.OAEPOptions:
+		mgfHash := o.MGFHash
+		if mgfHash == 0 {
+			mgfHash = o.Hash
+		}
+		if !o.Hash.Available() || !mgfHash.Available() {
+			return nil, fmt.Errorf("unsupported hash algorithm: crypto.Hash(%d)", o.Hash)
+		}
+		oaep = &rsa.OAEPOptions{Hash: o.Hash, MGFHash: mgfHash, Label: o.Label}
+	default:
+		return nil, fmt.Errorf("unsupported decrypter options: %T", opts)
+	}
+
+	em, err := ykRSAPrivate(tx, slot, pub, data)
+	if err != nil {
+		return nil, err
+	}
+	if oaep != nil {
+		return rsafork.EMEOAEPDecode(em, oaep.Hash.New(), oaep.MGFHash.New(), oaep.Label)
+	}
+	if sessionKey != nil {
+		if err := rsafork.EMEPKCS1v15DecodeSessionKey(em, sessionKey); err != nil {
+			return nil, err
+		}
+		return sessionKey, nil
+	}
+	valid, index := rsafork.EMEPKCS1v15Decode(em)
+	if valid == 0 {
+		return nil, rsa.ErrDecryption
+	}
+	return em[index:], nil
+}
+
+// ykRSAPrivate performs a raw RSA private key operation with the key in the
+// slot. The result is always the size of the modulus.
+func ykRSAPrivate(tx *scTx, slot Slot, pub *rsa.PublicKey, data []byte) ([]byte, error) {
 	alg, err := rsaAlg(pub)
 	if err != nil {
 		return nil, err
 	}
+	k := pub.Size()
+	if len(data) > k {
+		return nil, fmt.Errorf("input too large: %d bytes, modulus is %d bytes", len(data), k)
+	}
+	// The card expects input the size of the modulus.
+	in := make([]byte, k)
+	copy(in[k-len(data):], data)
 	cmd := apdu{
 		instruction: insAuthenticate,
 		param1:      alg,
 		param2:      byte(slot.Key),
 		data: marshalASN1(0x7c,
 			append([]byte{0x82, 0x00},
-				marshalASN1(0x81, data)...)),
+				marshalASN1(0x81, in)...)),
 	}
 	resp, err := tx.Transmit(cmd)
 	if err != nil {
@@ -1457,18 +1971,16 @@ func ykDecryptRSA(tx *scTx, slot Slot, pub *rsa.PublicKey, data []byte) ([]byte,
 	if err != nil {
 		return nil, fmt.Errorf("unmarshal response: %v", err)
 	}
-	decrypted, _, err := unmarshalASN1(sig, 2, 0x02) // 0x82
+	out, _, err := unmarshalASN1(sig, 2, 0x02) // 0x82
 	if err != nil {
 		return nil, fmt.Errorf("unmarshal response signature: %v", err)
 	}
-	// Decrypted blob contains a bunch of random data. Look for a NULL byte which
-	// indicates where the plain text starts.
-	for i := 2; i+1 < len(decrypted); i++ {
-		if decrypted[i] == 0x00 {
-			return decrypted[i+1:], nil
-		}
+	if len(out) > k {
+		return nil, fmt.Errorf("invalid response length: %d bytes, modulus is %d bytes", len(out), k)
 	}
-	return nil, fmt.Errorf("invalid pkcs#1 v1.5 padding")
+	em := make([]byte, k)
+	copy(em[k-len(out):], out)
+	return em, nil
 }
 
 // PKCS#1 v15 is largely informed by the standard library
@@ -1480,11 +1992,6 @@ func ykSignRSA(tx *scTx, rand io.Reader, slot Slot, pub *rsa.PublicKey, digest [
 		return nil, fmt.Errorf("input must be a hashed message")
 	}
 
-	alg, err := rsaAlg(pub)
-	if err != nil {
-		return nil, err
-	}
-
 	var data []byte
 	if o, ok := opts.(*rsa.PSSOptions); ok {
 		salt, err := rsafork.NewSalt(rand, pub, hash, o)
@@ -1524,28 +2031,7 @@ func ykSignRSA(tx *scTx, rand io.Reader, slot Slot, pub *rsa.PublicKey, digest [
 	}
 
 	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=117
-	cmd := apdu{
-		instruction: insAuthenticate,
-		param1:      alg,
-		param2:      byte(slot.Key),
-		data: marshalASN1(0x7c,
-			append([]byte{0x82, 0x00},
-				marshalASN1(0x81, data)...)),
-	}
-	resp, err := tx.Transmit(cmd)
-	if err != nil {
-		return nil, fmt.Errorf("command failed: %w", err)
-	}
-
-	sig, _, err := unmarshalASN1(resp, 1, 0x1c) // 0x7c
-	if err != nil {
-		return nil, fmt.Errorf("unmarshal response: %v", err)
-	}
-	pkcs1v15Sig, _, err := unmarshalASN1(sig, 2, 0x02) // 0x82
-	if err != nil {
-		return nil, fmt.Errorf("unmarshal response signature: %v", err)
-	}
-	return pkcs1v15Sig, nil
+	return ykRSAPrivate(tx, slot, pub, data)
 }
 
 var hashPrefixes = map[crypto.Hash][]byte{
@@ -17,6 +17,7 @@ package piv
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
@@ -35,6 +36,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
 )
 
 func TestYubiKeySignECDSA(t *testing.T) {
@@ -52,7 +55,7 @@ func TestYubiKeySignECDSA(t *testing.T) {
 		TouchPolicy: TouchPolicyNever,
 		PINPolicy:   PINPolicyNever,
 	}
-	pubKey, err := yk.GenerateKey(DefaultManagementKey, slot, key)
+	pubKey, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
 	if err != nil {
 		t.Fatalf("generating key: %v", err)
 	}
@@ -95,7 +98,7 @@ func TestYubiKeyECDSASharedKey(t *testing.T) {
 		TouchPolicy: TouchPolicyNever,
 		PINPolicy:   PINPolicyNever,
 	}
-	pubKey, err := yk.GenerateKey(DefaultManagementKey, slot, key)
+	pubKey, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
 	if err != nil {
 		t.Fatalf("generating key: %v", err)
 	}
@@ -118,7 +121,7 @@ func TestYubiKeyECDSASharedKey(t *testing.T) {
 			t.Fatalf("cannot generate key: %v", err)
 		}
 		mult, _ := pub.ScalarMult(pub.X, pub.Y, eph.D.Bytes())
-		secret1 := mult.Bytes()
+		secret1 := mult.FillBytes(make([]byte, 32))
 
 		secret2, err := privECDSA.SharedKey(&eph.PublicKey)
 		if err != nil {
@@ -163,7 +166,7 @@ func TestPINPrompt(t *testing.T) {
 				PINPolicy:   test.policy,
 				TouchPolicy: TouchPolicyNever,
 			}
-			pub, err := yk.GenerateKey(DefaultManagementKey, SlotAuthentication, k)
+			pub, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, k)
 			if err != nil {
 				t.Fatalf("generating key on slot: %v", err)
 			}
@@ -238,7 +241,7 @@ func TestSlots(t *testing.T) {
 				PINPolicy:   PINPolicyNever,
 				TouchPolicy: TouchPolicyNever,
 			}
-			pub, err := yk.GenerateKey(DefaultManagementKey, test.slot, k)
+			pub, err := yk.GenerateKey(DefaultManagementKey(), test.slot, k)
 			if err != nil {
 				t.Fatalf("generating key on slot: %v", err)
 			}
@@ -274,7 +277,7 @@ func TestSlots(t *testing.T) {
 			if _, err := yk.Certificate(test.slot); err == nil || !errors.Is(err, ErrNotFound) {
 				t.Errorf("get certificate, got err=%v, want=ErrNotFound", err)
 			}
-			if err := yk.SetCertificate(DefaultManagementKey, test.slot, cert); err != nil {
+			if err := yk.SetCertificate(DefaultManagementKey(), test.slot, cert); err != nil {
 				t.Fatalf("set certificate: %v", err)
 			}
 			got, err := yk.Certificate(test.slot)
@@ -310,7 +313,7 @@ func TestYubiKeySignRSA(t *testing.T) {
 				TouchPolicy: TouchPolicyNever,
 				PINPolicy:   PINPolicyNever,
 			}
-			pubKey, err := yk.GenerateKey(DefaultManagementKey, slot, key)
+			pubKey, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
 			if err != nil {
 				t.Fatalf("generating key: %v", err)
 			}
@@ -360,7 +363,7 @@ func TestYubiKeySignRSAPSS(t *testing.T) {
 				TouchPolicy: TouchPolicyNever,
 				PINPolicy:   PINPolicyNever,
 			}
-			pubKey, err := yk.GenerateKey(DefaultManagementKey, slot, key)
+			pubKey, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
 			if err != nil {
 				t.Fatalf("generating key: %v", err)
 			}
@@ -390,6 +393,85 @@ func TestYubiKeySignRSAPSS(t *testing.T) {
 	}
 }
 
+func TestYubiKeySignConcurrent(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("reset yubikey: %v", err)
+	}
+
+	// RSA signatures span multiple APDUs, and keys with PINPolicyAlways must
+	// be used by the command immediately following PIN verification, so
+	// interleaved operations would fail.
+	rsaPub, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, Key{
+		Algorithm:   AlgorithmRSA2048,
+		PINPolicy:   PINPolicyAlways,
+		TouchPolicy: TouchPolicyNever,
+	})
+	if err != nil {
+		t.Fatalf("generating rsa key: %v", err)
+	}
+	ecPub, err := yk.GenerateKey(DefaultManagementKey(), SlotSignature, Key{
+		Algorithm:   AlgorithmEC256,
+		PINPolicy:   PINPolicyOnce,
+		TouchPolicy: TouchPolicyNever,
+	})
+	if err != nil {
+		t.Fatalf("generating ec key: %v", err)
+	}
+	auth := KeyAuth{PIN: DefaultPIN}
+	rsaPriv, err := yk.PrivateKey(SlotAuthentication, rsaPub, auth)
+	if err != nil {
+		t.Fatalf("getting rsa private key: %v", err)
+	}
+	ecPriv, err := yk.PrivateKey(SlotSignature, ecPub, auth)
+	if err != nil {
+		t.Fatalf("getting ec private key: %v", err)
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	errc := make(chan error)
+	const workers = 8
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			for j := 0; j < 4; j++ {
+				if i%2 == 0 {
+					sig, err := rsaPriv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+					if err != nil {
+						errc <- fmt.Errorf("rsa signing: %v", err)
+						return
+					}
+					if err := rsa.VerifyPKCS1v15(rsaPub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+						errc <- fmt.Errorf("verifying rsa signature: %v", err)
+						return
+					}
+				} else {
+					sig, err := ecPriv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+					if err != nil {
+						errc <- fmt.Errorf("ec signing: %v", err)
+						return
+					}
+					if !ecdsa.VerifyASN1(ecPub.(*ecdsa.PublicKey), digest[:], sig) {
+						errc <- fmt.Errorf("ec signature didn't verify")
+						return
+					}
+				}
+				if _, err := yk.Serial(); err != nil {
+					errc <- fmt.Errorf("getting serial: %v", err)
+					return
+				}
+			}
+			errc <- nil
+		}(i)
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 func TestTLS13(t *testing.T) {
 	yk, close := newTestYubiKey(t)
 	defer close()
@@ -399,7 +481,7 @@ func TestTLS13(t *testing.T) {
 		TouchPolicy: TouchPolicyNever,
 		PINPolicy:   PINPolicyNever,
 	}
-	pub, err := yk.GenerateKey(DefaultManagementKey, slot, key)
+	pub, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
 	if err != nil {
 		t.Fatalf("generating key: %v", err)
 	}
@@ -533,7 +615,7 @@ func TestYubiKeyDecryptRSA(t *testing.T) {
 				TouchPolicy: TouchPolicyNever,
 				PINPolicy:   PINPolicyNever,
 			}
-			pubKey, err := yk.GenerateKey(DefaultManagementKey, slot, key)
+			pubKey, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
 			if err != nil {
 				t.Fatalf("generating key: %v", err)
 			}
@@ -567,6 +649,145 @@ func TestYubiKeyDecryptRSA(t *testing.T) {
 	}
 }
 
+func TestYubiKeyDecryptRSAOptions(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+	slot := SlotAuthentication
+	key := Key{
+		Algorithm:   AlgorithmRSA1024,
+		TouchPolicy: TouchPolicyNever,
+		PINPolicy:   PINPolicyNever,
+	}
+	pubKey, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	pub, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		t.Fatalf("public key is not an rsa key")
+	}
+	priv, err := yk.PrivateKey(slot, pub, KeyAuth{})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	d, ok := priv.(crypto.Decrypter)
+	if !ok {
+		t.Fatalf("private key didn't implement crypto.Decypter")
+	}
+
+	data := []byte("0123456789abcdef")
+	label := []byte("label")
+	oaepCT, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, data, label)
+	if err != nil {
+		t.Fatalf("oaep encryption failed: %v", err)
+	}
+	pkcs1CT, err := rsa.EncryptPKCS1v15(rand.Reader, pub, data)
+	if err != nil {
+		t.Fatalf("pkcs#1 v1.5 encryption failed: %v", err)
+	}
+	// The plain text 0x42 doesn't have valid padding.
+	invalidCT := new(big.Int).Exp(big.NewInt(0x42), big.NewInt(int64(pub.E)), pub.N).Bytes()
+
+	tests := []struct {
+		name    string
+		ct      []byte
+		opts    crypto.DecrypterOpts
+		want    []byte
+		wantErr bool
+	}{
+		{"OAEP", oaepCT, &rsa.OAEPOptions{Hash: crypto.SHA256, Label: label}, data, false},
+		{"OAEPMGFHash", oaepCT, &rsa.OAEPOptions{Hash: crypto.SHA256, MGFHash: crypto.SHA256, Label: label}, data, false},
+		{"OAEPWrongLabel", oaepCT, &rsa.OAEPOptions{Hash: crypto.SHA256}, nil, true},
+		{"OAEPWrongHash", oaepCT, &rsa.OAEPOptions{Hash: crypto.SHA1, Label: label}, nil, true},
+		{"PKCS1v15", pkcs1CT, &rsa.PKCS1v15DecryptOptions{}, data, false},
+		{"PKCS1v15SessionKey", pkcs1CT, &rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(data)}, data, false},
+		{"PKCS1v15InvalidPadding", invalidCT, nil, nil, true},
+		{"UnsupportedOptions", pkcs1CT, crypto.SHA256, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := d.Decrypt(rand.Reader, test.ct, test.opts)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("decrypt succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("decrypt, got=%q, want=%q", got, test.want)
+			}
+		})
+	}
+
+	// With SessionKeyLen, invalid padding or a different message length
+	// returns a random key instead of an error.
+	for _, ct := range [][]byte{invalidCT, pkcs1CT} {
+		opts := &rsa.PKCS1v15DecryptOptions{SessionKeyLen: 32}
+		got, err := d.Decrypt(rand.Reader, ct, opts)
+		if err != nil {
+			t.Fatalf("decrypt with session key: %v", err)
+		}
+		if len(got) != 32 || bytes.HasPrefix(got, data) {
+			t.Errorf("decrypt with session key, got=%x, want random key", got)
+		}
+	}
+}
+
+func TestYubiKeyRSARaw(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+	slot := SlotAuthentication
+	key := Key{
+		Algorithm:   AlgorithmRSA1024,
+		TouchPolicy: TouchPolicyNever,
+		PINPolicy:   PINPolicyAlways,
+	}
+	pubKey, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	pub, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		t.Fatalf("public key is not an rsa key")
+	}
+	priv, err := yk.PrivateKey(slot, pub, KeyAuth{PIN: DefaultPIN})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	k, ok := priv.(*RSAPrivateKey)
+	if !ok {
+		t.Fatalf("private key is not an *RSAPrivateKey: %T", priv)
+	}
+
+	for _, in := range [][]byte{
+		[]byte("hello"),
+		new(big.Int).Sub(pub.N, big.NewInt(1)).Bytes(),
+	} {
+		out, err := k.Raw(in)
+		if err != nil {
+			t.Fatalf("raw rsa operation: %v", err)
+		}
+		if len(out) != pub.Size() {
+			t.Errorf("raw rsa output length got=%d, want=%d", len(out), pub.Size())
+		}
+		// Applying the public key recovers the input.
+		got := new(big.Int).Exp(new(big.Int).SetBytes(out), big.NewInt(int64(pub.E)), pub.N)
+		if got.Cmp(new(big.Int).SetBytes(in)) != 0 {
+			t.Errorf("raw rsa operation didn't match public key operation")
+		}
+	}
+
+	if _, err := k.Raw(pub.N.Bytes()); err == nil {
+		t.Errorf("raw rsa operation with input equal to the modulus succeeded")
+	}
+	if _, err := k.Raw(make([]byte, pub.Size()+1)); err == nil {
+		t.Errorf("raw rsa operation with input longer than the modulus succeeded")
+	}
+}
+
 func TestYubiKeyAttestation(t *testing.T) {
 	yk, close := newTestYubiKey(t)
 	defer close()
@@ -583,7 +804,7 @@ func TestYubiKeyAttestation(t *testing.T) {
 		t.Fatalf("getting attestation certificate: %v", err)
 	}
 
-	pub, err := yk.GenerateKey(DefaultManagementKey, SlotAuthentication, key)
+	pub, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key)
 	if err != nil {
 		t.Fatalf("generate key: %v", err)
 	}
@@ -592,7 +813,7 @@ func TestYubiKeyAttestation(t *testing.T) {
 	if err != nil {
 		t.Fatalf("attesting key: %v", err)
 	}
-	a, err := Verify(cert, c)
+	a, err := testVerify(yk, cert, c)
 	if err != nil {
 		t.Fatalf("failed to verify attestation: %v", err)
 	}
@@ -655,7 +876,7 @@ func TestYubiKeyStoreCertificate(t *testing.T) {
 		TouchPolicy: TouchPolicyNever,
 		PINPolicy:   PINPolicyNever,
 	}
-	pub, err := yk.GenerateKey(DefaultManagementKey, slot, key)
+	pub, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
 	if err != nil {
 		t.Fatalf("generating key: %v", err)
 	}
@@ -676,7 +897,7 @@ func TestYubiKeyStoreCertificate(t *testing.T) {
 	if err != nil {
 		t.Fatalf("parsing cli cert: %v", err)
 	}
-	if err := yk.SetCertificate(DefaultManagementKey, slot, cliCert); err != nil {
+	if err := yk.SetCertificate(DefaultManagementKey(), slot, cliCert); err != nil {
 		t.Fatalf("storing client cert: %v", err)
 	}
 	gotCert, err := yk.Certificate(slot)
@@ -729,7 +950,7 @@ func TestYubiKeyGenerateKey(t *testing.T) {
 				TouchPolicy: TouchPolicyNever,
 				PINPolicy:   PINPolicyNever,
 			}
-			if _, err := yk.GenerateKey(DefaultManagementKey, SlotAuthentication, key); err != nil {
+			if _, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key); err != nil {
 				t.Errorf("generating key: %v", err)
 			}
 		})
@@ -748,7 +969,7 @@ func TestYubiKeyPrivateKey(t *testing.T) {
 		TouchPolicy: TouchPolicyNever,
 		PINPolicy:   PINPolicyNever,
 	}
-	pub, err := yk.GenerateKey(DefaultManagementKey, slot, key)
+	pub, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
 	if err != nil {
 		t.Fatalf("generating key: %v", err)
 	}
@@ -797,7 +1018,7 @@ func TestYubiKeyPrivateKeyPINError(t *testing.T) {
 		TouchPolicy: TouchPolicyNever,
 		PINPolicy:   PINPolicyAlways,
 	}
-	pub, err := yk.GenerateKey(DefaultManagementKey, slot, key)
+	pub, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
 	if err != nil {
 		t.Fatalf("generating key: %v", err)
 	}
@@ -889,8 +1110,8 @@ func TestSetRSAPrivateKey(t *testing.T) {
 			wantErr: nil,
 		},
 		{
-			name:    "rsa 4096",
-			bits:    4096,
+			name:    "rsa 1536",
+			bits:    1536,
 			slot:    SlotAuthentication,
 			wantErr: errUnsupportedKeySize,
 		},
@@ -912,7 +1133,7 @@ func TestSetRSAPrivateKey(t *testing.T) {
 				t.Fatalf("generating private key: %v", err)
 			}
 
-			err = yk.SetPrivateKeyInsecure(DefaultManagementKey, tt.slot, generated, Key{
+			err = yk.SetPrivateKeyInsecure(DefaultManagementKey(), tt.slot, generated, Key{
 				PINPolicy:   PINPolicyNever,
 				TouchPolicy: TouchPolicyNever,
 			})
@@ -951,6 +1172,400 @@ func TestSetRSAPrivateKey(t *testing.T) {
 	}
 }
 
+func TestYubiKeyLargeRSA(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	tests := []struct {
+		name string
+		alg  Algorithm
+	}{
+		{"rsa3072", AlgorithmRSA3072},
+		{"rsa4096", AlgorithmRSA4096},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 7, 1}})
+
+			key := Key{
+				Algorithm:   test.alg,
+				PINPolicy:   PINPolicyNever,
+				TouchPolicy: TouchPolicyNever,
+			}
+			pubKey, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key)
+			if err != nil {
+				t.Fatalf("generating key: %v", err)
+			}
+			pub := pubKey.(*rsa.PublicKey)
+			priv, err := yk.PrivateKey(SlotAuthentication, pub, KeyAuth{})
+			if err != nil {
+				t.Fatalf("getting private key: %v", err)
+			}
+			data := sha256.Sum256([]byte("hello"))
+			sig, err := priv.(crypto.Signer).Sign(rand.Reader, data[:], crypto.SHA256)
+			if err != nil {
+				t.Fatalf("signing failed: %v", err)
+			}
+			if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, data[:], sig); err != nil {
+				t.Errorf("failed to verify signature: %v", err)
+			}
+
+			imported := ephemeralKey(t, test.alg).(*rsa.PrivateKey)
+			if err := yk.SetPrivateKeyInsecure(DefaultManagementKey(), SlotKeyManagement, imported, key); err != nil {
+				t.Fatalf("importing key: %v", err)
+			}
+			ki, err := yk.KeyInfo(SlotKeyManagement)
+			if err != nil {
+				t.Fatalf("getting key info: %v", err)
+			}
+			if ki.Algorithm != test.alg {
+				t.Errorf("key info algorithm got=%v, want=%v", ki.Algorithm, test.alg)
+			}
+			priv, err = yk.PrivateKey(SlotKeyManagement, &imported.PublicKey, KeyAuth{})
+			if err != nil {
+				t.Fatalf("getting private key: %v", err)
+			}
+			msg := []byte("hello")
+			ct, err := rsa.EncryptPKCS1v15(rand.Reader, &imported.PublicKey, msg)
+			if err != nil {
+				t.Fatalf("encryption failed: %v", err)
+			}
+			got, err := priv.(crypto.Decrypter).Decrypt(rand.Reader, ct, nil)
+			if err != nil {
+				t.Fatalf("decryption failed: %v", err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("decrypt, got=%q, want=%q", got, msg)
+			}
+		})
+	}
+}
+
+// generateKeyWithCertificate generates an EC key in the given slot, and stores
+// a certificate for it.
+func generateKeyWithCertificate(t *testing.T, yk *YubiKey, slot Slot) (crypto.PublicKey, *x509.Certificate) {
+	t.Helper()
+	key := Key{
+		Algorithm:   AlgorithmEC256,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyNever,
+	}
+	pub, err := yk.GenerateKey(DefaultManagementKey(), slot, key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	caPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ca private: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "my-client"},
+		SerialNumber: big.NewInt(101),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, caPriv)
+	if err != nil {
+		t.Fatalf("creating cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing cert: %v", err)
+	}
+	if err := yk.SetCertificate(DefaultManagementKey(), slot, cert); err != nil {
+		t.Fatalf("storing cert: %v", err)
+	}
+	return pub, cert
+}
+
+func TestYubiKeyMoveKey(t *testing.T) {
+	from, to := SlotAuthentication, SlotSignature
+	tests := []struct {
+		name string
+		move func(yk *YubiKey) error
+		cert bool
+	}{
+		{"Key", func(yk *YubiKey) error { return yk.MoveKey(DefaultManagementKey(), from, to) }, false},
+		{"KeyAndCertificate", func(yk *YubiKey) error { return yk.MoveKeyAndCertificate(DefaultManagementKey(), from, to) }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 7, 1}})
+			pub, cert := generateKeyWithCertificate(t, yk, from)
+
+			if err := test.move(yk); err != nil {
+				t.Fatalf("moving key: %v", err)
+			}
+			if _, err := yk.KeyInfo(from); !errors.Is(err, ErrNotFound) {
+				t.Errorf("getting key info for original slot got err=%v, want=%v", err, ErrNotFound)
+			}
+			ki, err := yk.KeyInfo(to)
+			if err != nil {
+				t.Fatalf("getting key info: %v", err)
+			}
+			if !pub.(*ecdsa.PublicKey).Equal(ki.PublicKey) {
+				t.Errorf("moved key doesn't match generated key")
+			}
+
+			fromCert, fromErr := yk.Certificate(from)
+			toCert, toErr := yk.Certificate(to)
+			if test.cert {
+				if !errors.Is(fromErr, ErrNotFound) {
+					t.Errorf("getting certificate for original slot got err=%v, want=%v", fromErr, ErrNotFound)
+				}
+				if toErr != nil {
+					t.Fatalf("getting moved certificate: %v", toErr)
+				}
+				if !bytes.Equal(toCert.Raw, cert.Raw) {
+					t.Errorf("moved certificate doesn't match stored certificate")
+				}
+			} else {
+				if fromErr != nil {
+					t.Fatalf("getting certificate: %v", fromErr)
+				}
+				if !bytes.Equal(fromCert.Raw, cert.Raw) {
+					t.Errorf("certificate changed after moving key")
+				}
+				if !errors.Is(toErr, ErrNotFound) {
+					t.Errorf("getting certificate for destination slot got err=%v, want=%v", toErr, ErrNotFound)
+				}
+			}
+
+			// The original slot is now empty.
+			if err := yk.MoveKey(DefaultManagementKey(), from, to); err == nil {
+				t.Errorf("moving key from empty slot succeeded")
+			}
+		})
+	}
+}
+
+func TestYubiKeyMoveKeyOccupied(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 7, 1}})
+	generateKeyWithCertificate(t, yk, SlotAuthentication)
+
+	key := Key{
+		Algorithm:   AlgorithmEC256,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyNever,
+	}
+	if _, err := yk.GenerateKey(DefaultManagementKey(), SlotSignature, key); err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	if err := yk.MoveKey(DefaultManagementKey(), SlotAuthentication, SlotSignature); err == nil {
+		t.Errorf("moving key to occupied slot succeeded")
+	}
+}
+
+func TestYubiKeyDeleteKey(t *testing.T) {
+	slot := SlotAuthentication
+	tests := []struct {
+		name   string
+		delete func(yk *YubiKey) error
+		cert   bool
+	}{
+		{"Key", func(yk *YubiKey) error { return yk.DeleteKey(DefaultManagementKey(), slot) }, false},
+		{"KeyAndCertificate", func(yk *YubiKey) error { return yk.DeleteKeyAndCertificate(DefaultManagementKey(), slot) }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 7, 1}})
+			generateKeyWithCertificate(t, yk, slot)
+
+			if err := test.delete(yk); err != nil {
+				t.Fatalf("deleting key: %v", err)
+			}
+			if _, err := yk.KeyInfo(slot); !errors.Is(err, ErrNotFound) {
+				t.Errorf("getting key info got err=%v, want=%v", err, ErrNotFound)
+			}
+			_, err := yk.Certificate(slot)
+			if test.cert && !errors.Is(err, ErrNotFound) {
+				t.Errorf("getting certificate got err=%v, want=%v", err, ErrNotFound)
+			}
+			if !test.cert && err != nil {
+				t.Errorf("getting certificate: %v", err)
+			}
+		})
+	}
+}
+
+func TestYubiKeyMoveKeyUnsupported(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 4, 3}})
+	testRequiresVersionBefore(t, yk, 5, 7, 0)
+
+	if err := yk.MoveKey(DefaultManagementKey(), SlotAuthentication, SlotSignature); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("moving key got err=%v, want=%v", err, ErrMissingCapability)
+	}
+	if err := yk.DeleteKey(DefaultManagementKey(), SlotAuthentication); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("deleting key got err=%v, want=%v", err, ErrMissingCapability)
+	}
+}
+
+func TestYubiKeyLargeRSAUnsupported(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 4, 3}})
+	testRequiresVersionBefore(t, yk, 5, 7, 0)
+
+	key := Key{
+		Algorithm:   AlgorithmRSA4096,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyNever,
+	}
+	if _, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key); err == nil {
+		t.Errorf("generating rsa 4096 key before 5.7.0 succeeded")
+	}
+}
+
+func TestYubiKeyEd25519(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 7, 1}})
+
+	key := Key{
+		Algorithm:   AlgorithmEd25519,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyNever,
+	}
+	pubKey, err := yk.GenerateKey(DefaultManagementKey(), SlotSignature, key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	pub, ok := pubKey.(ed25519.PublicKey)
+	if !ok {
+		t.Fatalf("public key is not an ed25519 key: %T", pubKey)
+	}
+	cert, err := yk.Attest(SlotSignature)
+	if err != nil {
+		t.Fatalf("attesting key: %v", err)
+	}
+	if !pub.Equal(cert.PublicKey) {
+		t.Errorf("attested public key doesn't match generated key")
+	}
+
+	priv, err := yk.PrivateKey(SlotSignature, pub, KeyAuth{})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	msg := []byte("hello")
+	sig, err := priv.(crypto.Signer).Sign(rand.Reader, msg, crypto.Hash(0))
+	if err != nil {
+		t.Fatalf("signing failed: %v", err)
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		t.Errorf("failed to verify signature")
+	}
+
+	imported := ephemeralKey(t, AlgorithmEd25519).(ed25519.PrivateKey)
+	if err := yk.SetPrivateKeyInsecure(DefaultManagementKey(), SlotAuthentication, imported, key); err != nil {
+		t.Fatalf("importing key: %v", err)
+	}
+	ki, err := yk.KeyInfo(SlotAuthentication)
+	if err != nil {
+		t.Fatalf("getting key info: %v", err)
+	}
+	if ki.Algorithm != AlgorithmEd25519 || !imported.Public().(ed25519.PublicKey).Equal(ki.PublicKey) {
+		t.Errorf("key info got algorithm=%v, public key=%v", ki.Algorithm, ki.PublicKey)
+	}
+}
+
+func TestYubiKeyX25519(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 7, 1}})
+
+	key := Key{
+		Algorithm:   AlgorithmX25519,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyNever,
+	}
+	pubKey, err := yk.GenerateKey(DefaultManagementKey(), SlotKeyManagement, key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	pub, ok := pubKey.(*ecdh.PublicKey)
+	if !ok {
+		t.Fatalf("public key is not an ecdh key: %T", pubKey)
+	}
+	cert, err := yk.Attest(SlotKeyManagement)
+	if err != nil {
+		t.Fatalf("attesting key: %v", err)
+	}
+	if !pub.Equal(cert.PublicKey) {
+		t.Errorf("attested public key doesn't match generated key")
+	}
+	attestationCert, err := yk.AttestationCertificate()
+	if err != nil {
+		t.Fatalf("getting attestation certificate: %v", err)
+	}
+	if _, err := testVerify(yk, attestationCert, cert); err != nil {
+		t.Errorf("verifying attestation: %v", err)
+	}
+
+	priv, err := yk.PrivateKey(SlotKeyManagement, pub, KeyAuth{})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	x, ok := priv.(*X25519PrivateKey)
+	if !ok {
+		t.Fatalf("private key is not an x25519 key: %T", priv)
+	}
+	peer := ephemeralKey(t, AlgorithmX25519).(*ecdh.PrivateKey)
+	got, err := x.SharedKey(peer.PublicKey())
+	if err != nil {
+		t.Fatalf("computing shared key: %v", err)
+	}
+	want, err := peer.ECDH(pub)
+	if err != nil {
+		t.Fatalf("computing expected shared key: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("shared key got=%x, want=%x", got, want)
+	}
+
+	p256, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating p256 key: %v", err)
+	}
+	if _, err := x.SharedKey(p256.PublicKey()); !errors.Is(err, errMismatchingAlgorithms) {
+		t.Errorf("shared key with p256 peer got err=%v, want=%v", err, errMismatchingAlgorithms)
+	}
+
+	imported := ephemeralKey(t, AlgorithmX25519).(*ecdh.PrivateKey)
+	if err := yk.SetPrivateKeyInsecure(DefaultManagementKey(), SlotAuthentication, imported, key); err != nil {
+		t.Fatalf("importing key: %v", err)
+	}
+	ki, err := yk.KeyInfo(SlotAuthentication)
+	if err != nil {
+		t.Fatalf("getting key info: %v", err)
+	}
+	if ki.Algorithm != AlgorithmX25519 || !imported.PublicKey().Equal(ki.PublicKey) {
+		t.Errorf("key info got algorithm=%v, public key=%v", ki.Algorithm, ki.PublicKey)
+	}
+}
+
+func TestAlgorithmID(t *testing.T) {
+	tests := []struct {
+		name    string
+		version Version
+		generic bool
+		want    byte
+	}{
+		{"yubikey 5.7", Version{5, 7, 1}, false, algYubicoEd25519},
+		{"yubikey 5.4", Version{5, 4, 3}, false, algEd25519},
+		{"generic", Version{}, true, algEd25519},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			yk := &YubiKey{
+				version: &version{
+					major: byte(test.version.Major),
+					minor: byte(test.version.Minor),
+					patch: byte(test.version.Patch),
+				},
+				generic: test.generic,
+			}
+			got, ok := yk.algorithmID(AlgorithmEd25519)
+			if !ok || got != test.want {
+				t.Errorf("algorithmID(AlgorithmEd25519) got=0x%x, want=0x%x", got, test.want)
+			}
+		})
+	}
+}
+
 func TestSetECDSAPrivateKey(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -994,7 +1609,7 @@ func TestSetECDSAPrivateKey(t *testing.T) {
 				t.Fatalf("generating private key: %v", err)
 			}
 
-			err = yk.SetPrivateKeyInsecure(DefaultManagementKey, tt.slot, generated, Key{
+			err = yk.SetPrivateKeyInsecure(DefaultManagementKey(), tt.slot, generated, Key{
 				PINPolicy:   PINPolicyNever,
 				TouchPolicy: TouchPolicyNever,
 			})
@@ -1261,14 +1876,14 @@ func TestKeyInfo(t *testing.T) {
 			}
 
 			if test.importKey == nil {
-				pub, err := yk.GenerateKey(DefaultManagementKey, test.slot, test.policy)
+				pub, err := yk.GenerateKey(DefaultManagementKey(), test.slot, test.policy)
 				if err != nil {
 					t.Fatalf("generating key: %v", err)
 				}
 				want.Origin = OriginGenerated
 				want.PublicKey = pub
 			} else {
-				err := yk.SetPrivateKeyInsecure(DefaultManagementKey, test.slot, test.importKey, test.policy)
+				err := yk.SetPrivateKeyInsecure(DefaultManagementKey(), test.slot, test.importKey, test.policy)
 				if err != nil {
 					t.Fatalf("importing key: %v", err)
 				}
@@ -1308,7 +1923,7 @@ func TestPINPolicy(t *testing.T) {
 	// for imported keys, using the attestation certificate to derive the PIN
 	// policy fails. So we check that pinPolicy succeeds with imported keys.
 	priv := ephemeralKey(t, AlgorithmEC256)
-	err := yk.SetPrivateKeyInsecure(DefaultManagementKey, SlotAuthentication, priv, Key{
+	err := yk.SetPrivateKeyInsecure(DefaultManagementKey(), SlotAuthentication, priv, Key{
 		Algorithm:   AlgorithmEC256,
 		PINPolicy:   PINPolicyNever,
 		TouchPolicy: TouchPolicyNever,
@@ -1342,10 +1957,16 @@ func ephemeralKey(t *testing.T, alg Algorithm) privateKey {
 		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	case AlgorithmEd25519:
 		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmX25519:
+		key, err = ecdh.X25519().GenerateKey(rand.Reader)
 	case AlgorithmRSA1024:
 		key, err = rsa.GenerateKey(rand.Reader, 1024)
 	case AlgorithmRSA2048:
 		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgorithmRSA3072:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	case AlgorithmRSA4096:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
 	default:
 		t.Fatalf("ephemeral key: unknown algorithm %d", alg)
 	}
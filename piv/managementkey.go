@@ -0,0 +1,228 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"errors"
+	"fmt"
+)
+
+// ManagementKeyAlgorithm identifies the algorithm of a management key.
+type ManagementKeyAlgorithm int
+
+// Management key algorithms supported by this package. AES keys require a
+// YubiKey with firmware 5.4.0 or later.
+const (
+	ManagementKeyTDES ManagementKeyAlgorithm = iota + 1
+	ManagementKeyAES128
+	ManagementKeyAES192
+	ManagementKeyAES256
+)
+
+var managementKeyAlgorithmMap = map[ManagementKeyAlgorithm]byte{
+	ManagementKeyTDES:   alg3DES,
+	ManagementKeyAES128: algAES128,
+	ManagementKeyAES192: algAES192,
+	ManagementKeyAES256: algAES256,
+}
+
+var managementKeyAlgorithmMapInv = map[byte]ManagementKeyAlgorithm{
+	alg3DES:   ManagementKeyTDES,
+	algAES128: ManagementKeyAES128,
+	algAES192: ManagementKeyAES192,
+	algAES256: ManagementKeyAES256,
+}
+
+// keySize returns the length of keys for the algorithm in bytes.
+func (a ManagementKeyAlgorithm) keySize() int {
+	switch a {
+	case ManagementKeyTDES, ManagementKeyAES192:
+		return 24
+	case ManagementKeyAES128:
+		return 16
+	case ManagementKeyAES256:
+		return 32
+	}
+	return 0
+}
+
+func (a ManagementKeyAlgorithm) newCipher(key []byte) (cipher.Block, error) {
+	if n := a.keySize(); n == 0 {
+		return nil, fmt.Errorf("unsupported management key algorithm")
+	} else if len(key) != n {
+		return nil, fmt.Errorf("invalid management key length: %d, want %d", len(key), n)
+	}
+	if a == ManagementKeyTDES {
+		block, err := des.NewTripleDESCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("creating triple des block cipher: %v", err)
+		}
+		return block, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating aes block cipher: %v", err)
+	}
+	return block, nil
+}
+
+// ManagementKey is a key used to authenticate administrative operations, such
+// as generating keys and setting certificates.
+type ManagementKey struct {
+	// Algorithm of the key. If zero, the algorithm of the card's current
+	// management key is used, read from the card's metadata for the
+	// management key, which is supported by YubiKeys with firmware 5.3.0 and
+	// later. Older cards only support Triple-DES keys.
+	Algorithm ManagementKeyAlgorithm
+	// Key holds the key's bytes: 24 for Triple-DES and AES-192 keys, 16 for
+	// AES-128 keys, and 32 for AES-256 keys.
+	Key []byte
+}
+
+// ManagementKeyMetadata describes the management key set on the card.
+type ManagementKeyMetadata struct {
+	// Algorithm of the management key.
+	Algorithm ManagementKeyAlgorithm
+	// TouchPolicy indicates whether the card must be touched to
+	// authenticate with the management key, either TouchPolicyNever or
+	// TouchPolicyAlways.
+	TouchPolicy TouchPolicy
+	// Default indicates the management key is the factory default key,
+	// DefaultManagementKey.
+	Default bool
+}
+
+// ManagementKeyMetadata returns information about the management key set on
+// the card, such as whether it's still the factory default key. Reading the
+// metadata doesn't require authenticating with the management key.
+//
+// This method is only supported for YubiKey versions >= 5.3.0, and returns an
+// error wrapping ErrMissingCapability for older cards.
+func (yk *YubiKey) ManagementKeyMetadata() (*ManagementKeyMetadata, error) {
+	if err := yk.requireYubico("getting management key metadata"); err != nil {
+		return nil, err
+	}
+	if !supportsVersion(yk.Version(), 5, 3, 0) {
+		return nil, fmt.Errorf("management key metadata requires firmware 5.3.0: %w", ErrMissingCapability)
+	}
+	var m *ManagementKeyMetadata
+	err := yk.do(context.Background(), func(tx *scTx) error {
+		var err error
+		m, err = ykManagementKeyMetadata(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func ykManagementKeyMetadata(tx *scTx) (*ManagementKeyMetadata, error) {
+	cmd := apdu{instruction: insGetMetadata, param2: keyCardManagement}
+	resp, err := tx.Transmit(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+	fields, err := parseMetadata(resp)
+	if err != nil {
+		return nil, fmt.Errorf("parsing management key metadata: %v", err)
+	}
+	var (
+		m  ManagementKeyMetadata
+		ok bool
+	)
+	alg := fields[0x01]
+	if len(alg) != 1 {
+		return nil, errors.New("invalid management key algorithm in metadata")
+	}
+	if m.Algorithm, ok = managementKeyAlgorithmMapInv[alg[0]]; !ok {
+		return nil, fmt.Errorf("unknown management key algorithm in metadata: 0x%x", alg[0])
+	}
+	// The first byte is the PIN policy, which doesn't apply to management
+	// keys.
+	policy := fields[0x02]
+	if len(policy) != 2 {
+		return nil, errors.New("invalid management key policy in metadata")
+	}
+	if m.TouchPolicy, ok = touchPolicyMapInv[policy[1]]; !ok {
+		return nil, fmt.Errorf("unknown management key touch policy in metadata: 0x%x", policy[1])
+	}
+	def := fields[0x05]
+	if len(def) != 1 {
+		return nil, errors.New("invalid management key default value in metadata")
+	}
+	m.Default = def[0] == 0x01
+	return &m, nil
+}
+
+// managementKeyAlgorithm returns the algorithm of a management key. If it isn't
+// set, the algorithm of the card's current management key is used, which is
+// read from the card's metadata once and cached until the management key is
+// changed or the card is reset.
+func (yk *YubiKey) managementKeyAlgorithm(tx *scTx, key ManagementKey) (ManagementKeyAlgorithm, error) {
+	if key.Algorithm != 0 {
+		return key.Algorithm, nil
+	}
+	if yk.mgmtAlg != 0 {
+		return yk.mgmtAlg, nil
+	}
+	if !supportsVersion(yk.Version(), 5, 3, 0) {
+		return ManagementKeyTDES, nil
+	}
+	m, err := ykManagementKeyMetadata(tx)
+	if err != nil {
+		return 0, fmt.Errorf("getting management key metadata: %w", err)
+	}
+	yk.mgmtAlg = m.Algorithm
+	return m.Algorithm, nil
+}
+
+// authenticate authenticates with the management key, using the algorithm of
+// the card's current management key if key doesn't set one.
+func (yk *YubiKey) authenticate(tx *scTx, key ManagementKey) error {
+	a, err := yk.managementKeyAlgorithm(tx, key)
+	if err != nil {
+		return err
+	}
+	key.Algorithm = a
+	if err := ykAuthenticate(tx, key, yk.rand); err != nil {
+		// Another application may have changed the management key, read its
+		// algorithm again next time.
+		yk.mgmtAlg = 0
+		return err
+	}
+	return nil
+}
+
+// parseMetadata decodes the response of a GET METADATA command, TLV encoded
+// fields with single byte tags and lengths.
+//
+// https://developers.yubico.com/PIV/Introduction/Yubico_extensions.html
+func parseMetadata(b []byte) (map[byte][]byte, error) {
+	fields := map[byte][]byte{}
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errors.New("invalid metadata encoding")
+		}
+		tag, n := b[0], int(b[1])
+		fields[tag] = b[2 : 2+n]
+		b = b[2+n:]
+	}
+	return fields, nil
+}
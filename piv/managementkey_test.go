@@ -0,0 +1,150 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
+)
+
+func TestManagementKeyMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		version [3]byte
+	}{
+		{"5.4.3", [3]byte{5, 4, 3}},
+		{"5.7.1", [3]byte{5, 7, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			yk := newTestYubiKeyConfig(t, pivtest.Config{Version: test.version})
+
+			// YubiKeys with firmware 5.7.0 and later default to an AES-192 key.
+			want := ManagementKeyMetadata{ManagementKeyTDES, TouchPolicyNever, true}
+			if supportsVersion(yk.Version(), 5, 7, 0) {
+				want.Algorithm = ManagementKeyAES192
+			}
+			got, err := yk.ManagementKeyMetadata()
+			if err != nil {
+				t.Fatalf("getting management key metadata: %v", err)
+			}
+			if *got != want {
+				t.Errorf("management key metadata got=%+v, want=%+v", *got, want)
+			}
+
+			key := ManagementKey{
+				Algorithm: ManagementKeyAES128,
+				Key:       []byte("0123456789abcdef"),
+			}
+			if err := yk.SetManagementKeyTouch(DefaultManagementKey(), key); err != nil {
+				t.Fatalf("setting management key: %v", err)
+			}
+			got, err = yk.ManagementKeyMetadata()
+			if err != nil {
+				t.Fatalf("getting management key metadata: %v", err)
+			}
+			want = ManagementKeyMetadata{ManagementKeyAES128, TouchPolicyAlways, false}
+			if *got != want {
+				t.Errorf("management key metadata got=%+v, want=%+v", *got, want)
+			}
+		})
+	}
+}
+
+func TestManagementKeyMetadataUnsupported(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{4, 3, 0}})
+	testRequiresVersionBefore(t, yk, 5, 3, 0)
+
+	if _, err := yk.ManagementKeyMetadata(); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("getting management key metadata got err=%v, want=%v", err, ErrMissingCapability)
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	got, err := parseMetadata([]byte{0x01, 0x01, 0x0a, 0x02, 0x02, 0xff, 0x02, 0x05, 0x01, 0x00})
+	if err != nil {
+		t.Fatalf("parsing metadata: %v", err)
+	}
+	if len(got) != 3 || got[0x01][0] != 0x0a || got[0x02][1] != 0x02 || got[0x05][0] != 0x00 {
+		t.Errorf("parseMetadata() got=%x", got)
+	}
+	if _, err := parseMetadata([]byte{0x01, 0x02, 0x0a}); err == nil {
+		t.Errorf("parsing truncated metadata succeeded")
+	}
+}
+
+// metadataCountTransport wraps a Transport, counting requests for the
+// management key's metadata.
+type metadataCountTransport struct {
+	Transport
+	n int
+}
+
+func (m *metadataCountTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	if len(req) > 3 && req[1] == insGetMetadata && req[3] == keyCardManagement {
+		m.n++
+	}
+	return m.Transport.Transmit(req)
+}
+
+func TestManagementKeyAlgorithmCached(t *testing.T) {
+	mt := &metadataCountTransport{Transport: pivtest.New(pivtest.Config{Version: [3]byte{5, 7, 1}})}
+	yk, err := OpenTransport(mt)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := yk.authManagementKey(DefaultManagementKey()); err != nil {
+			t.Fatalf("authenticating: %v", err)
+		}
+	}
+	if mt.n != 1 {
+		t.Errorf("management key metadata read %d times, want 1", mt.n)
+	}
+
+	// The cached algorithm follows changes to the management key.
+	key := ManagementKey{Algorithm: ManagementKeyAES128, Key: []byte("0123456789abcdef")}
+	if err := yk.SetManagementKey(DefaultManagementKey(), key); err != nil {
+		t.Fatalf("setting management key: %v", err)
+	}
+	if err := yk.authManagementKey(ManagementKey{Key: key.Key}); err != nil {
+		t.Errorf("authenticating without algorithm: %v", err)
+	}
+	if mt.n != 1 {
+		t.Errorf("management key metadata read %d times, want 1", mt.n)
+	}
+
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("resetting yubikey: %v", err)
+	}
+	if err := yk.authManagementKey(DefaultManagementKey()); err != nil {
+		t.Errorf("authenticating after reset: %v", err)
+	}
+	if mt.n != 2 {
+		t.Errorf("management key metadata read %d times, want 2", mt.n)
+	}
+}
+
+func TestDefaultManagementKeyCopy(t *testing.T) {
+	key := DefaultManagementKey()
+	key.Key[0] = 0xff
+	if got := DefaultManagementKey().Key[0]; got != 0x01 {
+		t.Errorf("default management key modified through returned key: first byte got=0x%02x, want=0x01", got)
+	}
+}
@@ -17,6 +17,7 @@ package piv
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 type scErr struct {
@@ -133,6 +134,107 @@ func (a *apduErr) Unwrap() error {
 	return nil
 }
 
+// Transport is a channel to a smart card capable of exchanging raw APDUs.
+// The PIV logic in this package is implemented entirely on top of this
+// interface, allowing YubiKeys to be driven over PC/SC, a software card, a
+// network relay, or a recorded transcript.
+//
+// Transports are used through OpenTransport.
+type Transport interface {
+	// Begin starts a transaction, giving the caller exclusive access to the
+	// card until End is called.
+	Begin() error
+	// End ends a transaction started by Begin.
+	End() error
+	// Transmit sends a raw command APDU to the card. It returns the response
+	// data and the status word (SW1 and SW2) that trailed it.
+	//
+	// Transmit should only return an error if the APDU couldn't be exchanged
+	// with the card. Status words indicating a failed command are interpreted
+	// by the caller.
+	Transmit(req []byte) (resp []byte, sw uint16, err error)
+	// Close releases the connection to the card.
+	Close() error
+}
+
+// pcscTransport is a Transport backed by the operating system's PC/SC
+// implementation.
+type pcscTransport struct {
+	ctx *scContext
+	h   *scHandle
+
+	// reader and shared are used to reconnect to the card.
+	reader string
+	shared bool
+}
+
+func (p *pcscTransport) Begin() error {
+	return p.h.begin()
+}
+
+func (p *pcscTransport) End() error {
+	return p.h.end()
+}
+
+func (p *pcscTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	return p.h.transmit(req)
+}
+
+// Cancel interrupts outstanding blocking calls to the smart card daemon.
+//
+// PC/SC implementations differ in what can be interrupted. pcsc-lite, for
+// example, only cancels calls waiting for reader changes, and commands already
+// sent to the card run until the card responds.
+func (p *pcscTransport) Cancel() error {
+	return p.ctx.Cancel()
+}
+
+func (p *pcscTransport) Close() error {
+	err1 := p.h.Close()
+	err2 := p.ctx.Close()
+	if err1 == nil {
+		return err2
+	}
+	return err1
+}
+
+// Begin starts a transaction on the handle.
+func (h *scHandle) Begin() (*scTx, error) {
+	if err := h.begin(); err != nil {
+		return nil, err
+	}
+	return &scTx{t: &pcscTransport{h: h}}, nil
+}
+
+// scTx is an open transaction with a smart card. Methods on scTx handle APDU
+// chaining and status words, exchanging raw bytes through the Transport.
+type scTx struct {
+	t Transport
+	// trace, if set, is called for each command exchanged with the card.
+	trace Tracer
+}
+
+// Close ends the transaction.
+func (t *scTx) Close() error {
+	return t.t.End()
+}
+
+func (t *scTx) transmit(req []byte) (more bool, b []byte, err error) {
+	resp, sw, err := t.t.Transmit(req)
+	if err != nil {
+		return false, nil, fmt.Errorf("transmitting request: %w", err)
+	}
+	sw1 := byte(sw >> 8)
+	sw2 := byte(sw)
+	if sw1 == 0x90 && sw2 == 0x00 {
+		return false, resp, nil
+	}
+	if sw1 == 0x61 {
+		return true, resp, nil
+	}
+	return false, nil, &apduErr{sw1, sw2}
+}
+
 type apdu struct {
 	instruction byte
 	param1      byte
@@ -141,6 +243,16 @@ type apdu struct {
 }
 
 func (t *scTx) Transmit(d apdu) ([]byte, error) {
+	if t.trace == nil {
+		return t.transmitAPDU(d)
+	}
+	start := time.Now()
+	resp, err := t.transmitAPDU(d)
+	t.trace(newTrace(d, resp, err, time.Since(start)))
+	return resp, err
+}
+
+func (t *scTx) transmitAPDU(d apdu) ([]byte, error) {
 	data := d.data
 	var resp []byte
 	const maxAPDUDataSize = 0xff
@@ -36,3 +36,7 @@ func isRCNoReaders(rc C.int) bool {
 	// are available.
 	return false
 }
+
+// scSupportsPnP reports whether readers being attached or detached can be
+// detected using the PnP notification reader. Otherwise readers are polled.
+const scSupportsPnP = false
@@ -12,6 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build cgo && !pcscd
+// +build cgo,!pcscd
+
 package piv
 
 import "C"
@@ -28,3 +31,7 @@ func scCheck(rc C.long) error {
 func isRCNoReaders(rc C.long) bool {
 	return C.ulong(rc) == 0x8010002E
 }
+
+// scSupportsPnP reports whether readers being attached or detached can be
+// detected using the PnP notification reader.
+const scSupportsPnP = true
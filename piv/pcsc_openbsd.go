@@ -28,3 +28,7 @@ func scCheck(rc C.long) error {
 func isRCNoReaders(rc C.long) bool {
 	return rc == 0x8010002E
 }
+
+// scSupportsPnP reports whether readers being attached or detached can be
+// detected using the PnP notification reader.
+const scSupportsPnP = true
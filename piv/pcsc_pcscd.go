@@ -0,0 +1,543 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && (!cgo || pcscd)
+// +build linux
+// +build !cgo pcscd
+
+package piv
+
+// This file implements a client for the pcsc-lite daemon without cgo, by
+// speaking its wire protocol directly over the daemon's UNIX socket. It's used
+// on Linux when cgo is disabled, or when the "pcscd" build tag is provided.
+//
+// https://github.com/LudovicRousseau/PCSC/blob/master/src/winscard_msg.h
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+	"unsafe"
+)
+
+const (
+	// pcscdSocket is the default path of the pcsc-lite daemon's socket. It may
+	// be overridden by the PCSCLITE_CSOCK_NAME environment variable, the same
+	// as libpcsclite.
+	pcscdSocket    = "/run/pcscd/pcscd.comm"
+	pcscdSocketEnv = "PCSCLITE_CSOCK_NAME"
+
+	// Version of the wire protocol spoken by the client.
+	pcscdProtocolMajor = 4
+	pcscdProtocolMinor = 4
+
+	pcscdCmdEstablishContext = 0x01
+	pcscdCmdReleaseContext   = 0x02
+	pcscdCmdConnect          = 0x04
+	pcscdCmdDisconnect       = 0x06
+	pcscdCmdBeginTransaction = 0x07
+	pcscdCmdEndTransaction   = 0x08
+	pcscdCmdTransmit         = 0x09
+	pcscdCmdCancel           = 0x0D
+	pcscdCmdVersion          = 0x11
+	pcscdCmdGetReadersState  = 0x12
+	pcscdCmdWaitReaderState  = 0x13
+	pcscdCmdStopWaiting      = 0x14
+
+	pcscdMaxReaderName = 128
+	pcscdMaxATRSize    = 33
+	pcscdMaxReaders    = 16
+
+	scardScopeSystem      = 2
+	scardShareExclusive   = 1
+	scardShareShared      = 2
+	scardLeaveCard        = 0
+	scardProtocolT1       = 2
+	maxBufferSizeExtended = (4 + 3 + (1 << 16) + 3 + 2)
+	rcSuccess             = 0
+
+	rcNoService = 0x8010001D
+
+	// Reader states published by the daemon.
+	//
+	// https://github.com/LudovicRousseau/PCSC/blob/master/src/PCSC/pcsclite.h.in
+	pcscdStateUnknown = 0x0001
+	pcscdStateAbsent  = 0x0002
+	pcscdStatePresent = 0x0004
+
+	// pcscdSharingExclusive is the sharing value of a reader connected to
+	// exclusively. Positive values count shared connections.
+	pcscdSharingExclusive = -1
+)
+
+// scSupportsPnP reports whether readers being attached or detached can be
+// detected using the PnP notification reader.
+const scSupportsPnP = true
+
+// scardIORequestSize is the size of the SCARD_IO_REQUEST struct, which holds
+// two unsigned longs.
+const scardIORequestSize = 2 * uint32(unsafe.Sizeof(uintptr(0)))
+
+// pcscdByteOrder is the byte order of integers sent to the daemon, which uses
+// the native byte order of the host.
+var pcscdByteOrder = func() binary.ByteOrder {
+	n := uint16(1)
+	if *(*byte)(unsafe.Pointer(&n)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+func scCheck(rc uint32) error {
+	if rc == rcSuccess {
+		return nil
+	}
+	return &scErr{int64(rc)}
+}
+
+// Messages exchanged with the daemon. Each command is sent as a header followed
+// by the message, and the daemon replies with the same message with its
+// fields, including the return code, filled in.
+
+type pcscdHeader struct {
+	Size    uint32
+	Command uint32
+}
+
+type pcscdVersion struct {
+	Major int32
+	Minor int32
+	RV    uint32
+}
+
+type pcscdEstablish struct {
+	Scope   uint32
+	Context uint32
+	RV      uint32
+}
+
+type pcscdRelease struct {
+	Context uint32
+	RV      uint32
+}
+
+type pcscdConnect struct {
+	Context            uint32
+	Reader             [pcscdMaxReaderName]byte
+	ShareMode          uint32
+	PreferredProtocols uint32
+	Card               int32
+	ActiveProtocol     uint32
+	RV                 uint32
+}
+
+type pcscdDisconnect struct {
+	Card        int32
+	Disposition uint32
+	RV          uint32
+}
+
+type pcscdCancel struct {
+	Context uint32
+	RV      uint32
+}
+
+type pcscdWaitReaderState struct {
+	Timeout uint32
+	RV      uint32
+}
+
+type pcscdBegin struct {
+	Card int32
+	RV   uint32
+}
+
+type pcscdEnd struct {
+	Card        int32
+	Disposition uint32
+	RV          uint32
+}
+
+type pcscdTransmit struct {
+	Card            int32
+	SendPCIProtocol uint32
+	SendPCILength   uint32
+	SendLength      uint32
+	RecvPCIProtocol uint32
+	RecvPCILength   uint32
+	RecvLength      uint32
+	RV              uint32
+}
+
+// pcscdReaderState is the state of a reader as published by the daemon.
+type pcscdReaderState struct {
+	Name         [pcscdMaxReaderName]byte
+	EventCounter uint32
+	State        uint32
+	Sharing      int32
+	ATR          [pcscdMaxATRSize]byte
+	_            [3]byte // Padding.
+	ATRLength    uint32
+	Protocol     uint32
+}
+
+// cString returns the contents of a NUL terminated string.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+type scContext struct {
+	conn net.Conn
+	ctx  uint32
+}
+
+// dialPCSCD opens a new connection to the daemon.
+func dialPCSCD() (net.Conn, error) {
+	path := os.Getenv(pcscdSocketEnv)
+	if path == "" {
+		path = pcscdSocket
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		// Match libpcsclite, which reports a missing daemon through the
+		// return code.
+		return nil, &scErr{rcNoService}
+	}
+	return conn, nil
+}
+
+func newSCContext() (*scContext, error) {
+	conn, err := dialPCSCD()
+	if err != nil {
+		return nil, err
+	}
+	c := &scContext{conn: conn}
+
+	v := pcscdVersion{Major: pcscdProtocolMajor, Minor: pcscdProtocolMinor}
+	if err := c.call(pcscdCmdVersion, &v); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := scCheck(v.RV); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	e := pcscdEstablish{Scope: scardScopeSystem}
+	if err := c.call(pcscdCmdEstablishContext, &e); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := scCheck(e.RV); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.ctx = e.Context
+	return c, nil
+}
+
+// send writes a command and its message to the daemon.
+func (c *scContext) send(cmd uint32, msg interface{}) error {
+	var b bytes.Buffer
+	hdr := pcscdHeader{Size: uint32(binary.Size(msg)), Command: cmd}
+	if err := binary.Write(&b, pcscdByteOrder, hdr); err != nil {
+		return fmt.Errorf("encoding header: %w", err)
+	}
+	if err := binary.Write(&b, pcscdByteOrder, msg); err != nil {
+		return fmt.Errorf("encoding message: %w", err)
+	}
+	if _, err := c.conn.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("sending command to pcscd: %w", err)
+	}
+	return nil
+}
+
+// recv reads a reply from the daemon into msg.
+func (c *scContext) recv(msg interface{}) error {
+	if err := binary.Read(c.conn, pcscdByteOrder, msg); err != nil {
+		return fmt.Errorf("reading reply from pcscd: %w", err)
+	}
+	return nil
+}
+
+// call sends a command to the daemon and reads the reply into the same
+// message.
+func (c *scContext) call(cmd uint32, msg interface{}) error {
+	if err := c.send(cmd, msg); err != nil {
+		return err
+	}
+	return c.recv(msg)
+}
+
+func (c *scContext) Close() error {
+	r := pcscdRelease{Context: c.ctx}
+	err := c.call(pcscdCmdReleaseContext, &r)
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return scCheck(r.RV)
+}
+
+func (c *scContext) ListReaders() ([]string, error) {
+	hdr := pcscdHeader{Command: pcscdCmdGetReadersState}
+	if err := binary.Write(c.conn, pcscdByteOrder, hdr); err != nil {
+		return nil, fmt.Errorf("sending command to pcscd: %w", err)
+	}
+	var states [pcscdMaxReaders]pcscdReaderState
+	if err := c.recv(&states); err != nil {
+		return nil, err
+	}
+	var readers []string
+	for _, s := range states {
+		if name := cString(s.Name[:]); name != "" {
+			readers = append(readers, name)
+		}
+	}
+	// The daemon reports no readers as an empty list, unlike SCardListReaders
+	// which returns an error. Either way, return nil with no smart cards.
+	return readers, nil
+}
+
+// readerStates registers the client for reader events, returning the current
+// state of all readers.
+func (c *scContext) readerStates() ([]pcscdReaderState, error) {
+	hdr := pcscdHeader{Command: pcscdCmdWaitReaderState}
+	if err := binary.Write(c.conn, pcscdByteOrder, hdr); err != nil {
+		return nil, fmt.Errorf("sending command to pcscd: %w", err)
+	}
+	var states [pcscdMaxReaders]pcscdReaderState
+	if err := c.recv(&states); err != nil {
+		return nil, err
+	}
+	return states[:], nil
+}
+
+// stopWaiting unregisters the client from reader events. The daemon replies
+// with a single message, either acknowledging the request or signaling an event
+// that raced with it.
+func (c *scContext) stopWaiting() error {
+	hdr := pcscdHeader{Command: pcscdCmdStopWaiting}
+	if err := binary.Write(c.conn, pcscdByteOrder, hdr); err != nil {
+		return fmt.Errorf("sending command to pcscd: %w", err)
+	}
+	var w pcscdWaitReaderState
+	return c.recv(&w)
+}
+
+// updateStates sets the event state of each reader from the state published
+// by the daemon, reporting whether any reader changed.
+//
+// This mirrors the implementation of SCardGetStatusChange in libpcsclite.
+func updateStates(published []pcscdReaderState, states []scReaderState) bool {
+	numReaders := 0
+	byName := map[string]*pcscdReaderState{}
+	for i := range published {
+		if name := cString(published[i].Name[:]); name != "" {
+			numReaders++
+			byName[name] = &published[i]
+		}
+	}
+
+	changed := false
+	for i := range states {
+		s := &states[i]
+		var event uint32
+		if s.reader == scPnPNotification {
+			event = uint32(numReaders) << 16
+		} else if r, ok := byName[s.reader]; !ok {
+			event = scStateUnknown | scStateUnavailable
+		} else {
+			event = r.EventCounter << 16
+			switch {
+			case r.State&pcscdStatePresent != 0:
+				event |= scStatePresent
+			case r.State&pcscdStateAbsent != 0:
+				event |= scStateEmpty
+			case r.State&pcscdStateUnknown != 0:
+				event |= scStateUnavailable
+			}
+			if r.Sharing == pcscdSharingExclusive {
+				event |= scStateExclusive | scStateInUse
+			} else if r.Sharing > 0 {
+				event |= scStateInUse
+			}
+		}
+		if event != s.currentState&^scStateChanged {
+			event |= scStateChanged
+			changed = true
+		}
+		s.eventState = event
+	}
+	return changed
+}
+
+// GetStatusChange blocks until the state of one of the readers differs from
+// its current state, or the timeout expires. A negative timeout waits
+// indefinitely.
+func (c *scContext) GetStatusChange(timeout time.Duration, states []scReaderState) error {
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		published, err := c.readerStates()
+		if err != nil {
+			return err
+		}
+		if updateStates(published, states) {
+			return c.stopWaiting()
+		}
+
+		// Wait for the daemon to signal an event.
+		var w pcscdWaitReaderState
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
+			return fmt.Errorf("setting deadline: %w", err)
+		}
+		err = c.recv(&w)
+		if derr := c.conn.SetReadDeadline(time.Time{}); derr != nil {
+			return fmt.Errorf("clearing deadline: %w", derr)
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if err := c.stopWaiting(); err != nil {
+				return err
+			}
+			return &scErr{rcTimeout}
+		}
+		if err != nil {
+			return err
+		}
+		// The return code indicates whether the wait was cancelled.
+		if err := scCheck(w.RV); err != nil {
+			return err
+		}
+	}
+}
+
+// Cancel interrupts any blocking calls on the context, such as
+// GetStatusChange. Like libpcsclite, the request is sent over a separate
+// connection, since the context's connection is blocked.
+func (c *scContext) Cancel() error {
+	conn, err := dialPCSCD()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cc := &scContext{conn: conn}
+	m := pcscdCancel{Context: c.ctx}
+	if err := cc.call(pcscdCmdCancel, &m); err != nil {
+		return err
+	}
+	return scCheck(m.RV)
+}
+
+type scHandle struct {
+	c *scContext
+	h int32
+}
+
+func (c *scContext) Connect(reader string, shared bool) (*scHandle, error) {
+	m := pcscdConnect{
+		Context:            c.ctx,
+		ShareMode:          scardShareExclusive,
+		PreferredProtocols: scardProtocolT1,
+	}
+	if len(reader) >= len(m.Reader) {
+		return nil, fmt.Errorf("reader name too long: %d bytes", len(reader))
+	}
+	if shared {
+		m.ShareMode = scardShareShared
+	}
+	copy(m.Reader[:], reader)
+	if err := c.call(pcscdCmdConnect, &m); err != nil {
+		return nil, err
+	}
+	if err := scCheck(m.RV); err != nil {
+		return nil, err
+	}
+	return &scHandle{c: c, h: m.Card}, nil
+}
+
+func (h *scHandle) Close() error {
+	m := pcscdDisconnect{Card: h.h, Disposition: scardLeaveCard}
+	if err := h.c.call(pcscdCmdDisconnect, &m); err != nil {
+		return err
+	}
+	return scCheck(m.RV)
+}
+
+func (h *scHandle) begin() error {
+	m := pcscdBegin{Card: h.h}
+	if err := h.c.call(pcscdCmdBeginTransaction, &m); err != nil {
+		return err
+	}
+	return scCheck(m.RV)
+}
+
+func (h *scHandle) end() error {
+	m := pcscdEnd{Card: h.h, Disposition: scardLeaveCard}
+	if err := h.c.call(pcscdCmdEndTransaction, &m); err != nil {
+		return err
+	}
+	return scCheck(m.RV)
+}
+
+func (h *scHandle) transmit(req []byte) ([]byte, uint16, error) {
+	m := pcscdTransmit{
+		Card:            h.h,
+		SendPCIProtocol: scardProtocolT1,
+		SendPCILength:   scardIORequestSize,
+		SendLength:      uint32(len(req)),
+		RecvPCIProtocol: scardProtocolT1,
+		RecvPCILength:   scardIORequestSize,
+		RecvLength:      maxBufferSizeExtended,
+	}
+	if err := h.c.send(pcscdCmdTransmit, &m); err != nil {
+		return nil, 0, err
+	}
+	// The command APDU follows the message.
+	if _, err := h.c.conn.Write(req); err != nil {
+		return nil, 0, fmt.Errorf("sending command to pcscd: %w", err)
+	}
+	if err := h.c.recv(&m); err != nil {
+		return nil, 0, err
+	}
+	if err := scCheck(m.RV); err != nil {
+		return nil, 0, err
+	}
+	if m.RecvLength > maxBufferSizeExtended {
+		return nil, 0, fmt.Errorf("scard response too long: %d", m.RecvLength)
+	}
+	resp := make([]byte, m.RecvLength)
+	if _, err := io.ReadFull(h.c.conn, resp); err != nil {
+		return nil, 0, fmt.Errorf("reading response from pcscd: %w", err)
+	}
+	respN := len(resp)
+	if respN < 2 {
+		return nil, 0, fmt.Errorf("scard response too short: %d", respN)
+	}
+	sw := uint16(resp[respN-2])<<8 | uint16(resp[respN-1])
+	return resp[:respN-2], sw, nil
+}
@@ -0,0 +1,784 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && (!cgo || pcscd)
+// +build linux
+// +build !cgo pcscd
+
+package piv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
+)
+
+const testPCSCDReader = "Yubico YubiKey OTP+FIDO+CCID 00 00"
+
+// fakePCSCD implements the pcsc-lite daemon's wire protocol, exposing
+// simulated cards as readers.
+type fakePCSCD struct {
+	t *testing.T
+	l net.Listener
+
+	mu sync.Mutex
+	// readers holds the attached readers in the order they were attached.
+	readers []string
+	// cards holds the card inserted in each reader, or nil if empty.
+	cards map[string]*pivtest.Card
+	// counters counts card insertions and removals for each reader.
+	counters map[string]uint32
+	// handles maps card handles to their reader.
+	handles map[int32]string
+	// shared holds the handles connected in shared mode.
+	shared map[int32]bool
+	// reset holds the handles that haven't been used since the card was
+	// reset.
+	reset       map[int32]bool
+	nextHandle  int32
+	nextContext uint32
+	// waiting holds clients registered for reader events by their context.
+	waiting map[uint32]*fakePCSCDConn
+}
+
+// fakePCSCDConn is a client connection to the fake daemon.
+type fakePCSCDConn struct {
+	conn net.Conn
+	ctx  uint32
+	// mu serializes writes, since events are signaled from other
+	// connections.
+	mu sync.Mutex
+}
+
+func (c *fakePCSCDConn) write(msg interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return binary.Write(c.conn, pcscdByteOrder, msg) == nil
+}
+
+// newFakePCSCD starts a fake daemon and points the client at its socket for the
+// duration of the test.
+func newFakePCSCD(t *testing.T, readers map[string]*pivtest.Card) *fakePCSCD {
+	dir, err := os.MkdirTemp("", "pcscd")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	path := filepath.Join(dir, "pcscd.comm")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("listening on %s: %v", path, err)
+	}
+	d := &fakePCSCD{
+		t:           t,
+		l:           l,
+		cards:       map[string]*pivtest.Card{},
+		counters:    map[string]uint32{},
+		handles:     map[int32]string{},
+		shared:      map[int32]bool{},
+		reset:       map[int32]bool{},
+		nextHandle:  1,
+		nextContext: 1,
+		waiting:     map[uint32]*fakePCSCDConn{},
+	}
+	var names []string
+	for name := range readers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d.attach(name, readers[name])
+	}
+
+	prev, ok := os.LookupEnv(pcscdSocketEnv)
+	os.Setenv(pcscdSocketEnv, path)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(pcscdSocketEnv, prev)
+		} else {
+			os.Unsetenv(pcscdSocketEnv)
+		}
+		l.Close()
+		os.RemoveAll(dir)
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(&fakePCSCDConn{conn: conn})
+		}
+	}()
+	return d
+}
+
+// signal wakes clients waiting for reader events. d.mu must be held.
+func (d *fakePCSCD) signal() {
+	for ctx, c := range d.waiting {
+		c.write(&pcscdWaitReaderState{RV: rcSuccess})
+		delete(d.waiting, ctx)
+	}
+}
+
+// attach connects a reader, with a card inserted if card is non-nil.
+func (d *fakePCSCD) attach(reader string, card *pivtest.Card) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readers = append(d.readers, reader)
+	d.cards[reader] = card
+	if card != nil {
+		d.counters[reader]++
+	}
+	d.signal()
+}
+
+// resetCard resets the card in a reader, as if another application
+// disconnected from it with SCARD_RESET_CARD.
+func (d *fakePCSCD) resetCard(reader string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cards[reader].Close()
+	for h, r := range d.handles {
+		if r == reader {
+			d.reset[h] = true
+		}
+	}
+}
+
+// detach disconnects a reader, invalidating any handles to it.
+func (d *fakePCSCD) detach(reader string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, r := range d.readers {
+		if r == reader {
+			d.readers = append(d.readers[:i], d.readers[i+1:]...)
+			break
+		}
+	}
+	for h, r := range d.handles {
+		if r == reader {
+			delete(d.handles, h)
+			delete(d.shared, h)
+			delete(d.reset, h)
+		}
+	}
+	delete(d.cards, reader)
+	delete(d.counters, reader)
+	d.signal()
+}
+
+// readerStates returns the published state of all readers. d.mu must be
+// held.
+func (d *fakePCSCD) readerStates() *[pcscdMaxReaders]pcscdReaderState {
+	var states [pcscdMaxReaders]pcscdReaderState
+	for i, name := range d.readers {
+		s := &states[i]
+		copy(s.Name[:], name)
+		s.EventCounter = d.counters[name]
+		if d.cards[name] == nil {
+			s.State = pcscdStateAbsent
+			continue
+		}
+		s.State = pcscdStatePresent
+		for h, r := range d.handles {
+			if r != name {
+				continue
+			}
+			if !d.shared[h] {
+				s.Sharing = pcscdSharingExclusive
+				break
+			}
+			s.Sharing++
+		}
+	}
+	return &states
+}
+
+func (d *fakePCSCD) serve(c *fakePCSCDConn) {
+	conn := c.conn
+	defer conn.Close()
+
+	// Handles opened by this client, released when it disconnects.
+	var handles []int32
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.waiting, c.ctx)
+		for _, h := range handles {
+			d.release(h)
+		}
+		d.signal()
+	}()
+
+	read := func(msg interface{}) bool {
+		return binary.Read(conn, pcscdByteOrder, msg) == nil
+	}
+	write := c.write
+
+	for {
+		var hdr pcscdHeader
+		if !read(&hdr) {
+			return
+		}
+		switch hdr.Command {
+		case pcscdCmdVersion:
+			var m pcscdVersion
+			if !read(&m) {
+				return
+			}
+			if m.Major != pcscdProtocolMajor {
+				m.RV = 0x80100016 // SCARD_E_NOT_TRANSACTED
+			}
+			if !write(&m) {
+				return
+			}
+		case pcscdCmdEstablishContext:
+			var m pcscdEstablish
+			if !read(&m) {
+				return
+			}
+			d.mu.Lock()
+			c.ctx = d.nextContext
+			d.nextContext++
+			d.mu.Unlock()
+			m.Context = c.ctx
+			if !write(&m) {
+				return
+			}
+		case pcscdCmdReleaseContext:
+			var m pcscdRelease
+			if !read(&m) {
+				return
+			}
+			if !write(&m) {
+				return
+			}
+		case pcscdCmdGetReadersState:
+			d.mu.Lock()
+			states := d.readerStates()
+			d.mu.Unlock()
+			if !write(states) {
+				return
+			}
+		case pcscdCmdWaitReaderState:
+			d.mu.Lock()
+			d.waiting[c.ctx] = c
+			states := d.readerStates()
+			ok := write(states)
+			d.mu.Unlock()
+			if !ok {
+				return
+			}
+		case pcscdCmdStopWaiting:
+			d.mu.Lock()
+			_, ok := d.waiting[c.ctx]
+			delete(d.waiting, c.ctx)
+			if ok {
+				ok = write(&pcscdWaitReaderState{RV: rcSuccess})
+			} else {
+				// The client was already signaled.
+				ok = true
+			}
+			d.mu.Unlock()
+			if !ok {
+				return
+			}
+		case pcscdCmdCancel:
+			var m pcscdCancel
+			if !read(&m) {
+				return
+			}
+			d.mu.Lock()
+			if w, ok := d.waiting[m.Context]; ok {
+				w.write(&pcscdWaitReaderState{RV: rcCancelled})
+				delete(d.waiting, m.Context)
+			}
+			d.mu.Unlock()
+			if !write(&m) {
+				return
+			}
+		case pcscdCmdConnect:
+			var m pcscdConnect
+			if !read(&m) {
+				return
+			}
+			m.Card, m.RV = d.connect(cString(m.Reader[:]), m.ShareMode == scardShareShared)
+			if m.RV == rcSuccess {
+				handles = append(handles, m.Card)
+				m.ActiveProtocol = scardProtocolT1
+			}
+			if !write(&m) {
+				return
+			}
+		case pcscdCmdDisconnect:
+			var m pcscdDisconnect
+			if !read(&m) {
+				return
+			}
+			m.RV = d.withCard(m.Card, func(card *pivtest.Card) error {
+				d.mu.Lock()
+				defer d.mu.Unlock()
+				d.release(m.Card)
+				d.signal()
+				return nil
+			})
+			if !write(&m) {
+				return
+			}
+		case pcscdCmdBeginTransaction:
+			var m pcscdBegin
+			if !read(&m) {
+				return
+			}
+			m.RV = d.withCard(m.Card, func(card *pivtest.Card) error { return card.Begin() })
+			if !write(&m) {
+				return
+			}
+		case pcscdCmdEndTransaction:
+			var m pcscdEnd
+			if !read(&m) {
+				return
+			}
+			m.RV = d.withCard(m.Card, func(card *pivtest.Card) error { return card.End() })
+			if !write(&m) {
+				return
+			}
+		case pcscdCmdTransmit:
+			var m pcscdTransmit
+			if !read(&m) {
+				return
+			}
+			req := make([]byte, m.SendLength)
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			var resp []byte
+			m.RV = d.withCard(m.Card, func(card *pivtest.Card) error {
+				r, sw, err := card.Transmit(req)
+				if err != nil {
+					return err
+				}
+				resp = append(r, byte(sw>>8), byte(sw))
+				return nil
+			})
+			m.RecvLength = uint32(len(resp))
+			if !write(&m) {
+				return
+			}
+			if m.RV == rcSuccess {
+				c.mu.Lock()
+				_, err := conn.Write(resp)
+				c.mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		default:
+			d.t.Errorf("fake pcscd: unexpected command 0x%x", hdr.Command)
+			return
+		}
+	}
+}
+
+// connect opens a connection to a reader.
+func (d *fakePCSCD) connect(reader string, shared bool) (int32, uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	card, ok := d.cards[reader]
+	if !ok {
+		return 0, 0x80100009 // SCARD_E_UNKNOWN_READER
+	}
+	if card == nil {
+		return 0, 0x8010000C // SCARD_E_NO_SMARTCARD
+	}
+	for h, r := range d.handles {
+		if r == reader && (!shared || !d.shared[h]) {
+			return 0, 0x8010000B // SCARD_E_SHARING_VIOLATION
+		}
+	}
+	h := d.nextHandle
+	d.nextHandle++
+	d.handles[h] = reader
+	d.shared[h] = shared
+	d.signal()
+	return h, rcSuccess
+}
+
+// release closes a handle, resetting the card's session once no connections
+// remain. d.mu must be held.
+func (d *fakePCSCD) release(h int32) {
+	reader, ok := d.handles[h]
+	if !ok {
+		return
+	}
+	delete(d.handles, h)
+	delete(d.shared, h)
+	delete(d.reset, h)
+	for _, r := range d.handles {
+		if r == reader {
+			return
+		}
+	}
+	d.cards[reader].Close()
+}
+
+// withCard calls f with the card of a handle, returning a pcsc return code.
+func (d *fakePCSCD) withCard(h int32, f func(c *pivtest.Card) error) uint32 {
+	d.mu.Lock()
+	reader, ok := d.handles[h]
+	card := d.cards[reader]
+	reset := d.reset[h]
+	delete(d.reset, h)
+	d.mu.Unlock()
+	if !ok {
+		return 0x80100003 // SCARD_E_INVALID_HANDLE
+	}
+	if reset {
+		return rcResetCard
+	}
+	if err := f(card); err != nil {
+		return 0x80100001 // SCARD_F_INTERNAL_ERROR
+	}
+	return rcSuccess
+}
+
+func TestPCSCDListReaders(t *testing.T) {
+	newFakePCSCD(t, map[string]*pivtest.Card{
+		testPCSCDReader: pivtest.New(pivtest.Config{}),
+	})
+	runContextTest(t, func(t *testing.T, c *scContext) {
+		readers, err := c.ListReaders()
+		if err != nil {
+			t.Fatalf("listing readers: %v", err)
+		}
+		if len(readers) != 1 || readers[0] != testPCSCDReader {
+			t.Errorf("listing readers returned %q, want %q", readers, testPCSCDReader)
+		}
+	})
+}
+
+func TestPCSCDNoReaders(t *testing.T) {
+	newFakePCSCD(t, nil)
+	cards, err := Cards()
+	if err != nil {
+		t.Fatalf("listing cards: %v", err)
+	}
+	if len(cards) != 0 {
+		t.Errorf("listing cards returned %q, want none", cards)
+	}
+}
+
+func TestPCSCDNoService(t *testing.T) {
+	os.Setenv(pcscdSocketEnv, filepath.Join(t.TempDir(), "missing.comm"))
+	defer os.Unsetenv(pcscdSocketEnv)
+
+	_, err := newSCContext()
+	var e *scErr
+	if !errors.As(err, &e) {
+		t.Fatalf("expected scErr, got %v", err)
+	}
+	if e.rc != rcNoService {
+		t.Fatalf("expected return code 0x%x, got 0x%x", rcNoService, e.rc)
+	}
+}
+
+func TestPCSCDGetVersion(t *testing.T) {
+	newFakePCSCD(t, map[string]*pivtest.Card{
+		testPCSCDReader: pivtest.New(pivtest.Config{}),
+	})
+	runHandleTest(t, testGetVersion)
+}
+
+func TestPCSCDOpen(t *testing.T) {
+	const serial = 87654321
+	newFakePCSCD(t, map[string]*pivtest.Card{
+		testPCSCDReader: pivtest.New(pivtest.Config{Serial: serial}),
+	})
+	yk, err := Open(testPCSCDReader)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer func() {
+		if err := yk.Close(); err != nil {
+			t.Errorf("closing yubikey: %v", err)
+		}
+	}()
+
+	got, err := yk.Serial()
+	if err != nil {
+		t.Fatalf("getting serial: %v", err)
+	}
+	if got != serial {
+		t.Errorf("serial got=%d, want=%d", got, serial)
+	}
+	// Exercise chained commands and long responses.
+	key := Key{
+		Algorithm:   AlgorithmRSA2048,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyNever,
+	}
+	if _, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key); err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	_, oerr := Open(testPCSCDReader)
+	var e *scErr
+	if !errors.As(oerr, &e) {
+		t.Fatalf("expected scErr, got %v", oerr)
+	}
+	if e.rc != 0x8010000B {
+		t.Fatalf("expected return code 0x8010000B, got 0x%x", e.rc)
+	}
+}
+
+func TestPCSCDOpenShared(t *testing.T) {
+	newFakePCSCD(t, map[string]*pivtest.Card{
+		testPCSCDReader: pivtest.New(pivtest.Config{}),
+	})
+	yk1, err := OpenShared(testPCSCDReader)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk1.Close()
+	yk2, err := OpenShared(testPCSCDReader)
+	if err != nil {
+		t.Fatalf("opening yubikey a second time: %v", err)
+	}
+	defer yk2.Close()
+
+	for i, yk := range []*YubiKey{yk1, yk2, yk1} {
+		if _, err := yk.Serial(); err != nil {
+			t.Errorf("getting serial from connection %d: %v", i, err)
+		}
+	}
+
+	_, oerr := Open(testPCSCDReader)
+	var e *scErr
+	if !errors.As(oerr, &e) || e.rc != 0x8010000B {
+		t.Fatalf("expected exclusive open to fail with 0x8010000B, got %v", oerr)
+	}
+}
+
+func TestPCSCDReconnect(t *testing.T) {
+	d := newFakePCSCD(t, map[string]*pivtest.Card{
+		testPCSCDReader: pivtest.New(pivtest.Config{}),
+	})
+	yk, err := Open(testPCSCDReader)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	d.resetCard(testPCSCDReader)
+	if _, err := yk.Serial(); err != nil {
+		t.Fatalf("getting serial after reset: %v", err)
+	}
+	if _, err := yk.Retries(); err != nil {
+		t.Fatalf("getting retries after reconnecting: %v", err)
+	}
+}
+
+// nextEvent waits for Watch to send an event.
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func TestPCSCDEnumerate(t *testing.T) {
+	const (
+		otherReader = "Yubico YubiKey OTP+FIDO+CCID 01 00"
+		emptyReader = "Empty Reader 00 00"
+	)
+	newFakePCSCD(t, map[string]*pivtest.Card{
+		testPCSCDReader: pivtest.New(pivtest.Config{Serial: 11111111}),
+		otherReader:     pivtest.New(pivtest.Config{Serial: 22222222, Formfactor: FormfactorUSBCNano}),
+		emptyReader:     nil,
+	})
+	infos, err := Enumerate()
+	if err != nil {
+		t.Fatalf("enumerating cards: %v", err)
+	}
+	got := map[string]CardInfo{}
+	for _, info := range infos {
+		got[info.Reader] = info
+	}
+	if len(got) != 3 {
+		t.Fatalf("enumerate returned %d cards, want 3: %+v", len(got), infos)
+	}
+	if info := got[emptyReader]; info.Err == nil {
+		t.Errorf("empty reader returned no error: %+v", info)
+	}
+	want := CardInfo{
+		Reader:     otherReader,
+		IsYubiKey:  true,
+		Serial:     22222222,
+		Version:    Version{5, 4, 3},
+		Formfactor: FormfactorUSBCNano,
+	}
+	if info := got[otherReader]; info != want {
+		t.Errorf("card info got=%+v, want=%+v", info, want)
+	}
+
+	yk, err := OpenSerial(22222222)
+	if err != nil {
+		t.Fatalf("opening yubikey by serial: %v", err)
+	}
+	serial, err := yk.Serial()
+	if err != nil {
+		t.Fatalf("getting serial: %v", err)
+	}
+	if serial != 22222222 {
+		t.Errorf("opened yubikey with serial %d, want 22222222", serial)
+	}
+	if err := yk.Close(); err != nil {
+		t.Errorf("closing yubikey: %v", err)
+	}
+
+	if _, err := OpenSerial(33333333); !errors.Is(err, ErrNotFound) {
+		t.Errorf("opening unknown serial got err=%v, want ErrNotFound", err)
+	}
+}
+
+func TestPCSCDReaderFilter(t *testing.T) {
+	const otherReader = "Other Reader 00 00"
+	newFakePCSCD(t, map[string]*pivtest.Card{
+		testPCSCDReader: pivtest.New(pivtest.Config{}),
+		otherReader:     pivtest.New(pivtest.Config{}),
+	})
+	c := Client{
+		ReaderFilter: func(reader string) bool {
+			return strings.Contains(reader, "YubiKey")
+		},
+	}
+	cards, err := c.Cards()
+	if err != nil {
+		t.Fatalf("listing cards: %v", err)
+	}
+	if len(cards) != 1 || cards[0] != testPCSCDReader {
+		t.Errorf("listing cards returned %q, want %q", cards, testPCSCDReader)
+	}
+	if _, err := c.Open(otherReader); err == nil {
+		t.Errorf("opening excluded reader succeeded")
+	}
+	yk, err := c.Open(testPCSCDReader)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	if err := yk.Close(); err != nil {
+		t.Errorf("closing yubikey: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan Event)
+	errc := make(chan error, 1)
+	go func() { errc <- c.Watch(ctx, events) }()
+	for _, want := range []Event{
+		{EventReaderAttached, testPCSCDReader},
+		{EventCardInserted, testPCSCDReader},
+	} {
+		if got := nextEvent(t, events); got != want {
+			t.Fatalf("event got=%v %q, want=%v %q", got.Type, got.Reader, want.Type, want.Reader)
+		}
+	}
+	cancel()
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %v %q", e.Type, e.Reader)
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("watch returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for watch to return")
+	}
+}
+
+func TestPCSCDWatch(t *testing.T) {
+	const otherReader = "Yubico YubiKey OTP+FIDO+CCID 01 00"
+	d := newFakePCSCD(t, map[string]*pivtest.Card{
+		testPCSCDReader: pivtest.New(pivtest.Config{}),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan Event)
+	errc := make(chan error, 1)
+	go func() { errc <- Watch(ctx, events) }()
+
+	expect := func(want ...Event) {
+		t.Helper()
+		for _, w := range want {
+			if got := nextEvent(t, events); got != w {
+				t.Fatalf("event got=%v %q, want=%v %q", got.Type, got.Reader, w.Type, w.Reader)
+			}
+		}
+	}
+
+	expect(
+		Event{EventReaderAttached, testPCSCDReader},
+		Event{EventCardInserted, testPCSCDReader},
+	)
+
+	d.attach(otherReader, pivtest.New(pivtest.Config{}))
+	expect(
+		Event{EventReaderAttached, otherReader},
+		Event{EventCardInserted, otherReader},
+	)
+
+	yk, err := Open(otherReader)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	expect(Event{EventCardInUse, otherReader})
+	if err := yk.Close(); err != nil {
+		t.Fatalf("closing yubikey: %v", err)
+	}
+	expect(Event{EventCardReleased, otherReader})
+
+	d.detach(testPCSCDReader)
+	expect(
+		Event{EventCardRemoved, testPCSCDReader},
+		Event{EventReaderDetached, testPCSCDReader},
+	)
+
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("watch returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for watch to return")
+	}
+}
@@ -15,6 +15,7 @@
 package piv
 
 import (
+	"bytes"
 	"errors"
 	"strings"
 	"testing"
@@ -63,7 +64,7 @@ func runHandleTest(t *testing.T, f func(t *testing.T, h *scHandle)) {
 		if reader == "" {
 			t.Skip("could not find yubikey, skipping testing")
 		}
-		h, err := c.Connect(reader)
+		h, err := c.Connect(reader, false)
 		if err != nil {
 			t.Fatalf("connecting to %s: %v", reader, err)
 		}
@@ -137,3 +138,100 @@ func TestErrors(t *testing.T) {
 		}
 	}
 }
+
+// scriptedExchange is a single command and response pair expected by a
+// scriptedTransport.
+type scriptedExchange struct {
+	req  []byte
+	resp []byte
+	sw   uint16
+}
+
+// scriptedTransport is a Transport that expects a fixed sequence of commands,
+// failing the test if a different command is sent.
+type scriptedTransport struct {
+	t         *testing.T
+	exchanges []scriptedExchange
+	inTx      bool
+	closed    bool
+}
+
+func (s *scriptedTransport) Begin() error {
+	s.inTx = true
+	return nil
+}
+
+func (s *scriptedTransport) End() error {
+	s.inTx = false
+	return nil
+}
+
+func (s *scriptedTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	if !s.inTx {
+		s.t.Errorf("transmit outside of a transaction")
+	}
+	if len(s.exchanges) == 0 {
+		s.t.Fatalf("unexpected command: %x", req)
+	}
+	e := s.exchanges[0]
+	s.exchanges = s.exchanges[1:]
+	if !bytes.Equal(req, e.req) {
+		s.t.Fatalf("unexpected command: got=%x, want=%x", req, e.req)
+	}
+	return e.resp, e.sw, nil
+}
+
+func (s *scriptedTransport) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestTransmitChaining(t *testing.T) {
+	data := bytes.Repeat([]byte{0xaa}, 0xff+2)
+	st := &scriptedTransport{
+		t:    t,
+		inTx: true,
+		exchanges: []scriptedExchange{
+			{
+				req: append([]byte{0x10, 0xdb, 0x3f, 0xff, 0xff}, data[:0xff]...),
+				sw:  0x9000,
+			},
+			{
+				req:  []byte{0x00, 0xdb, 0x3f, 0xff, 0x02, 0xaa, 0xaa},
+				resp: []byte{0x01, 0x02},
+				sw:   0x6102,
+			},
+			{
+				req:  []byte{0x00, 0xc0, 0x00, 0x00, 0x00},
+				resp: []byte{0x03, 0x04},
+				sw:   0x9000,
+			},
+		},
+	}
+	tx := &scTx{t: st}
+	got, err := tx.Transmit(apdu{instruction: insPutData, param1: 0x3f, param2: 0xff, data: data})
+	if err != nil {
+		t.Fatalf("transmit: %v", err)
+	}
+	if want := []byte{0x01, 0x02, 0x03, 0x04}; !bytes.Equal(got, want) {
+		t.Errorf("transmit returned %x, want %x", got, want)
+	}
+	if len(st.exchanges) != 0 {
+		t.Errorf("%d exchanges were not sent", len(st.exchanges))
+	}
+}
+
+func TestTransmitStatusError(t *testing.T) {
+	st := &scriptedTransport{
+		t:    t,
+		inTx: true,
+		exchanges: []scriptedExchange{
+			{req: []byte{0x00, 0xcb, 0x3f, 0xff, 0x00}, sw: 0x6a82},
+		},
+	}
+	tx := &scTx{t: st}
+	_, err := tx.Transmit(apdu{instruction: insGetData, param1: 0x3f, param2: 0xff})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("transmit returned %v, want ErrNotFound", err)
+	}
+}
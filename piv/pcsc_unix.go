@@ -12,8 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build darwin || linux || freebsd || openbsd
-// +build darwin linux freebsd openbsd
+//go:build darwin || freebsd || openbsd || (linux && cgo && !pcscd)
+// +build darwin freebsd openbsd linux,cgo,!pcscd
 
 package piv
 
@@ -29,6 +29,7 @@ package piv
 // #cgo openbsd CFLAGS: -I/usr/local/include/PCSC
 // #cgo openbsd LDFLAGS: -L/usr/local/lib/
 // #cgo openbsd LDFLAGS: -lpcsclite
+// #include <stdlib.h>
 // #include <PCSC/winscard.h>
 // #include <PCSC/wintypes.h>
 import "C"
@@ -36,6 +37,7 @@ import "C"
 import (
 	"bytes"
 	"fmt"
+	"time"
 	"unsafe"
 )
 
@@ -88,17 +90,52 @@ func (c *scContext) ListReaders() ([]string, error) {
 	return readers, nil
 }
 
+// GetStatusChange blocks until the state of one of the readers differs from
+// its current state, or the timeout expires. A negative timeout waits
+// indefinitely.
+func (c *scContext) GetStatusChange(timeout time.Duration, states []scReaderState) error {
+	cStates := make([]C.SCARD_READERSTATE, len(states))
+	for i, s := range states {
+		reader := C.CString(s.reader)
+		defer C.free(unsafe.Pointer(reader))
+		cStates[i].szReader = reader
+		cStates[i].dwCurrentState = C.DWORD(s.currentState)
+	}
+	t := C.DWORD(C.INFINITE)
+	if timeout >= 0 {
+		t = C.DWORD(timeout / time.Millisecond)
+	}
+	rc := C.SCardGetStatusChange(c.ctx, t, &cStates[0], C.DWORD(len(cStates)))
+	if err := scCheck(rc); err != nil {
+		return err
+	}
+	for i := range states {
+		states[i].eventState = uint32(cStates[i].dwEventState)
+	}
+	return nil
+}
+
+// Cancel interrupts any blocking calls on the context, such as
+// GetStatusChange.
+func (c *scContext) Cancel() error {
+	return scCheck(C.SCardCancel(c.ctx))
+}
+
 type scHandle struct {
 	h C.SCARDHANDLE
 }
 
-func (c *scContext) Connect(reader string) (*scHandle, error) {
+func (c *scContext) Connect(reader string, shared bool) (*scHandle, error) {
 	var (
 		handle         C.SCARDHANDLE
 		activeProtocol C.DWORD
 	)
+	shareMode := C.DWORD(C.SCARD_SHARE_EXCLUSIVE)
+	if shared {
+		shareMode = C.SCARD_SHARE_SHARED
+	}
 	rc := C.SCardConnect(c.ctx, C.CString(reader),
-		C.SCARD_SHARE_EXCLUSIVE, C.SCARD_PROTOCOL_T1,
+		shareMode, C.SCARD_PROTOCOL_T1,
 		&handle, &activeProtocol)
 	if err := scCheck(rc); err != nil {
 		return nil, err
@@ -110,43 +147,29 @@ func (h *scHandle) Close() error {
 	return scCheck(C.SCardDisconnect(h.h, C.SCARD_LEAVE_CARD))
 }
 
-type scTx struct {
-	h C.SCARDHANDLE
-}
-
-func (h *scHandle) Begin() (*scTx, error) {
-	if err := scCheck(C.SCardBeginTransaction(h.h)); err != nil {
-		return nil, err
-	}
-	return &scTx{h.h}, nil
+func (h *scHandle) begin() error {
+	return scCheck(C.SCardBeginTransaction(h.h))
 }
 
-func (t *scTx) Close() error {
-	return scCheck(C.SCardEndTransaction(t.h, C.SCARD_LEAVE_CARD))
+func (h *scHandle) end() error {
+	return scCheck(C.SCardEndTransaction(h.h, C.SCARD_LEAVE_CARD))
 }
 
-func (t *scTx) transmit(req []byte) (more bool, b []byte, err error) {
+func (h *scHandle) transmit(req []byte) ([]byte, uint16, error) {
 	var resp [C.MAX_BUFFER_SIZE_EXTENDED]byte
 	reqN := C.DWORD(len(req))
 	respN := C.DWORD(len(resp))
 	rc := C.SCardTransmit(
-		t.h,
+		h.h,
 		C.SCARD_PCI_T1,
 		(*C.BYTE)(&req[0]), reqN, nil,
 		(*C.BYTE)(&resp[0]), &respN)
 	if err := scCheck(rc); err != nil {
-		return false, nil, fmt.Errorf("transmitting request: %w", err)
+		return nil, 0, err
 	}
 	if respN < 2 {
-		return false, nil, fmt.Errorf("scard response too short: %d", respN)
-	}
-	sw1 := resp[respN-2]
-	sw2 := resp[respN-1]
-	if sw1 == 0x90 && sw2 == 0x00 {
-		return false, resp[:respN-2], nil
-	}
-	if sw1 == 0x61 {
-		return true, resp[:respN-2], nil
+		return nil, 0, fmt.Errorf("scard response too short: %d", respN)
 	}
-	return false, nil, &apduErr{sw1, sw2}
+	sw := uint16(resp[respN-2])<<8 | uint16(resp[respN-1])
+	return resp[:respN-2], sw, nil
 }
@@ -17,6 +17,7 @@ package piv
 import (
 	"fmt"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -30,18 +31,26 @@ var (
 	procSCardBeginTransaction = winscard.NewProc("SCardBeginTransaction")
 	procSCardEndTransaction   = winscard.NewProc("SCardEndTransaction")
 	procSCardTransmit         = winscard.NewProc("SCardTransmit")
+	procSCardGetStatusChangeW = winscard.NewProc("SCardGetStatusChangeW")
+	procSCardCancel           = winscard.NewProc("SCardCancel")
 )
 
 const (
 	scardScopeSystem      = 2
 	scardShareExclusive   = 1
+	scardShareShared      = 2
 	scardLeaveCard        = 0
 	scardProtocolT1       = 2
 	scardPCIT1            = 0
 	maxBufferSizeExtended = (4 + 3 + (1 << 16) + 3 + 2)
 	rcSuccess             = 0
+	infinite              = 0xFFFFFFFF
 )
 
+// scSupportsPnP reports whether readers being attached or detached can be
+// detected using the PnP notification reader.
+const scSupportsPnP = true
+
 func scCheck(rc uintptr) error {
 	if rc == rcSuccess {
 		return nil
@@ -122,7 +131,7 @@ func (c *scContext) ListReaders() ([]string, error) {
 	return readers, nil
 }
 
-func (c *scContext) Connect(reader string) (*scHandle, error) {
+func (c *scContext) Connect(reader string, shared bool) (*scHandle, error) {
 	var (
 		handle         syscall.Handle
 		activeProtocol uint16
@@ -131,10 +140,14 @@ func (c *scContext) Connect(reader string) (*scHandle, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid reader string: %v", err)
 	}
+	shareMode := scardShareExclusive
+	if shared {
+		shareMode = scardShareShared
+	}
 	r0, _, _ := procSCardConnectW.Call(
 		uintptr(c.ctx),
 		uintptr(unsafe.Pointer(readerPtr)),
-		scardShareExclusive,
+		uintptr(shareMode),
 		scardProtocolT1,
 		uintptr(unsafe.Pointer(&handle)),
 		uintptr(activeProtocol),
@@ -145,6 +158,57 @@ func (c *scContext) Connect(reader string) (*scHandle, error) {
 	return &scHandle{handle}, nil
 }
 
+// scardReaderState is the SCARD_READERSTATEW struct.
+//
+// https://learn.microsoft.com/en-us/windows/win32/api/winscard/ns-winscard-scard_readerstatew
+type scardReaderState struct {
+	reader       *uint16
+	userData     uintptr
+	currentState uint32
+	eventState   uint32
+	atrLen       uint32
+	atr          [36]byte
+}
+
+// GetStatusChange blocks until the state of one of the readers differs from
+// its current state, or the timeout expires. A negative timeout waits
+// indefinitely.
+func (c *scContext) GetStatusChange(timeout time.Duration, states []scReaderState) error {
+	rs := make([]scardReaderState, len(states))
+	for i, s := range states {
+		readerPtr, err := syscall.UTF16PtrFromString(s.reader)
+		if err != nil {
+			return fmt.Errorf("invalid reader string: %v", err)
+		}
+		rs[i].reader = readerPtr
+		rs[i].currentState = s.currentState
+	}
+	t := uint32(infinite)
+	if timeout >= 0 {
+		t = uint32(timeout / time.Millisecond)
+	}
+	r0, _, _ := procSCardGetStatusChangeW.Call(
+		uintptr(c.ctx),
+		uintptr(t),
+		uintptr(unsafe.Pointer(&rs[0])),
+		uintptr(len(rs)),
+	)
+	if err := scCheck(r0); err != nil {
+		return err
+	}
+	for i := range states {
+		states[i].eventState = rs[i].eventState
+	}
+	return nil
+}
+
+// Cancel interrupts any blocking calls on the context, such as
+// GetStatusChange.
+func (c *scContext) Cancel() error {
+	r0, _, _ := procSCardCancel.Call(uintptr(c.ctx))
+	return scCheck(r0)
+}
+
 type scHandle struct {
 	handle syscall.Handle
 }
@@ -154,29 +218,22 @@ func (h *scHandle) Close() error {
 	return scCheck(r0)
 }
 
-func (h *scHandle) Begin() (*scTx, error) {
+func (h *scHandle) begin() error {
 	r0, _, _ := procSCardBeginTransaction.Call(uintptr(h.handle))
-	if err := scCheck(r0); err != nil {
-		return nil, err
-	}
-	return &scTx{h.handle}, nil
-}
-
-func (t *scTx) Close() error {
-	r0, _, _ := procSCardEndTransaction.Call(uintptr(t.handle), scardLeaveCard)
 	return scCheck(r0)
 }
 
-type scTx struct {
-	handle syscall.Handle
+func (h *scHandle) end() error {
+	r0, _, _ := procSCardEndTransaction.Call(uintptr(h.handle), scardLeaveCard)
+	return scCheck(r0)
 }
 
-func (t *scTx) transmit(req []byte) (more bool, b []byte, err error) {
+func (h *scHandle) transmit(req []byte) ([]byte, uint16, error) {
 	var resp [maxBufferSizeExtended]byte
 	reqN := len(req)
 	respN := len(resp)
 	r0, _, _ := procSCardTransmit.Call(
-		uintptr(t.handle),
+		uintptr(h.handle),
 		uintptr(scardPCIT1),
 		uintptr(unsafe.Pointer(&req[0])),
 		uintptr(reqN),
@@ -186,18 +243,11 @@ func (t *scTx) transmit(req []byte) (more bool, b []byte, err error) {
 	)
 
 	if err := scCheck(r0); err != nil {
-		return false, nil, fmt.Errorf("transmitting request: %w", err)
+		return nil, 0, err
 	}
 	if respN < 2 {
-		return false, nil, fmt.Errorf("scard response too short: %d", respN)
-	}
-	sw1 := resp[respN-2]
-	sw2 := resp[respN-1]
-	if sw1 == 0x90 && sw2 == 0x00 {
-		return false, resp[:respN-2], nil
-	}
-	if sw1 == 0x61 {
-		return true, resp[:respN-2], nil
+		return nil, 0, fmt.Errorf("scard response too short: %d", respN)
 	}
-	return false, nil, &apduErr{sw1, sw2}
+	sw := uint16(resp[respN-2])<<8 | uint16(resp[respN-1])
+	return resp[:respN-2], sw, nil
 }
@@ -16,7 +16,7 @@ package piv
 
 import (
 	"bytes"
-	"crypto/des"
+	"context"
 	"crypto/rand"
 	"encoding/asn1"
 	"encoding/binary"
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"time"
 )
 
 var (
@@ -33,16 +34,27 @@ var (
 	// DefaultPUK for the PIV applet. The PUK is only used to reset the PIN when
 	// the card's PIN retries have been exhausted.
 	DefaultPUK = "12345678"
-	// DefaultManagementKey for the PIV applet. The Management Key is a Triple-DES
-	// key required for slot actions such as generating keys, setting certificates,
-	// and signing.
-	DefaultManagementKey = [24]byte{
-		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
-		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
-		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
-	}
 )
 
+// defaultManagementKey holds the bytes of the default management key.
+var defaultManagementKey = [24]byte{
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+}
+
+// DefaultManagementKey returns the default management key for the PIV applet.
+// The Management Key is required for slot actions such as generating keys,
+// setting certificates, and signing. Each call returns a new copy of the key.
+//
+// The default key is a Triple-DES key, or an AES-192 key on YubiKeys with
+// firmware 5.7.0 and later. Its algorithm is left unset so it can be used with
+// either.
+func DefaultManagementKey() ManagementKey {
+	key := defaultManagementKey
+	return ManagementKey{Key: key[:]}
+}
+
 var (
 	// ErrOCCLocked is returned when on card biometric comparision is locked.
 	ErrOCCLocked = errors.New("occ biometric verification locked")
@@ -58,11 +70,12 @@ var (
 // strings describing the key, such as "Yubico Yubikey NEO OTP+U2F+CCID 00 00".
 //
 // Card names depend on the operating system and what port a card is plugged
-// into. To uniquely identify a card, use its serial number.
+// into. To uniquely identify a card, use its serial number, as reported by
+// Enumerate and accepted by OpenSerial.
 //
 // See: https://ludovicrousseau.blogspot.com/2010/05/what-is-in-pcsc-reader-name.html
 func Cards() ([]string, error) {
-	var c client
+	var c Client
 	return c.Cards()
 }
 
@@ -70,13 +83,23 @@ const (
 	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-78-4.pdf#page=17
 	algTag     = 0x80
 	alg3DES    = 0x03
+	algAES128  = 0x08
+	algAES192  = 0x0a
+	algAES256  = 0x0c
 	algRSA1024 = 0x06
 	algRSA2048 = 0x07
+	algRSA3072 = 0x05
+	algRSA4096 = 0x16
 	algECCP256 = 0x11
 	algECCP384 = 0x14
 	// non-standard; as implemented by SoloKeys. Chosen for low probability of eventual
 	// clashes, if and when PIV standard adds Ed25519 support
 	algEd25519 = 0x22
+	// YubiKey 5.7 and later.
+	//
+	// https://docs.yubico.com/yesdk/users-manual/application-piv/apdu/generate-pair.html
+	algYubicoEd25519 = 0xe0
+	algX25519        = 0xe1
 
 	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-78-4.pdf#page=16
 	keyAuthentication     = 0x9a
@@ -86,6 +109,10 @@ const (
 	keyCardAuthentication = 0x9e
 	keyAttestation        = 0xf9
 
+	// https://developers.yubico.com/PIV/Introduction/Yubico_extensions.html#_get_metadata
+	keyPIN = 0x80
+	keyPUK = 0x81
+
 	insVerify             = 0x20
 	insChangeReference    = 0x24
 	insResetRetry         = 0x2c
@@ -105,7 +132,10 @@ const (
 	insAttest        = 0xf9
 	insGetSerial     = 0xf8
 	insGetMetadata   = 0xf7
+	insMoveKey       = 0xf6
 	insDeviceReset   = 0x1f
+	insGetDeviceInfo = 0x1d
+	insSetDeviceInfo = 0x1c
 
 	paramPINAuth = 0x80
 	paramOCCAuth = 0x96
@@ -113,14 +143,63 @@ const (
 	occIncapableStatus = 0x6a88
 )
 
-// YubiKey is an exclusive open connection to a YubiKey smart card. While open,
-// no other process can query the given card.
+// YubiKey is an open connection to a YubiKey smart card. By default, the
+// connection is exclusive and no other process can query the card while it's
+// open. See OpenShared and Client for connections that allow other processes
+// to use the card.
+//
+// If the card is reset by another application or briefly removed, the YubiKey
+// reconnects to it, checking its serial number, and retries the operation if
+// it's safe to repeat. Since a reset clears the PIN's verification status,
+// operations that relied on an earlier call to VerifyPIN fail with an error
+// wrapping ErrPINRequired until the PIN is verified again.
+//
+// PIV cards from other vendors can also be opened, provided they implement the
+// command set of NIST SP 800-73-4. Methods relying on Yubico's extensions, such
+// as Attest, KeyInfo, SetPrivateKeyInsecure and Reset, return an error wrapping
+// ErrMissingCapability for these cards.
+//
+// A YubiKey is safe for concurrent use by multiple goroutines. Each operation,
+// including any PIN verification it requires, is run to completion before the
+// next begins, so private keys returned by PrivateKey can be shared, such as
+// by a TLS server handling many connections.
 //
 // To release the connection, call the Close method.
 type YubiKey struct {
-	ctx *scContext
-	h   *scHandle
-	tx  *scTx
+	t  Transport
+	tx *scTx
+	// busy is held while an operation is using tx. It's a channel rather than
+	// a mutex so callers can stop waiting when their context is done.
+	busy chan struct{}
+
+	// perOp indicates that a transaction is only held during each
+	// operation, allowing other applications to use the card in between. The
+	// PIV applet is reselected if needed.
+	perOp bool
+	// pin is the PIN last verified through VerifyPIN or set through SetPIN
+	// or Unblock, kept to reestablish the PIN's verification status when
+	// it's been reset by another application. Only used if perOp is set.
+	pin string
+	// timeout, if non-zero, bounds the duration of each operation.
+	timeout time.Duration
+
+	// serial is the card's serial number, used to check that the same card
+	// is present when reconnecting. hasSerial is set if it's known.
+	serial    uint32
+	hasSerial bool
+	// pinReset indicates the card was reset since the PIN was last verified,
+	// and that the reset hasn't been reported through ErrPINRequired yet.
+	pinReset bool
+	// lost holds an error if the connection to the card can't be recovered.
+	lost error
+
+	// mgmtAlg caches the algorithm of the card's management key, used for
+	// management keys without an Algorithm. Zero if it hasn't been read.
+	mgmtAlg ManagementKeyAlgorithm
+
+	// generic indicates the card doesn't implement Yubico's PIV extensions,
+	// detected by it rejecting GET VERSION.
+	generic bool
 
 	rand io.Reader
 
@@ -132,67 +211,267 @@ type YubiKey struct {
 	version *version
 }
 
+// requireYubico returns an error wrapping ErrMissingCapability if the card
+// doesn't implement Yubico's PIV extensions, which the operation requires.
+func (yk *YubiKey) requireYubico(op string) error {
+	if yk.generic {
+		return fmt.Errorf("%s requires yubico piv extensions: %w", op, ErrMissingCapability)
+	}
+	return nil
+}
+
 // Close releases the connection to the smart card.
+//
+// If a cancelled operation is still waiting on the card, Close blocks until it
+// completes.
 func (yk *YubiKey) Close() error {
-	err1 := yk.h.Close()
-	err2 := yk.ctx.Close()
-	if err1 == nil {
-		return err2
-	}
-	return err1
+	yk.busy <- struct{}{}
+	defer func() { <-yk.busy }()
+	return yk.t.Close()
 }
 
 // Open connects to a YubiKey smart card.
 func Open(card string) (*YubiKey, error) {
-	var c client
+	var c Client
+	return c.Open(card)
+}
+
+// OpenShared connects to a YubiKey smart card without preventing other
+// applications, such as gpg-agent or ykman, from using it while it's open.
+//
+// Instead of holding a transaction until the YubiKey is closed, a transaction
+// is begun and ended for each operation. Since other applications may select a
+// different applet or reset the PIN's verification status between operations,
+// the PIV applet is reselected when needed, and the PIN passed to VerifyPIN is
+// kept in memory and verified again before using keys that require it.
+//
+// OpenShared is equivalent to calling Open on a Client with ShareMode set to
+// ShareShared and Transactions set to TransactionPerOperation.
+func OpenShared(card string) (*YubiKey, error) {
+	c := Client{ShareMode: ShareShared, Transactions: TransactionPerOperation}
 	return c.Open(card)
 }
 
-// client is a smart card client and may be exported in the future to allow
-// configuration for the top level Open() and Cards() APIs.
-type client struct {
+// OpenTransport begins a transaction over the provided Transport and selects
+// the PIV applet, returning a YubiKey that exchanges all APDUs through it.
+//
+// On success, the returned YubiKey takes ownership of the transport and closes
+// it when the YubiKey is closed. If an error is returned, the transaction is
+// ended and the caller remains responsible for closing the transport.
+func OpenTransport(t Transport) (*YubiKey, error) {
+	var c Client
+	return c.OpenTransport(t)
+}
+
+// OpenPCSC connects to a smart card using the system's PC/SC implementation,
+// returning a Transport for use with OpenTransport. This allows the connection
+// to be wrapped, such as to record a transcript using NewRecorder.
+//
+// Open is equivalent to calling OpenPCSC followed by OpenTransport.
+func OpenPCSC(card string) (Transport, error) {
+	var c Client
+	return c.OpenPCSC(card)
+}
+
+// ShareMode determines whether other applications can use a card while it's
+// open.
+type ShareMode int
+
+// Share modes supported by Client.
+const (
+	// ShareExclusive prevents other applications from connecting to the card
+	// while it's open.
+	ShareExclusive ShareMode = iota
+	// ShareShared allows other applications to connect to the card while
+	// it's open. They can only use the card while no transaction is held,
+	// see TransactionPerOperation.
+	ShareShared
+)
+
+// TransactionMode determines how long a YubiKey holds a transaction on the
+// card, giving it exclusive use of the card.
+type TransactionMode int
+
+// Transaction modes supported by Client.
+const (
+	// TransactionPerConnection holds a single transaction from when the card
+	// is opened until it's closed.
+	TransactionPerConnection TransactionMode = iota
+	// TransactionPerOperation holds a transaction only for the duration of
+	// each operation. Between operations, other applications may select a
+	// different applet or reset the PIN's verification status, so the PIV
+	// applet is reselected when needed and the PIN passed to VerifyPIN is
+	// kept in memory to be verified again before using keys that require it.
+	TransactionPerOperation
+)
+
+// Client configures how smart cards are listed and opened. The zero value uses
+// the same defaults as the package level functions, such as Open and Cards.
+//
+//	c := piv.Client{
+//		ShareMode:    piv.ShareShared,
+//		Transactions: piv.TransactionPerOperation,
+//		Timeout:      10 * time.Second,
+//		ReaderFilter: func(reader string) bool {
+//			return strings.Contains(strings.ToLower(reader), "yubikey")
+//		},
+//	}
+//	cards, err := c.Cards()
+//	if err != nil {
+//		// ...
+//	}
+//	yk, err := c.Open(cards[0])
+type Client struct {
 	// Rand is a cryptographic source of randomness used for card challenges.
 	//
 	// If nil, defaults to crypto.Rand.
 	Rand io.Reader
+
+	// Tracer, if set, is called for each command exchanged with the card,
+	// including those sent while opening it. See Trace for details.
+	Tracer Tracer
+
+	// ShareMode determines whether other applications can connect to cards
+	// opened by Open. Defaults to ShareExclusive.
+	ShareMode ShareMode
+
+	// Transactions determines how long opened YubiKeys hold a transaction on
+	// the card. Defaults to TransactionPerConnection.
+	Transactions TransactionMode
+
+	// Timeout, if non-zero, bounds the duration of each operation on opened
+	// YubiKeys, including time spent waiting for other operations or for the
+	// user to touch the card. Operations given a context with an earlier
+	// deadline use the context's deadline instead.
+	//
+	// Operations that time out return an error wrapping ErrCanceled and
+	// context.DeadlineExceeded. A command already sent to the card may still
+	// complete in the background, but its result is discarded, and later
+	// operations wait for it before using the card.
+	Timeout time.Duration
+
+	// ReaderFilter, if set, restricts the readers returned by Cards and
+	// reported by Watch to those for which it returns true. Open and OpenPCSC
+	// return an error for readers that don't match.
+	ReaderFilter func(reader string) bool
 }
 
-func (c *client) Cards() ([]string, error) {
+// Cards lists the smart cards available via PC/SC that match the client's
+// ReaderFilter. See the package level Cards function for details.
+func (c *Client) Cards() ([]string, error) {
 	ctx, err := newSCContext()
 	if err != nil {
 		return nil, fmt.Errorf("connecting to pcsc: %w", err)
 	}
 	defer ctx.Close()
-	return ctx.ListReaders()
+	readers, err := ctx.ListReaders()
+	if err != nil {
+		return nil, err
+	}
+	return c.filterReaders(readers), nil
 }
 
-func (c *client) Open(card string) (*YubiKey, error) {
+// filterReaders returns the readers that match the client's ReaderFilter.
+func (c *Client) filterReaders(readers []string) []string {
+	if c.ReaderFilter == nil {
+		return readers
+	}
+	var filtered []string
+	for _, r := range readers {
+		if c.ReaderFilter(r) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+// Open connects to a YubiKey smart card using the client's configuration.
+func (c *Client) Open(card string) (*YubiKey, error) {
+	t, err := c.connect(card, c.ShareMode == ShareShared)
+	if err != nil {
+		return nil, err
+	}
+	yk, err := c.OpenTransport(t)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return yk, nil
+}
+
+// OpenPCSC connects to a smart card using the client's ShareMode, returning a
+// Transport for use with OpenTransport.
+func (c *Client) OpenPCSC(card string) (Transport, error) {
+	t, err := c.connect(card, c.ShareMode == ShareShared)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (c *Client) connect(card string, shared bool) (*pcscTransport, error) {
+	if c.ReaderFilter != nil && !c.ReaderFilter(card) {
+		return nil, fmt.Errorf("reader %q excluded by reader filter", card)
+	}
 	ctx, err := newSCContext()
 	if err != nil {
 		return nil, fmt.Errorf("connecting to smart card daemon: %w", err)
 	}
 
-	h, err := ctx.Connect(card)
+	h, err := ctx.Connect(card, shared)
 	if err != nil {
 		ctx.Close()
 		return nil, fmt.Errorf("connecting to smart card: %w", err)
 	}
-	tx, err := h.Begin()
-	if err != nil {
+	return &pcscTransport{ctx: ctx, h: h, reader: card, shared: shared}, nil
+}
+
+// OpenTransport opens a YubiKey over the provided Transport using the client's
+// configuration. See the package level OpenTransport function for details.
+func (c *Client) OpenTransport(t Transport) (*YubiKey, error) {
+	if err := t.Begin(); err != nil {
 		return nil, fmt.Errorf("beginning smart card transaction: %w", err)
 	}
+	tx := &scTx{t: t, trace: c.Tracer}
 	if err := ykSelectApplication(tx, aidPIV[:]); err != nil {
 		tx.Close()
 		return nil, fmt.Errorf("selecting piv applet: %w", err)
 	}
 
-	yk := &YubiKey{ctx: ctx, h: h, tx: tx}
-	v, err := ykVersion(yk.tx)
+	v, err := ykVersion(tx)
+	var generic bool
 	if err != nil {
-		yk.Close()
-		return nil, fmt.Errorf("getting yubikey version: %w", err)
+		var e *apduErr
+		if !errors.As(err, &e) {
+			tx.Close()
+			return nil, fmt.Errorf("getting yubikey version: %w", err)
+		}
+		// The card responded, but doesn't implement Yubico's extensions.
+		v = &version{}
+		generic = true
+	}
+	yk := &YubiKey{
+		t:       t,
+		tx:      tx,
+		busy:    make(chan struct{}, 1),
+		perOp:   c.Transactions == TransactionPerOperation,
+		timeout: c.Timeout,
+		version: v,
+		generic: generic,
+	}
+	if _, ok := t.(reconnecter); ok && !generic {
+		// Record the serial number to recognize the card if it has to be
+		// reconnected. Not all cards report one, so failures aren't fatal.
+		if serial, err := ykSerial(tx, v); err == nil {
+			yk.serial = serial
+			yk.hasSerial = true
+		}
+	}
+	if yk.perOp {
+		if err := tx.Close(); err != nil {
+			return nil, fmt.Errorf("ending smart card transaction: %w", err)
+		}
 	}
-	yk.version = v
 	if c.Rand != nil {
 		yk.rand = c.Rand
 	} else {
@@ -201,11 +480,50 @@ func (c *client) Open(card string) (*YubiKey, error) {
 	return yk, nil
 }
 
+// run calls f with the YubiKey's transaction. If transactions are held per
+// operation, a transaction is begun for the duration of the call and the PIV
+// applet is reselected if another application switched applets.
+func (yk *YubiKey) run(f func(tx *scTx) error) error {
+	if !yk.perOp {
+		return f(yk.tx)
+	}
+	if err := yk.t.Begin(); err != nil {
+		return fmt.Errorf("beginning smart card transaction: %w", err)
+	}
+	err := ykEnsureSelected(yk.tx, yk.generic)
+	if err == nil {
+		err = f(yk.tx)
+	}
+	if cerr := yk.tx.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("ending smart card transaction: %w", cerr)
+	}
+	return err
+}
+
+// ykEnsureSelected selects the PIV applet if another applet is selected.
+//
+// Selecting the PIV applet resets the PIN's verification status, so first
+// check if it's already selected with a command only the PIV applet accepts,
+// as yubico-piv-tool does. Generic cards don't implement that command, so the
+// PIV applet is always reselected.
+func ykEnsureSelected(tx *scTx, generic bool) error {
+	if !generic {
+		if _, err := ykVersion(tx); err == nil {
+			return nil
+		}
+	}
+	if err := ykSelectApplication(tx, aidPIV[:]); err != nil {
+		return fmt.Errorf("selecting piv applet: %w", err)
+	}
+	return nil
+}
+
 // Version returns the version as reported by the PIV applet. For newer
 // YubiKeys (>=4.0.0) this corresponds to the version of the YubiKey itself.
 //
 // Older YubiKeys return values that aren't directly related to the YubiKey
-// version. For example, 3rd generation YubiKeys report 1.0.X.
+// version. For example, 3rd generation YubiKeys report 1.0.X. Cards that don't
+// implement Yubico's extensions report a zero version.
 func (yk *YubiKey) Version() Version {
 	return Version{
 		Major: int(yk.version.major),
@@ -216,7 +534,19 @@ func (yk *YubiKey) Version() Version {
 
 // Serial returns the YubiKey's serial number.
 func (yk *YubiKey) Serial() (uint32, error) {
-	return ykSerial(yk.tx, yk.version)
+	if err := yk.requireYubico("getting serial number"); err != nil {
+		return 0, err
+	}
+	var serial uint32
+	err := yk.do(context.Background(), func(tx *scTx) error {
+		var err error
+		serial, err = ykSerial(tx, yk.version)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return serial, nil
 }
 
 func encodePIN(pin string) ([]byte, error) {
@@ -249,7 +579,22 @@ func encodePIN(pin string) ([]byte, error) {
 //
 // Use DefaultPIN if the PIN hasn't been set.
 func (yk *YubiKey) VerifyPIN(pin string) error {
-	return ykLogin(yk.tx, pin)
+	return yk.VerifyPINContext(context.Background(), pin)
+}
+
+// VerifyPINContext is like VerifyPIN, but returns an error wrapping ErrCanceled
+// if the context is done before the card responds.
+func (yk *YubiKey) VerifyPINContext(ctx context.Context, pin string) error {
+	return yk.do(ctx, func(tx *scTx) error {
+		if err := ykLogin(tx, pin); err != nil {
+			return err
+		}
+		yk.pinReset = false
+		if yk.perOp {
+			yk.pin = pin
+		}
+		return nil
+	})
 }
 
 func ykLogin(tx *scTx, pin string) error {
@@ -292,8 +637,13 @@ func ykLoginNeeded(tx *scTx) bool {
 // ErrMissingCapability is returned when a smart card does not support biometric
 // comparison.
 func (yk *YubiKey) VerifyOCC() error {
-	_, err := ykOCCLogin(yk.tx, false, "")
-	return err
+	if err := yk.requireYubico("verifying occ"); err != nil {
+		return err
+	}
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		_, err := ykOCCLogin(tx, false, "")
+		return err
+	})
 }
 
 // VerifyOCC attempts to authenticate against the card using on card biometric
@@ -306,7 +656,19 @@ func (yk *YubiKey) VerifyOCC() error {
 // See VerifyOCC for errors returned by this method when on card biometric comparison
 // is locked, not configured, or not supported by a given smart card.
 func (yk *YubiKey) TemporaryPIN() (string, error) {
-	return ykOCCLogin(yk.tx, true, "")
+	if err := yk.requireYubico("generating temporary pin"); err != nil {
+		return "", err
+	}
+	var pin string
+	err := yk.doOnce(context.Background(), func(tx *scTx) error {
+		var err error
+		pin, err = ykOCCLogin(tx, true, "")
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return pin, nil
 }
 
 func ykOCCLogin(tx *scTx, genPIN bool, tempPIN string) (string, error) {
@@ -383,7 +745,16 @@ func ykOCCLoginNeeded(tx *scTx) (bool, error) {
 
 // Retries returns the number of attempts remaining to enter the correct PIN.
 func (yk *YubiKey) Retries() (int, error) {
-	return ykPINRetries(yk.tx)
+	var retries int
+	err := yk.do(context.Background(), func(tx *scTx) error {
+		var err error
+		retries, err = ykPINRetries(tx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return retries, nil
 }
 
 func ykPINRetries(tx *scTx) (int, error) {
@@ -399,10 +770,101 @@ func ykPINRetries(tx *scTx) (int, error) {
 	return 0, fmt.Errorf("invalid response: %w", err)
 }
 
+// CredentialMetadata describes the state of the PIN or PUK.
+type CredentialMetadata struct {
+	// Default indicates the credential is still the factory default value,
+	// DefaultPIN or DefaultPUK.
+	Default bool
+	// TotalRetries is the number of incorrect attempts allowed before the
+	// credential is blocked.
+	TotalRetries int
+	// RemainingRetries is the number of attempts remaining before the
+	// credential is blocked.
+	RemainingRetries int
+}
+
+// PINMetadata returns information about the PIN, such as whether it's still
+// the default value. Unlike Retries, reading the metadata doesn't send a
+// VERIFY command to the card.
+//
+// This method is only supported for YubiKey versions >= 5.3.0, and returns an
+// error wrapping ErrMissingCapability for older cards.
+func (yk *YubiKey) PINMetadata() (*CredentialMetadata, error) {
+	return yk.credentialMetadata("pin", keyPIN)
+}
+
+// PUKMetadata returns information about the PUK, such as whether it's still
+// the default value and how many attempts remain before it's blocked.
+//
+// This method is only supported for YubiKey versions >= 5.3.0, and returns an
+// error wrapping ErrMissingCapability for older cards.
+func (yk *YubiKey) PUKMetadata() (*CredentialMetadata, error) {
+	return yk.credentialMetadata("puk", keyPUK)
+}
+
+func (yk *YubiKey) credentialMetadata(name string, key byte) (*CredentialMetadata, error) {
+	if err := yk.requireYubico("getting " + name + " metadata"); err != nil {
+		return nil, err
+	}
+	if !supportsVersion(yk.Version(), 5, 3, 0) {
+		return nil, fmt.Errorf("%s metadata requires firmware 5.3.0: %w", name, ErrMissingCapability)
+	}
+	var m *CredentialMetadata
+	err := yk.do(context.Background(), func(tx *scTx) error {
+		var err error
+		m, err = ykCredentialMetadata(tx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func ykCredentialMetadata(tx *scTx, key byte) (*CredentialMetadata, error) {
+	cmd := apdu{instruction: insGetMetadata, param2: key}
+	resp, err := tx.Transmit(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+	fields, err := parseMetadata(resp)
+	if err != nil {
+		return nil, fmt.Errorf("parsing metadata: %v", err)
+	}
+	def := fields[0x05]
+	if len(def) != 1 {
+		return nil, errors.New("invalid default value in metadata")
+	}
+	// The first byte is the total number of retries, the second the number
+	// remaining.
+	retries := fields[0x06]
+	if len(retries) != 2 {
+		return nil, errors.New("invalid retries in metadata")
+	}
+	return &CredentialMetadata{
+		Default:          def[0] == 0x01,
+		TotalRetries:     int(retries[0]),
+		RemainingRetries: int(retries[1]),
+	}, nil
+}
+
 // OCCRetries returns the number of attempts remaining to verify a biometric template and if
 // a temporary PIN has been generated for a OCC protected key using the TemporaryPIN method.
 func (yk *YubiKey) OCCRetries() (retries int, tempPIN bool, err error) {
-	return ykOCCRetries(yk.tx)
+	if err := yk.requireYubico("getting occ retries"); err != nil {
+		return 0, false, err
+	}
+	var n int
+	var active bool
+	err = yk.do(context.Background(), func(tx *scTx) error {
+		var err error
+		n, active, err = ykOCCRetries(tx)
+		return err
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return n, active, nil
 }
 
 func ykOCCRetries(tx *scTx) (retries int, tempPIN bool, err error) {
@@ -479,19 +941,35 @@ func ykOCCRetries(tx *scTx) (retries int, tempPIN bool, err error) {
 // Reset resets the YubiKey PIV applet to its factory settings, wiping all slots
 // and resetting the PIN, PUK, and Management Key to their default values. This
 // does NOT affect data on other applets, such as GPG or U2F.
+//
+// If the YubiKey blocks resetting the PIV applet on its own, as YubiKey Bio keys
+// do while biometric templates are configured, the returned error wraps
+// ErrMissingCapability. Use DeviceReset instead. To check, YubiKeys with
+// firmware 5.5.0 or later have their device information read first, which
+// resets the PIN's verification status even if the reset fails.
 func (yk *YubiKey) Reset() error {
-	return ykReset(yk.tx, yk.rand)
+	if err := yk.requireYubico("reset"); err != nil {
+		return err
+	}
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		// YubiKey Bio keys block resetting the PIV applet on its own while
+		// biometric templates are configured. Cards that don't report device
+		// information don't block resets.
+		if mayBeBio(yk.Version()) {
+			if info, err := ykDeviceInfo(tx); err == nil && info.ResetBlocked&ApplicationPIV != 0 {
+				return fmt.Errorf("PIV applet reset blocked, use DeviceReset instead: %w", ErrMissingCapability)
+			}
+		}
+		if err := ykReset(tx, yk.rand); err != nil {
+			return err
+		}
+		yk.pin = ""
+		yk.mgmtAlg = 0
+		return nil
+	})
 }
 
 func ykReset(tx *scTx, r io.Reader) error {
-	// TODO(joelferrier): replace this basic check with a getDeviceInfo lookup to determine
-	// if PIV reset is blocked.
-	//
-	// PIV reset is not supported when a OCC biometric template is configured.
-	if _, _, err := ykOCCRetries(tx); err == nil || err == ErrOCCLocked {
-		return fmt.Errorf("PIV applet reset not possible when OCC biometric templates are configured: %w", ErrMissingCapability)
-	}
-
 	// Reset only works if both the PIN and PUK are blocked. Before resetting,
 	// try the wrong PIN and PUK multiple times to block them.
 
@@ -549,7 +1027,17 @@ func ykReset(tx *scTx, r io.Reader) error {
 // to its factory settings, wiping all keys, resetting PINs, and clearing OCC
 // biometric templates.
 func (yk *YubiKey) DeviceReset() error {
-	return ykDeviceReset(yk.tx)
+	if err := yk.requireYubico("device reset"); err != nil {
+		return err
+	}
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		if err := ykDeviceReset(tx); err != nil {
+			return err
+		}
+		yk.pin = ""
+		yk.mgmtAlg = 0
+		return nil
+	})
 }
 
 func ykDeviceReset(tx *scTx) error {
@@ -574,8 +1062,10 @@ type version struct {
 // certificates to slots.
 //
 // Use DefaultManagementKey if the management key hasn't been set.
-func (yk *YubiKey) authManagementKey(key [24]byte) error {
-	return ykAuthenticate(yk.tx, key, yk.rand)
+func (yk *YubiKey) authManagementKey(key ManagementKey) error {
+	return yk.do(context.Background(), func(tx *scTx) error {
+		return yk.authenticate(tx, key)
+	})
 }
 
 var (
@@ -590,14 +1080,20 @@ var (
 	aidYubiKey    = [...]byte{0xa0, 0x00, 0x00, 0x05, 0x27, 0x20, 0x01, 0x01}
 )
 
-func ykAuthenticate(tx *scTx, key [24]byte, rand io.Reader) error {
+func ykAuthenticate(tx *scTx, key ManagementKey, rand io.Reader) error {
 	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=92
 	// https://tsapps.nist.gov/publication/get_pdf.cfm?pub_id=918402#page=114
+	block, err := key.Algorithm.newCipher(key.Key)
+	if err != nil {
+		return err
+	}
+	alg := managementKeyAlgorithmMap[key.Algorithm]
+	n := block.BlockSize()
 
 	// request a witness
 	cmd := apdu{
 		instruction: insAuthenticate,
-		param1:      alg3DES,
+		param1:      alg,
 		param2:      keyCardManagement,
 		data: []byte{
 			0x7c, // Dynamic Authentication Template tag
@@ -610,50 +1106,45 @@ func ykAuthenticate(tx *scTx, key [24]byte, rand io.Reader) error {
 	if err != nil {
 		return fmt.Errorf("get auth challenge: %w", err)
 	}
-	if n := len(resp); n < 12 {
-		return fmt.Errorf("challenge didn't return enough bytes: %d", n)
+	if len(resp) < 4+n {
+		return fmt.Errorf("challenge didn't return enough bytes: %d", len(resp))
 	}
 	if !bytes.Equal(resp[:4], []byte{
 		0x7c,
-		0x0a,
-		0x80, // 'Witness'
-		0x08, // Tag length
+		byte(2 + n),
+		0x80,    // 'Witness'
+		byte(n), // Tag length
 	}) {
 		return fmt.Errorf("invalid authentication object header: %x", resp[:4])
 	}
 
-	cardChallenge := resp[4 : 4+8]
-	cardResponse := make([]byte, 8)
-
-	block, err := des.NewTripleDESCipher(key[:])
-	if err != nil {
-		return fmt.Errorf("creating triple des block cipher: %v", err)
-	}
+	cardChallenge := resp[4 : 4+n]
+	cardResponse := make([]byte, n)
 	block.Decrypt(cardResponse, cardChallenge)
 
-	challenge := make([]byte, 8)
+	challenge := make([]byte, n)
 	if _, err := io.ReadFull(rand, challenge); err != nil {
 		return fmt.Errorf("reading rand data: %v", err)
 	}
-	response := make([]byte, 8)
+	response := make([]byte, n)
 	block.Encrypt(response, challenge)
 
 	data := []byte{
-		0x7c, // Dynamic Authentication Template tag
-		20,   // 2+8+2+8
-		0x80, // 'Witness'
-		0x08, // Tag length
+		0x7c,          // Dynamic Authentication Template tag
+		byte(4 + 2*n), // 2+n+2+n
+		0x80,          // 'Witness'
+		byte(n),       // Tag length
 	}
 	data = append(data, cardResponse...)
 	data = append(data,
-		0x81, // 'Challenge'
-		0x08, // Tag length
+		0x81,    // 'Challenge'
+		byte(n), // Tag length
 	)
 	data = append(data, challenge...)
 
 	cmd = apdu{
 		instruction: insAuthenticate,
-		param1:      alg3DES,
+		param1:      alg,
 		param2:      keyCardManagement,
 		data:        data,
 	}
@@ -661,55 +1152,89 @@ func ykAuthenticate(tx *scTx, key [24]byte, rand io.Reader) error {
 	if err != nil {
 		return fmt.Errorf("auth challenge: %w", err)
 	}
-	if n := len(resp); n < 12 {
-		return fmt.Errorf("challenge response didn't return enough bytes: %d", n)
+	if len(resp) < 4+n {
+		return fmt.Errorf("challenge response didn't return enough bytes: %d", len(resp))
 	}
 	if !bytes.Equal(resp[:4], []byte{
 		0x7c,
-		0x0a,
+		byte(2 + n),
 		0x82, // 'Response'
-		0x08,
+		byte(n),
 	}) {
 		return fmt.Errorf("response invalid authentication object header: %x", resp[:4])
 	}
-	if !bytes.Equal(resp[4:4+8], response) {
+	if !bytes.Equal(resp[4:4+n], response) {
 		return fmt.Errorf("challenge failed")
 	}
 
 	return nil
 }
 
-// SetManagementKey updates the management key to a new key. Management keys
-// are triple-des keys, however padding isn't verified. To generate a new key,
-// generate 24 random bytes.
+// SetManagementKey updates the management key to a new key. To generate a new
+// key, generate random bytes of the algorithm's key size. AES keys require a
+// YubiKey with firmware 5.4.0 or later.
 //
-//	var newKey [24]byte
-//	if _, err := io.ReadFull(rand.Reader, newKey[:]); err != nil {
+//	newKey := piv.ManagementKey{
+//		Algorithm: piv.ManagementKeyAES256,
+//		Key:       make([]byte, 32),
+//	}
+//	if _, err := io.ReadFull(rand.Reader, newKey.Key); err != nil {
 //		// ...
 //	}
-//	if err := yk.SetManagementKey(piv.DefaultManagementKey, newKey); err != nil {
+//	if err := yk.SetManagementKey(piv.DefaultManagementKey(), newKey); err != nil {
 //		// ...
 //	}
-func (yk *YubiKey) SetManagementKey(oldKey, newKey [24]byte) error {
-	if err := ykAuthenticate(yk.tx, oldKey, yk.rand); err != nil {
-		return fmt.Errorf("authenticating with old key: %w", err)
-	}
-	if err := ykSetManagementKey(yk.tx, newKey, false); err != nil {
+//
+// If the new key's Algorithm is zero, the new key uses the same algorithm as
+// the current key.
+func (yk *YubiKey) SetManagementKey(oldKey, newKey ManagementKey) error {
+	return yk.setManagementKey(oldKey, newKey, false)
+}
+
+// SetManagementKeyTouch is like SetManagementKey, but the new key requires
+// touching the card each time it's used to authenticate.
+func (yk *YubiKey) SetManagementKeyTouch(oldKey, newKey ManagementKey) error {
+	return yk.setManagementKey(oldKey, newKey, true)
+}
+
+func (yk *YubiKey) setManagementKey(oldKey, newKey ManagementKey, touch bool) error {
+	if err := yk.requireYubico("setting management key"); err != nil {
 		return err
 	}
-	return nil
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		a, err := yk.managementKeyAlgorithm(tx, newKey)
+		if err != nil {
+			return err
+		}
+		newKey.Algorithm = a
+		if err := yk.authenticate(tx, oldKey); err != nil {
+			return fmt.Errorf("authenticating with old key: %w", err)
+		}
+		if err := ykSetManagementKey(tx, newKey, touch); err != nil {
+			return err
+		}
+		yk.mgmtAlg = newKey.Algorithm
+		return nil
+	})
 }
 
 // ykSetManagementKey updates the management key to a new key. This requires
 // authenticating with the existing management key.
-func ykSetManagementKey(tx *scTx, key [24]byte, touch bool) error {
+func ykSetManagementKey(tx *scTx, key ManagementKey, touch bool) error {
+	alg, ok := managementKeyAlgorithmMap[key.Algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported management key algorithm")
+	}
+	if len(key.Key) != key.Algorithm.keySize() {
+		return fmt.Errorf("invalid management key length: %d", len(key.Key))
+	}
 	cmd := apdu{
 		instruction: insSetMGMKey,
 		param1:      0xff,
 		param2:      0xff,
 		data: append([]byte{
-			alg3DES, keyCardManagement, 24,
-		}, key[:]...),
+			alg, keyCardManagement, byte(len(key.Key)),
+		}, key.Key...),
 	}
 	if touch {
 		cmd.param2 = 0xfe
@@ -736,7 +1261,15 @@ func ykSetManagementKey(tx *scTx, key [24]byte, touch bool) error {
 //		// ...
 //	}
 func (yk *YubiKey) SetPIN(oldPIN, newPIN string) error {
-	return ykChangePIN(yk.tx, oldPIN, newPIN)
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		if err := ykChangePIN(tx, oldPIN, newPIN); err != nil {
+			return err
+		}
+		if yk.perOp {
+			yk.pin = newPIN
+		}
+		return nil
+	})
 }
 
 func ykChangePIN(tx *scTx, oldPIN, newPIN string) error {
@@ -758,12 +1291,27 @@ func ykChangePIN(tx *scTx, oldPIN, newPIN string) error {
 }
 
 // Unblock unblocks the PIN, setting it to a new value.
+//
+// YubiKey Bio keys don't have a PUK, and return an error wrapping
+// ErrMissingCapability. To check, YubiKeys with firmware 5.5.0 or later have
+// their device information read first, which resets the PIN's verification
+// status.
 func (yk *YubiKey) Unblock(puk, newPIN string) error {
-	// PUK based pin onblock is not supported on OCC enabled Yubikeys.
-	if _, _, err := ykOCCRetries(yk.tx); err == nil || errors.Is(err, ErrOCCLocked) || errors.Is(err, ErrOCCTemplateNotFound) {
-		return fmt.Errorf("PUK pin unblock not supported: %w", ErrMissingCapability)
-	}
-	return ykUnblockPIN(yk.tx, puk, newPIN)
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		// YubiKey Bio keys don't have a PUK.
+		if mayBeBio(yk.Version()) {
+			if info, err := ykDeviceInfo(tx); err == nil && isBio(info.Formfactor) {
+				return fmt.Errorf("PUK pin unblock not supported: %w", ErrMissingCapability)
+			}
+		}
+		if err := ykUnblockPIN(tx, puk, newPIN); err != nil {
+			return err
+		}
+		if yk.perOp {
+			yk.pin = newPIN
+		}
+		return nil
+	})
 }
 
 func ykUnblockPIN(tx *scTx, puk, newPIN string) error {
@@ -800,7 +1348,9 @@ func ykUnblockPIN(tx *scTx, puk, newPIN string) error {
 //		// ...
 //	}
 func (yk *YubiKey) SetPUK(oldPUK, newPUK string) error {
-	return ykChangePUK(yk.tx, oldPUK, newPUK)
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		return ykChangePUK(tx, oldPUK, newPUK)
+	})
 }
 
 func ykChangePUK(tx *scTx, oldPUK, newPUK string) error {
@@ -821,6 +1371,130 @@ func ykChangePUK(tx *scTx, oldPUK, newPUK string) error {
 	return err
 }
 
+// RetryLimits configures the number of incorrect attempts allowed for the PIN
+// and PUK, and optionally the values they're set to afterwards.
+type RetryLimits struct {
+	// PINRetries and PUKRetries are the number of incorrect attempts allowed
+	// before the PIN or PUK is blocked. Each must be between 1 and 255.
+	PINRetries int
+	PUKRetries int
+
+	// NewPIN and NewPUK, if set, replace DefaultPIN and DefaultPUK once the
+	// limits have been configured. If empty, the credential is left set to
+	// its default value.
+	NewPIN string
+	NewPUK string
+}
+
+// SetRetries configures the number of attempts allowed to enter the PIN and
+// PUK. This requires the management key and the current PIN.
+//
+// Changing the limits resets both the PIN and the PUK to their default values,
+// DefaultPIN and DefaultPUK. To avoid leaving the card with default
+// credentials, set NewPIN and NewPUK, which are applied in the same
+// transaction. If they can't be applied after the limits were changed, the
+// returned error wraps ErrDefaultCredentials:
+//
+//	limits := piv.RetryLimits{
+//		PINRetries: 5,
+//		PUKRetries: 3,
+//		NewPIN:     newPIN,
+//		NewPUK:     newPUK,
+//	}
+//	if err := yk.SetRetries(key, pin, limits); err != nil {
+//		// ...
+//	}
+func (yk *YubiKey) SetRetries(key ManagementKey, pin string, l RetryLimits) error {
+	if err := yk.requireYubico("setting retries"); err != nil {
+		return err
+	}
+	if l.PINRetries < 1 || l.PINRetries > 255 {
+		return fmt.Errorf("invalid number of pin retries: %d", l.PINRetries)
+	}
+	if l.PUKRetries < 1 || l.PUKRetries > 255 {
+		return fmt.Errorf("invalid number of puk retries: %d", l.PUKRetries)
+	}
+	// Validate the new values before the card resets the existing ones.
+	if l.NewPIN != "" {
+		if _, err := encodePIN(l.NewPIN); err != nil {
+			return fmt.Errorf("encoding new pin: %v", err)
+		}
+	}
+	if l.NewPUK != "" {
+		if _, err := encodePIN(l.NewPUK); err != nil {
+			return fmt.Errorf("encoding new puk: %v", err)
+		}
+	}
+	return yk.doOnce(context.Background(), func(tx *scTx) error {
+		if err := yk.authenticate(tx, key); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		if err := ykLogin(tx, pin); err != nil {
+			return fmt.Errorf("authenticating with pin: %w", err)
+		}
+		if err := ykSetRetries(tx, l.PINRetries, l.PUKRetries); err != nil {
+			return err
+		}
+		// The PIN was reset, and its verification status with it.
+		yk.pin = ""
+		if l.NewPUK != "" {
+			if err := ykChangePUK(tx, DefaultPUK, l.NewPUK); err != nil {
+				return &defaultCredentialsErr{fmt.Errorf("setting puk: %w", err)}
+			}
+		}
+		if l.NewPIN != "" {
+			if err := ykChangePIN(tx, DefaultPIN, l.NewPIN); err != nil {
+				return &defaultCredentialsErr{fmt.Errorf("setting pin: %w", err)}
+			}
+			if yk.perOp {
+				yk.pin = l.NewPIN
+			}
+		}
+		return nil
+	})
+}
+
+// ErrDefaultCredentials is returned by SetRetries when the retry limits were
+// applied, but setting NewPIN or NewPUK failed afterwards. If setting NewPUK
+// failed, the PIN and PUK are DefaultPIN and DefaultPUK. If setting NewPIN
+// failed, the PIN is DefaultPIN and the PUK is NewPUK, if set.
+var ErrDefaultCredentials = errors.New("retry limits set, but credentials left at default values")
+
+// defaultCredentialsErr is returned by SetRetries when the card reset the PIN
+// and PUK, but they couldn't be changed from their default values.
+type defaultCredentialsErr struct {
+	err error
+}
+
+func (e *defaultCredentialsErr) Error() string {
+	return ErrDefaultCredentials.Error() + ": " + e.err.Error()
+}
+
+func (e *defaultCredentialsErr) Unwrap() error {
+	return e.err
+}
+
+func (e *defaultCredentialsErr) Is(target error) bool {
+	return target == ErrDefaultCredentials
+}
+
+// ykSetRetries sets the PIN and PUK retry limits, resetting both to their
+// default values. This requires authenticating with the management key and
+// verifying the PIN.
+//
+// https://developers.yubico.com/PIV/Introduction/Yubico_extensions.html
+func ykSetRetries(tx *scTx, pinRetries, pukRetries int) error {
+	cmd := apdu{
+		instruction: insSetPINRetries,
+		param1:      byte(pinRetries),
+		param2:      byte(pukRetries),
+	}
+	if _, err := tx.Transmit(cmd); err != nil {
+		return fmt.Errorf("command failed: %w", err)
+	}
+	return nil
+}
+
 func ykSelectApplication(tx *scTx, id []byte) error {
 	cmd := apdu{
 		instruction: insSelectApplication,
@@ -871,7 +1545,12 @@ func ykSerial(tx *scTx, v *version) (uint32, error) {
 // Metadata returns protected data stored on the card. This can be used to
 // retrieve PIN protected management keys.
 func (yk *YubiKey) Metadata(pin string) (*Metadata, error) {
-	m, err := ykGetProtectedMetadata(yk.tx, pin)
+	var m *Metadata
+	err := yk.do(context.Background(), func(tx *scTx) error {
+		var err error
+		m, err = ykGetProtectedMetadata(tx, pin)
+		return err
+	})
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			return &Metadata{}, nil
@@ -884,8 +1563,26 @@ func (yk *YubiKey) Metadata(pin string) (*Metadata, error) {
 // SetMetadata sets PIN protected metadata on the key. This is primarily to
 // store the management key on the smart card instead of managing the PIN and
 // management key seperately.
-func (yk *YubiKey) SetMetadata(key [24]byte, m *Metadata) error {
-	return ykSetProtectedMetadata(yk.tx, key, m)
+func (yk *YubiKey) SetMetadata(key ManagementKey, m *Metadata) error {
+	return yk.do(context.Background(), func(tx *scTx) error {
+		md := m
+		if m.ManagementKey != nil && m.ManagementKey.Algorithm == 0 {
+			// Store the algorithm of the card's current management key.
+			a, err := yk.managementKeyAlgorithm(tx, *m.ManagementKey)
+			if err != nil {
+				return err
+			}
+			k := *m.ManagementKey
+			k.Algorithm = a
+			md = &Metadata{ManagementKey: &k, raw: m.raw}
+		}
+		// NOTE: for some reason this action requires the management key
+		// authenticated on the same transaction. It doesn't work otherwise.
+		if err := yk.authenticate(tx, key); err != nil {
+			return fmt.Errorf("authenticating with key: %w", err)
+		}
+		return ykSetProtectedMetadata(tx, md)
+	})
 }
 
 // Metadata holds protected metadata. This is primarily used by YubiKey manager
@@ -893,7 +1590,14 @@ func (yk *YubiKey) SetMetadata(key [24]byte, m *Metadata) error {
 // guarded by the PIN.
 type Metadata struct {
 	// ManagementKey is the management key stored directly on the YubiKey.
-	ManagementKey *[24]byte
+	//
+	// The key's Algorithm is stored alongside it. SetMetadata stores the
+	// algorithm of the card's current management key for keys without one.
+	// Keys stored by other applications may lack the algorithm. When read,
+	// the Algorithm of such AES-128 and AES-256 keys is set based on their
+	// length, while 24 byte keys leave it unset, since they may be
+	// Triple-DES or AES-192 keys.
+	ManagementKey *ManagementKey
 
 	// raw, if not nil, is the full bytes
 	raw []byte
@@ -904,12 +1608,7 @@ func (m *Metadata) marshal() ([]byte, error) {
 		if m.ManagementKey == nil {
 			return []byte{0x88, 0x00}, nil
 		}
-		return append([]byte{
-			0x88,
-			26,
-			0x89,
-			24,
-		}, m.ManagementKey[:]...), nil
+		return marshalASN1(0x88, m.ManagementKey.marshalMetadata()), nil
 	}
 
 	if m.ManagementKey == nil {
@@ -938,16 +1637,25 @@ func (m *Metadata) marshal() ([]byte, error) {
 			return nil, fmt.Errorf("unmarshal metadata field: %v", err)
 		}
 
-		if bytes.HasPrefix(v.FullBytes, []byte{0x89}) {
+		if bytes.HasPrefix(v.FullBytes, []byte{0x89}) || bytes.HasPrefix(v.FullBytes, []byte{0x8a}) {
 			continue
 		}
 		metadata.Bytes = append(metadata.Bytes, v.FullBytes...)
 	}
-	metadata.Bytes = append(metadata.Bytes, 0x89, 24)
-	metadata.Bytes = append(metadata.Bytes, m.ManagementKey[:]...)
+	metadata.Bytes = append(metadata.Bytes, m.ManagementKey.marshalMetadata()...)
 	return asn1.Marshal(metadata)
 }
 
+// marshalMetadata encodes the management key as protected metadata fields: the
+// key itself, followed by its algorithm if set.
+func (k *ManagementKey) marshalMetadata() []byte {
+	b := marshalASN1(0x89, k.Key)
+	if alg, ok := managementKeyAlgorithmMap[k.Algorithm]; ok {
+		b = append(b, marshalASN1(0x8a, []byte{alg})...)
+	}
+	return b
+}
+
 func (m *Metadata) unmarshal(b []byte) error {
 	m.raw = b
 	var md asn1.RawValue
@@ -958,6 +1666,10 @@ func (m *Metadata) unmarshal(b []byte) error {
 		return fmt.Errorf("expected tag: 0x88")
 	}
 	d := md.Bytes
+	var (
+		key []byte
+		alg []byte
+	)
 	for len(d) > 0 {
 		var (
 			err error
@@ -967,17 +1679,43 @@ func (m *Metadata) unmarshal(b []byte) error {
 		if err != nil {
 			return fmt.Errorf("unmarshal metadata field: %v", err)
 		}
-		if !bytes.HasPrefix(v.FullBytes, []byte{0x89}) {
-			continue
+		switch {
+		case bytes.HasPrefix(v.FullBytes, []byte{0x89}):
+			// 0x89 indicates key
+			key = v.Bytes
+		case bytes.HasPrefix(v.FullBytes, []byte{0x8a}):
+			// 0x8a indicates the key's algorithm
+			alg = v.Bytes
+		}
+	}
+	if key == nil {
+		return nil
+	}
+	k := &ManagementKey{Key: append([]byte{}, key...)}
+	if alg != nil {
+		var ok bool
+		if len(alg) != 1 {
+			return fmt.Errorf("invalid management key algorithm")
 		}
-		// 0x89 indicates key
-		if len(v.Bytes) != 24 {
-			return fmt.Errorf("invalid management key length: %d", len(v.Bytes))
+		if k.Algorithm, ok = managementKeyAlgorithmMapInv[alg[0]]; !ok {
+			return fmt.Errorf("unknown management key algorithm: 0x%x", alg[0])
 		}
-		var key [24]byte
-		copy(key[:], v.Bytes)
-		m.ManagementKey = &key
+		if len(key) != k.Algorithm.keySize() {
+			return fmt.Errorf("invalid management key length: %d", len(key))
+		}
+		m.ManagementKey = k
+		return nil
+	}
+	switch len(key) {
+	case 16:
+		k.Algorithm = ManagementKeyAES128
+	case 24:
+	case 32:
+		k.Algorithm = ManagementKeyAES256
+	default:
+		return fmt.Errorf("invalid management key length: %d", len(key))
 	}
+	m.ManagementKey = k
 	return nil
 }
 
@@ -1014,7 +1752,7 @@ func ykGetProtectedMetadata(tx *scTx, pin string) (*Metadata, error) {
 	return &m, nil
 }
 
-func ykSetProtectedMetadata(tx *scTx, key [24]byte, m *Metadata) error {
+func ykSetProtectedMetadata(tx *scTx, m *Metadata) error {
 	data, err := m.marshal()
 	if err != nil {
 		return fmt.Errorf("encoding metadata: %v", err)
@@ -1032,11 +1770,6 @@ func ykSetProtectedMetadata(tx *scTx, key [24]byte, m *Metadata) error {
 		param2:      0xff,
 		data:        data,
 	}
-	// NOTE: for some reason this action requires the management key authenticated
-	// on the same transaction. It doesn't work otherwise.
-	if err := ykAuthenticate(tx, key, rand.Reader); err != nil {
-		return fmt.Errorf("authenticating with key: %w", err)
-	}
 	if _, err := tx.Transmit(cmd); err != nil {
 		return fmt.Errorf("command failed: %w", err)
 	}
@@ -16,14 +16,22 @@ package piv
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"flag"
 	"io"
 	"math/bits"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
 )
 
 // canModifyYubiKey indicates whether the test running has constented to
@@ -56,6 +64,15 @@ func testRequiresVersion(t *testing.T, yk *YubiKey, major, minor, patch int) {
 	}
 }
 
+// testRequiresVersionBefore skips the test unless the YubiKey's firmware is
+// older than the given version, for tests of older YubiKeys.
+func testRequiresVersionBefore(t *testing.T, yk *YubiKey, major, minor, patch int) {
+	v := yk.Version()
+	if supportsVersion(v, major, minor, patch) {
+		t.Skipf("test requires yubikey older than %d.%d.%d: got %d.%d.%d", major, minor, patch, v.Major, v.Minor, v.Patch)
+	}
+}
+
 func TestGetVersion(t *testing.T) { runHandleTest(t, testGetVersion) }
 
 func TestCards(t *testing.T) {
@@ -64,7 +81,14 @@ func TestCards(t *testing.T) {
 	}
 }
 
-func newTestYubiKey(t *testing.T) (*YubiKey, func()) {
+// newTestTransport returns a transport for a card to run tests against. By
+// default this is a card simulated with the given configuration, unless the
+// --wipe-yubikey flag is provided, in which case the first YubiKey connected to
+// the system is used.
+func newTestTransport(t *testing.T, config pivtest.Config) Transport {
+	if !canModifyYubiKey {
+		return pivtest.New(config)
+	}
 	cards, err := Cards()
 	if err != nil {
 		t.Fatalf("listing cards: %v", err)
@@ -73,21 +97,69 @@ func newTestYubiKey(t *testing.T) (*YubiKey, func()) {
 		if !strings.Contains(strings.ToLower(card), "yubikey") {
 			continue
 		}
-		if !canModifyYubiKey {
-			t.Skip("not running test that accesses yubikey, provide --wipe-yubikey flag")
-		}
-		yk, err := Open(card)
+		tr, err := OpenPCSC(card)
 		if err != nil {
-			t.Fatalf("getting new yubikey: %v", err)
-		}
-		return yk, func() {
-			if err := yk.Close(); err != nil {
-				t.Errorf("closing yubikey: %v", err)
-			}
+			t.Fatalf("connecting to yubikey: %v", err)
 		}
+		return tr
 	}
 	t.Skip("no yubikeys detected, skipping")
-	return nil, nil
+	return nil
+}
+
+func newTestYubiKey(t *testing.T) (*YubiKey, func()) {
+	tr := newTestTransport(t, pivtest.Config{})
+	yk, err := OpenTransport(tr)
+	if err != nil {
+		tr.Close()
+		t.Fatalf("getting new yubikey: %v", err)
+	}
+	return yk, func() {
+		if err := yk.Close(); err != nil {
+			t.Errorf("closing yubikey: %v", err)
+		}
+	}
+}
+
+// newTestYubiKeyConfig is like newTestYubiKey, but simulated cards are created
+// with the given configuration, and the YubiKey is closed when the test
+// completes. Physical YubiKeys are skipped if their firmware is older than the
+// configured version, and have their PIV applet reset when the test completes.
+func newTestYubiKeyConfig(t *testing.T, config pivtest.Config) *YubiKey {
+	t.Helper()
+	tr := newTestTransport(t, config)
+	yk, err := OpenTransport(tr)
+	if err != nil {
+		tr.Close()
+		t.Fatalf("getting new yubikey: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := yk.Close(); err != nil {
+			t.Errorf("closing yubikey: %v", err)
+		}
+	})
+	if !canModifyYubiKey {
+		return yk
+	}
+	if v := config.Version; v != [3]byte{} {
+		testRequiresVersion(t, yk, int(v[0]), int(v[1]), int(v[2]))
+	}
+	t.Cleanup(func() {
+		if err := yk.Reset(); err != nil {
+			t.Errorf("resetting yubikey: %v", err)
+		}
+	})
+	return yk
+}
+
+// testVerify verifies an attestation produced by a test YubiKey. Simulated
+// cards sign attestations with their own certificate authority.
+func testVerify(yk *YubiKey, attestationCert, slotCert *x509.Certificate) (*Attestation, error) {
+	var v Verifier
+	if card, ok := yk.t.(*pivtest.Card); ok {
+		v.Roots = card.Roots()
+	}
+	return v.Verify(attestationCert, slotCert)
 }
 
 func TestNewYubiKey(t *testing.T) {
@@ -133,6 +205,195 @@ func TestMultipleConnections(t *testing.T) {
 	t.Skip("no yubikeys detected, skipping")
 }
 
+func TestOpenTransport(t *testing.T) {
+	selectPIV := append([]byte{0x00, 0xa4, 0x04, 0x00, byte(len(aidPIV))}, aidPIV[:]...)
+	st := &scriptedTransport{
+		t: t,
+		exchanges: []scriptedExchange{
+			{req: selectPIV, sw: 0x9000},
+			{req: []byte{0x00, 0xfd, 0x00, 0x00, 0x00}, resp: []byte{0x05, 0x04, 0x03}, sw: 0x9000},
+			{req: []byte{0x00, 0xf8, 0x00, 0x00, 0x00}, resp: []byte{0x00, 0xbc, 0x61, 0x4e}, sw: 0x9000},
+		},
+	}
+	yk, err := OpenTransport(st)
+	if err != nil {
+		t.Fatalf("open transport: %v", err)
+	}
+	if got, want := yk.Version(), (Version{5, 4, 3}); got != want {
+		t.Errorf("version got=%v, want=%v", got, want)
+	}
+	serial, err := yk.Serial()
+	if err != nil {
+		t.Fatalf("getting serial: %v", err)
+	}
+	if serial != 12345678 {
+		t.Errorf("serial got=%d, want=%d", serial, 12345678)
+	}
+	if err := yk.Close(); err != nil {
+		t.Fatalf("closing yubikey: %v", err)
+	}
+	if !st.closed {
+		t.Errorf("closing yubikey didn't close transport")
+	}
+}
+
+func TestOpenTransportError(t *testing.T) {
+	selectPIV := append([]byte{0x00, 0xa4, 0x04, 0x00, byte(len(aidPIV))}, aidPIV[:]...)
+	st := &scriptedTransport{
+		t: t,
+		exchanges: []scriptedExchange{
+			{req: selectPIV, sw: 0x6a82},
+		},
+	}
+	if _, err := OpenTransport(st); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("open transport returned %v, want ErrNotFound", err)
+	}
+	if st.inTx {
+		t.Errorf("transaction wasn't ended after failing to open")
+	}
+	if st.closed {
+		t.Errorf("transport was closed after failing to open")
+	}
+}
+
+func TestOpenTransportShared(t *testing.T) {
+	card := pivtest.New(pivtest.Config{})
+	c := Client{ShareMode: ShareShared, Transactions: TransactionPerOperation}
+	yk, err := c.OpenTransport(card)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	// other simulates another application using the card between operations.
+	other := func(aid []byte) {
+		t.Helper()
+		if err := card.Begin(); err != nil {
+			t.Fatalf("beginning transaction from another application: %v", err)
+		}
+		defer card.End()
+		req := append([]byte{0x00, 0xa4, 0x04, 0x00, byte(len(aid))}, aid...)
+		if _, sw, err := card.Transmit(req); err != nil || sw != 0x9000 {
+			t.Fatalf("selecting applet from another application: sw=0x%04x, err=%v", sw, err)
+		}
+	}
+
+	other(aidYubiKey[:])
+	if _, err := yk.Serial(); err != nil {
+		t.Fatalf("getting serial after another applet was selected: %v", err)
+	}
+
+	key := Key{
+		Algorithm:   AlgorithmEC256,
+		PINPolicy:   PINPolicyOnce,
+		TouchPolicy: TouchPolicyNever,
+	}
+	pub, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	if err := yk.VerifyPIN(DefaultPIN); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+	priv, err := yk.PrivateKey(SlotAuthentication, pub, KeyAuth{})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+
+	// Reselecting the PIV applet resets the PIN's verification status, which
+	// must be reestablished before signing.
+	other(aidPIV[:])
+	digest := sha256.Sum256([]byte("hello"))
+	sig, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("signing after pin status was reset: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+		t.Errorf("signature didn't verify")
+	}
+}
+
+func TestOpenTransportSharedChangePIN(t *testing.T) {
+	newPIN := "654321"
+	tests := []struct {
+		name   string
+		change func(yk *YubiKey) error
+	}{
+		{"SetPIN", func(yk *YubiKey) error { return yk.SetPIN(DefaultPIN, newPIN) }},
+		{"SetRetries", func(yk *YubiKey) error {
+			limits := RetryLimits{PINRetries: 5, PUKRetries: 3, NewPIN: newPIN}
+			return yk.SetRetries(DefaultManagementKey(), DefaultPIN, limits)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			card := pivtest.New(pivtest.Config{})
+			c := Client{ShareMode: ShareShared, Transactions: TransactionPerOperation}
+			yk, err := c.OpenTransport(card)
+			if err != nil {
+				t.Fatalf("opening yubikey: %v", err)
+			}
+			defer yk.Close()
+
+			key := Key{
+				Algorithm:   AlgorithmEC256,
+				PINPolicy:   PINPolicyOnce,
+				TouchPolicy: TouchPolicyNever,
+			}
+			pub, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key)
+			if err != nil {
+				t.Fatalf("generating key: %v", err)
+			}
+			if err := yk.VerifyPIN(DefaultPIN); err != nil {
+				t.Fatalf("verifying pin: %v", err)
+			}
+			if err := test.change(yk); err != nil {
+				t.Fatalf("changing pin: %v", err)
+			}
+			priv, err := yk.PrivateKey(SlotAuthentication, pub, KeyAuth{})
+			if err != nil {
+				t.Fatalf("getting private key: %v", err)
+			}
+
+			// Reselect the PIV applet from another application, resetting the
+			// PIN's verification status. It must be reestablished with the new
+			// PIN.
+			if err := card.Begin(); err != nil {
+				t.Fatalf("beginning transaction from another application: %v", err)
+			}
+			req := append([]byte{0x00, 0xa4, 0x04, 0x00, byte(len(aidPIV))}, aidPIV[:]...)
+			if _, sw, err := card.Transmit(req); err != nil || sw != 0x9000 {
+				t.Fatalf("selecting applet from another application: sw=0x%04x, err=%v", sw, err)
+			}
+			card.End()
+
+			digest := sha256.Sum256([]byte("hello"))
+			if _, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+				t.Fatalf("signing after pin was changed: %v", err)
+			}
+			m, err := yk.PINMetadata()
+			if err != nil {
+				t.Fatalf("getting pin metadata: %v", err)
+			}
+			if m.RemainingRetries != m.TotalRetries {
+				t.Errorf("pin retries got=%d, want=%d", m.RemainingRetries, m.TotalRetries)
+			}
+		})
+	}
+}
+
+func TestOpenTransportExclusive(t *testing.T) {
+	card := pivtest.New(pivtest.Config{})
+	yk, err := OpenTransport(card)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+	if err := card.Begin(); err == nil {
+		t.Errorf("expected transaction to be held while yubikey is open")
+	}
+}
+
 func TestYubiKeySerial(t *testing.T) {
 	yk, close := newTestYubiKey(t)
 	defer close()
@@ -171,6 +432,177 @@ func TestYubiKeyPINRetries(t *testing.T) {
 	}
 }
 
+func TestYubiKeyCredentialMetadata(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{})
+	testRequiresVersion(t, yk, 5, 3, 0)
+
+	pin, err := yk.PINMetadata()
+	if err != nil {
+		t.Fatalf("getting pin metadata: %v", err)
+	}
+	want := CredentialMetadata{Default: true, TotalRetries: 3, RemainingRetries: 3}
+	if *pin != want {
+		t.Errorf("pin metadata got=%+v, want=%+v", *pin, want)
+	}
+
+	if err := yk.SetPUK("00000000", "87654321"); err == nil {
+		t.Fatalf("setting puk with wrong puk succeeded")
+	}
+	puk, err := yk.PUKMetadata()
+	if err != nil {
+		t.Fatalf("getting puk metadata: %v", err)
+	}
+	want = CredentialMetadata{Default: true, TotalRetries: 3, RemainingRetries: 2}
+	if *puk != want {
+		t.Errorf("puk metadata got=%+v, want=%+v", *puk, want)
+	}
+
+	if err := yk.SetPIN(DefaultPIN, "654321"); err != nil {
+		t.Fatalf("setting pin: %v", err)
+	}
+	pin, err = yk.PINMetadata()
+	if err != nil {
+		t.Fatalf("getting pin metadata: %v", err)
+	}
+	want = CredentialMetadata{Default: false, TotalRetries: 3, RemainingRetries: 3}
+	if *pin != want {
+		t.Errorf("pin metadata got=%+v, want=%+v", *pin, want)
+	}
+}
+
+func TestYubiKeyCredentialMetadataUnsupported(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{4, 3, 0}})
+	testRequiresVersionBefore(t, yk, 5, 3, 0)
+
+	if _, err := yk.PINMetadata(); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("getting pin metadata got err=%v, want=%v", err, ErrMissingCapability)
+	}
+	if _, err := yk.PUKMetadata(); !errors.Is(err, ErrMissingCapability) {
+		t.Errorf("getting puk metadata got err=%v, want=%v", err, ErrMissingCapability)
+	}
+}
+
+func TestYubiKeySetRetries(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{})
+	testRequiresVersion(t, yk, 5, 3, 0)
+
+	limits := RetryLimits{
+		PINRetries: 5,
+		PUKRetries: 3,
+		NewPIN:     "654321",
+		NewPUK:     "87654321",
+	}
+	if err := yk.SetRetries(DefaultManagementKey(), DefaultPIN, limits); err != nil {
+		t.Fatalf("setting retries: %v", err)
+	}
+	pin, err := yk.PINMetadata()
+	if err != nil {
+		t.Fatalf("getting pin metadata: %v", err)
+	}
+	want := CredentialMetadata{Default: false, TotalRetries: 5, RemainingRetries: 5}
+	if *pin != want {
+		t.Errorf("pin metadata got=%+v, want=%+v", *pin, want)
+	}
+	puk, err := yk.PUKMetadata()
+	if err != nil {
+		t.Fatalf("getting puk metadata: %v", err)
+	}
+	want = CredentialMetadata{Default: false, TotalRetries: 3, RemainingRetries: 3}
+	if *puk != want {
+		t.Errorf("puk metadata got=%+v, want=%+v", *puk, want)
+	}
+	if err := yk.VerifyPIN(limits.NewPIN); err != nil {
+		t.Errorf("verifying new pin: %v", err)
+	}
+
+	// Without new values, both credentials are reset to their defaults.
+	limits = RetryLimits{PINRetries: 8, PUKRetries: 4}
+	if err := yk.SetRetries(DefaultManagementKey(), "654321", limits); err != nil {
+		t.Fatalf("setting retries: %v", err)
+	}
+	pin, err = yk.PINMetadata()
+	if err != nil {
+		t.Fatalf("getting pin metadata: %v", err)
+	}
+	want = CredentialMetadata{Default: true, TotalRetries: 8, RemainingRetries: 8}
+	if *pin != want {
+		t.Errorf("pin metadata got=%+v, want=%+v", *pin, want)
+	}
+	if err := yk.SetPUK(DefaultPUK, "87654321"); err != nil {
+		t.Errorf("setting puk from default: %v", err)
+	}
+}
+
+func TestYubiKeySetRetriesInvalid(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{})
+	testRequiresVersion(t, yk, 5, 3, 0)
+
+	tests := []struct {
+		name   string
+		pin    string
+		limits RetryLimits
+	}{
+		{"NoPINRetries", DefaultPIN, RetryLimits{PINRetries: 0, PUKRetries: 3}},
+		{"TooManyPUKRetries", DefaultPIN, RetryLimits{PINRetries: 3, PUKRetries: 256}},
+		{"InvalidNewPIN", DefaultPIN, RetryLimits{PINRetries: 5, PUKRetries: 3, NewPIN: "123456789"}},
+		{"WrongPIN", "000000", RetryLimits{PINRetries: 5, PUKRetries: 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := yk.SetRetries(DefaultManagementKey(), test.pin, test.limits); err == nil {
+				t.Errorf("setting retries succeeded")
+			}
+		})
+	}
+
+	pin, err := yk.PINMetadata()
+	if err != nil {
+		t.Fatalf("getting pin metadata: %v", err)
+	}
+	if pin.TotalRetries != 3 {
+		t.Errorf("pin total retries got=%d, want=3", pin.TotalRetries)
+	}
+}
+
+// changePUKTransport wraps a Transport, failing any attempt to change the PUK.
+type changePUKTransport struct {
+	Transport
+}
+
+func (c *changePUKTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	if len(req) > 3 && req[1] == insChangeReference && req[3] == keyPUK {
+		return nil, 0x6a80, nil
+	}
+	return c.Transport.Transmit(req)
+}
+
+func TestYubiKeySetRetriesDefaultCredentials(t *testing.T) {
+	yk, err := OpenTransport(&changePUKTransport{pivtest.New(pivtest.Config{})})
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	limits := RetryLimits{
+		PINRetries: 5,
+		PUKRetries: 3,
+		NewPIN:     "654321",
+		NewPUK:     "87654321",
+	}
+	err = yk.SetRetries(DefaultManagementKey(), DefaultPIN, limits)
+	if !errors.Is(err, ErrDefaultCredentials) {
+		t.Fatalf("setting retries got err=%v, want ErrDefaultCredentials", err)
+	}
+	pin, err := yk.PINMetadata()
+	if err != nil {
+		t.Fatalf("getting pin metadata: %v", err)
+	}
+	want := CredentialMetadata{Default: true, TotalRetries: 5, RemainingRetries: 5}
+	if *pin != want {
+		t.Errorf("pin metadata got=%+v, want=%+v", *pin, want)
+	}
+}
+
 func TestYubiKeyReset(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
@@ -198,7 +630,7 @@ func TestYubiKeyAuthenticate(t *testing.T) {
 	yk, close := newTestYubiKey(t)
 	defer close()
 
-	if err := yk.authManagementKey(DefaultManagementKey); err != nil {
+	if err := yk.authManagementKey(DefaultManagementKey()); err != nil {
 		t.Errorf("authenticating: %v", err)
 	}
 }
@@ -207,22 +639,101 @@ func TestYubiKeySetManagementKey(t *testing.T) {
 	yk, close := newTestYubiKey(t)
 	defer close()
 
-	var mgmtKey [24]byte
-	if _, err := io.ReadFull(rand.Reader, mgmtKey[:]); err != nil {
+	mgmtKey := ManagementKey{Algorithm: ManagementKeyTDES, Key: make([]byte, 24)}
+	if _, err := io.ReadFull(rand.Reader, mgmtKey.Key); err != nil {
 		t.Fatalf("generating management key: %v", err)
 	}
 
-	if err := yk.SetManagementKey(DefaultManagementKey, mgmtKey); err != nil {
+	if err := yk.SetManagementKey(DefaultManagementKey(), mgmtKey); err != nil {
 		t.Fatalf("setting management key: %v", err)
 	}
 	if err := yk.authManagementKey(mgmtKey); err != nil {
 		t.Errorf("authenticating with new management key: %v", err)
 	}
-	if err := yk.SetManagementKey(mgmtKey, DefaultManagementKey); err != nil {
+	if err := yk.SetManagementKey(mgmtKey, DefaultManagementKey()); err != nil {
 		t.Fatalf("resetting management key: %v", err)
 	}
 }
 
+func TestYubiKeyAESManagementKey(t *testing.T) {
+	tests := []struct {
+		name string
+		alg  ManagementKeyAlgorithm
+		size int
+	}{
+		{"aes128", ManagementKeyAES128, 16},
+		{"aes192", ManagementKeyAES192, 24},
+		{"aes256", ManagementKeyAES256, 32},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 4, 3}})
+
+			key := ManagementKey{Algorithm: test.alg, Key: make([]byte, test.size)}
+			if _, err := io.ReadFull(rand.Reader, key.Key); err != nil {
+				t.Fatalf("generating management key: %v", err)
+			}
+			if err := yk.SetManagementKey(DefaultManagementKey(), key); err != nil {
+				t.Fatalf("setting management key: %v", err)
+			}
+			if err := yk.authManagementKey(key); err != nil {
+				t.Errorf("authenticating with new management key: %v", err)
+			}
+			// The algorithm is read from the card if it isn't provided.
+			if err := yk.authManagementKey(ManagementKey{Key: key.Key}); err != nil {
+				t.Errorf("authenticating without algorithm: %v", err)
+			}
+			if err := yk.authManagementKey(DefaultManagementKey()); err == nil {
+				t.Errorf("authenticating with old management key succeeded")
+			}
+			k := Key{Algorithm: AlgorithmEC256, PINPolicy: PINPolicyNever, TouchPolicy: TouchPolicyNever}
+			if _, err := yk.GenerateKey(key, SlotAuthentication, k); err != nil {
+				t.Errorf("generating key: %v", err)
+			}
+		})
+	}
+}
+
+func TestYubiKeyDefaultManagementKeyAES(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{5, 7, 1}})
+
+	// YubiKeys with firmware 5.7.0 and later default to an AES-192 key.
+	if err := yk.authManagementKey(DefaultManagementKey()); err != nil {
+		t.Fatalf("authenticating with default management key: %v", err)
+	}
+	tdes := ManagementKey{Algorithm: ManagementKeyTDES, Key: DefaultManagementKey().Key}
+	if err := yk.authManagementKey(tdes); err == nil {
+		t.Errorf("authenticating with triple-des default key succeeded")
+	}
+
+	// Keys without an algorithm keep the algorithm of the current key.
+	key := ManagementKey{Key: make([]byte, 24)}
+	if _, err := io.ReadFull(rand.Reader, key.Key); err != nil {
+		t.Fatalf("generating management key: %v", err)
+	}
+	if err := yk.SetManagementKeyTouch(DefaultManagementKey(), key); err != nil {
+		t.Fatalf("setting management key: %v", err)
+	}
+	key.Algorithm = ManagementKeyAES192
+	if err := yk.authManagementKey(key); err != nil {
+		t.Errorf("authenticating with new management key: %v", err)
+	}
+}
+
+func TestYubiKeyAESManagementKeyUnsupported(t *testing.T) {
+	yk := newTestYubiKeyConfig(t, pivtest.Config{Version: [3]byte{4, 3, 0}})
+	testRequiresVersionBefore(t, yk, 5, 4, 0)
+
+	key := ManagementKey{Algorithm: ManagementKeyAES128, Key: make([]byte, 16)}
+	if err := yk.SetManagementKey(DefaultManagementKey(), key); err == nil {
+		t.Errorf("setting aes management key before 5.4.0 succeeded")
+	}
+	short := ManagementKey{Algorithm: ManagementKeyAES256, Key: make([]byte, 16)}
+	if err := yk.authManagementKey(short); err == nil {
+		t.Errorf("authenticating with a short aes-256 key succeeded")
+	}
+}
+
 func TestYubiKeyUnblockPIN(t *testing.T) {
 	yk, close := newTestYubiKey(t)
 	defer close()
@@ -286,23 +797,23 @@ func TestChangeManagementKey(t *testing.T) {
 	yk, close := newTestYubiKey(t)
 	defer close()
 
-	var newKey [24]byte
-	if _, err := io.ReadFull(rand.Reader, newKey[:]); err != nil {
+	newKey := ManagementKey{Algorithm: ManagementKeyTDES, Key: make([]byte, 24)}
+	if _, err := io.ReadFull(rand.Reader, newKey.Key); err != nil {
 		t.Fatalf("generating new management key: %v", err)
 	}
 	// Apply odd-parity
-	for i, b := range newKey {
+	for i, b := range newKey.Key {
 		if bits.OnesCount8(uint8(b))%2 == 0 {
-			newKey[i] = b ^ 1 // flip least significant bit
+			newKey.Key[i] = b ^ 1 // flip least significant bit
 		}
 	}
 	if err := yk.SetManagementKey(newKey, newKey); err == nil {
 		t.Errorf("successfully changed management key with invalid key, expected error")
 	}
-	if err := yk.SetManagementKey(DefaultManagementKey, newKey); err != nil {
+	if err := yk.SetManagementKey(DefaultManagementKey(), newKey); err != nil {
 		t.Fatalf("changing management key: %v", err)
 	}
-	if err := yk.SetManagementKey(newKey, DefaultManagementKey); err != nil {
+	if err := yk.SetManagementKey(newKey, DefaultManagementKey()); err != nil {
 		t.Fatalf("resetting management key: %v", err)
 	}
 }
@@ -328,35 +839,41 @@ func TestMetadata(t *testing.T) {
 		t.Errorf("expected no management key set")
 	}
 
-	wantKey := [24]byte{
+	wantKey := ManagementKey{Key: []byte{
 		0x09, 0xd9, 0x87, 0x81, 0xfb, 0xdc, 0xc9, 0xb6,
 		0x91, 0xa2, 0x05, 0x80, 0x6e, 0xc0, 0xba, 0x84,
 		0x31, 0xac, 0x0d, 0x9f, 0x59, 0xa5, 0x00, 0xad,
-	}
+	}}
 	m := &Metadata{
 		ManagementKey: &wantKey,
 	}
-	if err := yk.SetMetadata(DefaultManagementKey, m); err != nil {
+	if err := yk.SetMetadata(DefaultManagementKey(), m); err != nil {
 		t.Fatalf("setting metadata: %v", err)
 	}
 	got, err := yk.Metadata(DefaultPIN)
 	if err != nil {
 		t.Fatalf("getting metadata: %v", err)
 	}
+	// Keys without an algorithm are stored with the algorithm of the card's
+	// management key.
+	wantKey.Algorithm = ManagementKeyTDES
+	if supportsVersion(yk.Version(), 5, 7, 0) {
+		wantKey.Algorithm = ManagementKeyAES192
+	}
 	if got.ManagementKey == nil {
 		t.Errorf("no management key")
-	} else if *got.ManagementKey != wantKey {
+	} else if !reflect.DeepEqual(*got.ManagementKey, wantKey) {
 		t.Errorf("wanted management key=0x%x, got=0x%x", wantKey, got.ManagementKey)
 	}
 }
 
 func TestMetadataUnmarshal(t *testing.T) {
 	data, _ := hex.DecodeString("881a891809d98781fbdcc9b691a205806ec0ba8431ac0d9f59a500ad")
-	wantKey := [24]byte{
+	wantKey := ManagementKey{Key: []byte{
 		0x09, 0xd9, 0x87, 0x81, 0xfb, 0xdc, 0xc9, 0xb6,
 		0x91, 0xa2, 0x05, 0x80, 0x6e, 0xc0, 0xba, 0x84,
 		0x31, 0xac, 0x0d, 0x9f, 0x59, 0xa5, 0x00, 0xad,
-	}
+	}}
 	var m Metadata
 	if err := m.unmarshal(data); err != nil {
 		t.Fatalf("parsing metadata: %v", err)
@@ -365,23 +882,61 @@ func TestMetadataUnmarshal(t *testing.T) {
 		t.Fatalf("no management key")
 	}
 	gotKey := *m.ManagementKey
-	if gotKey != wantKey {
+	if !reflect.DeepEqual(gotKey, wantKey) {
 		t.Errorf("(*Metadata).unmarshal, got key=0x%x, want key=0x%x", gotKey, wantKey)
 	}
 }
 
+func TestMetadataUnmarshalAES(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	var m Metadata
+	if err := m.unmarshal(marshalASN1(0x88, marshalASN1(0x89, key))); err != nil {
+		t.Fatalf("parsing metadata: %v", err)
+	}
+	want := ManagementKey{Algorithm: ManagementKeyAES256, Key: key}
+	if m.ManagementKey == nil || !reflect.DeepEqual(*m.ManagementKey, want) {
+		t.Errorf("(*Metadata).unmarshal, got key=%+v, want key=%+v", m.ManagementKey, want)
+	}
+}
+
+func TestMetadataAlgorithm(t *testing.T) {
+	key := ManagementKey{Algorithm: ManagementKeyAES192, Key: bytes.Repeat([]byte{0x42}, 24)}
+	m1 := Metadata{ManagementKey: &key}
+	b, err := m1.marshal()
+	if err != nil {
+		t.Fatalf("marshaling metadata: %v", err)
+	}
+	var m2 Metadata
+	if err := m2.unmarshal(b); err != nil {
+		t.Fatalf("parsing metadata: %v", err)
+	}
+	if m2.ManagementKey == nil || !reflect.DeepEqual(*m2.ManagementKey, key) {
+		t.Errorf("(*Metadata).unmarshal, got key=%+v, want key=%+v", m2.ManagementKey, key)
+	}
+
+	for _, b := range [][]byte{
+		marshalASN1(0x88, append(marshalASN1(0x89, key.Key), 0x8a, 0x01, 0xff)),
+		marshalASN1(0x88, append(marshalASN1(0x89, key.Key), 0x8a, 0x01, algAES128)),
+	} {
+		var m Metadata
+		if err := m.unmarshal(b); err == nil {
+			t.Errorf("parsing metadata %x: expected error", b)
+		}
+	}
+}
+
 func TestMetadataMarshal(t *testing.T) {
-	key := [24]byte{
+	key := ManagementKey{Key: []byte{
 		0x09, 0xd9, 0x87, 0x81, 0xfb, 0xdc, 0xc9, 0xb6,
 		0x91, 0xa2, 0x05, 0x80, 0x6e, 0xc0, 0xba, 0x84,
 		0x31, 0xac, 0x0d, 0x9f, 0x59, 0xa5, 0x00, 0xad,
-	}
+	}}
 	want := append([]byte{
 		0x88,
 		26,
 		0x89,
 		24,
-	}, key[:]...)
+	}, key.Key...)
 	m := Metadata{
 		ManagementKey: &key,
 	}
@@ -395,20 +950,21 @@ func TestMetadataMarshal(t *testing.T) {
 }
 
 func TestMetadataUpdate(t *testing.T) {
-	key := [24]byte{
+	key := ManagementKey{Key: []byte{
 		0x09, 0xd9, 0x87, 0x81, 0xfb, 0xdc, 0xc9, 0xb6,
 		0x91, 0xa2, 0x05, 0x80, 0x6e, 0xc0, 0xba, 0x84,
 		0x31, 0xac, 0x0d, 0x9f, 0x59, 0xa5, 0x00, 0xad,
-	}
+	}}
 	want := append([]byte{
 		0x88,
 		26,
 		0x89,
 		24,
-	}, key[:]...)
+	}, key.Key...)
 
+	defaultKey := DefaultManagementKey()
 	m1 := Metadata{
-		ManagementKey: &DefaultManagementKey,
+		ManagementKey: &defaultKey,
 	}
 	raw, err := m1.marshal()
 	if err != nil {
@@ -428,11 +984,11 @@ func TestMetadataUpdate(t *testing.T) {
 }
 
 func TestMetadataAdditoinalFields(t *testing.T) {
-	key := [24]byte{
+	key := ManagementKey{Key: []byte{
 		0x09, 0xd9, 0x87, 0x81, 0xfb, 0xdc, 0xc9, 0xb6,
 		0x91, 0xa2, 0x05, 0x80, 0x6e, 0xc0, 0xba, 0x84,
 		0x31, 0xac, 0x0d, 0x9f, 0x59, 0xa5, 0x00, 0xad,
-	}
+	}}
 	raw := []byte{
 		0x88,
 		4,
@@ -455,7 +1011,7 @@ func TestMetadataAdditoinalFields(t *testing.T) {
 		// Added management key.
 		0x89,
 		24,
-	}, key[:]...)
+	}, key.Key...)
 
 	m := Metadata{
 		ManagementKey: &key,
@@ -469,3 +1025,153 @@ func TestMetadataAdditoinalFields(t *testing.T) {
 		t.Errorf("(*Metadata.marshal, got=0x%x, want=0x%x", got, want)
 	}
 }
+
+// challengeTransport wraps a Transport, recording the data of each
+// authentication command.
+type challengeTransport struct {
+	Transport
+	auths [][]byte
+}
+
+func (c *challengeTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	if len(req) > 5 && req[1] == insAuthenticate {
+		c.auths = append(c.auths, append([]byte(nil), req[5:]...))
+	}
+	return c.Transport.Transmit(req)
+}
+
+func TestClientRand(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(yk *YubiKey) error
+	}{
+		{"SetManagementKey", func(yk *YubiKey) error {
+			return yk.SetManagementKey(DefaultManagementKey(), DefaultManagementKey())
+		}},
+		{"SetMetadata", func(yk *YubiKey) error {
+			return yk.SetMetadata(DefaultManagementKey(), &Metadata{})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ct := &challengeTransport{Transport: pivtest.New(pivtest.Config{})}
+			c := Client{Rand: bytes.NewReader(bytes.Repeat([]byte{0x42}, 8))}
+			yk, err := c.OpenTransport(ct)
+			if err != nil {
+				t.Fatalf("opening yubikey: %v", err)
+			}
+			defer yk.Close()
+
+			if err := test.op(yk); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if len(ct.auths) != 2 {
+				t.Fatalf("expected 2 authentication commands, got %d", len(ct.auths))
+			}
+			// The second command holds the host's response and challenge.
+			want := bytes.Repeat([]byte{0x42}, 8)
+			if !bytes.Contains(ct.auths[1], append([]byte{0x81, 0x08}, want...)) {
+				t.Errorf("authentication command got=%x, want challenge %x", ct.auths[1], want)
+			}
+		})
+	}
+}
+
+// genericTransport wraps a Transport, rejecting Yubico's PIV extensions and
+// applets as a PIV card from another vendor would.
+type genericTransport struct {
+	Transport
+}
+
+func (g *genericTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	if len(req) > 1 && req[1] >= 0xf7 {
+		return nil, 0x6d00, nil
+	}
+	if len(req) > 5 && req[1] == insSelectApplication && !bytes.HasPrefix(req[5:], aidPIV[:]) {
+		return nil, 0x6a82, nil
+	}
+	return g.Transport.Transmit(req)
+}
+
+func TestOpenGeneric(t *testing.T) {
+	tests := []struct {
+		name string
+		mode TransactionMode
+	}{
+		{"PerConnection", TransactionPerConnection},
+		{"PerOperation", TransactionPerOperation},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := Client{Transactions: test.mode}
+			yk, err := c.OpenTransport(&genericTransport{pivtest.New(pivtest.Config{})})
+			if err != nil {
+				t.Fatalf("opening generic card: %v", err)
+			}
+			defer yk.Close()
+
+			if v := yk.Version(); v != (Version{}) {
+				t.Errorf("version got=%v, want zero", v)
+			}
+			for name, err := range map[string]error{
+				"serial": func() error { _, err := yk.Serial(); return err }(),
+				"attest": func() error { _, err := yk.Attest(SlotAuthentication); return err }(),
+				"key info": func() error {
+					_, err := yk.KeyInfo(SlotAuthentication)
+					return err
+				}(),
+				"import key": func() error {
+					priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+					if err != nil {
+						t.Fatalf("generating key: %v", err)
+					}
+					return yk.SetPrivateKeyInsecure(DefaultManagementKey(), SlotAuthentication, priv, Key{})
+				}(),
+				"reset": yk.Reset(),
+				"generate": func() error {
+					key := Key{Algorithm: AlgorithmEC256, PINPolicy: PINPolicyNever, TouchPolicy: TouchPolicyNever}
+					_, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key)
+					return err
+				}(),
+			} {
+				if !errors.Is(err, ErrMissingCapability) {
+					t.Errorf("%s got err=%v, want ErrMissingCapability", name, err)
+				}
+			}
+
+			// Standard commands still work.
+			if _, err := yk.Retries(); err != nil {
+				t.Errorf("getting retries: %v", err)
+			}
+			pub, err := yk.GenerateKey(DefaultManagementKey(), SlotSignature, Key{Algorithm: AlgorithmEC256})
+			if err != nil {
+				t.Fatalf("generating key: %v", err)
+			}
+			priv, err := yk.PrivateKey(SlotSignature, pub, KeyAuth{PIN: DefaultPIN})
+			if err != nil {
+				t.Fatalf("getting private key: %v", err)
+			}
+			digest := sha256.Sum256([]byte("hello"))
+			sig, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatalf("signing: %v", err)
+			}
+			if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+				t.Errorf("signature didn't verify")
+			}
+			caps, err := yk.Capabilities()
+			if err != nil {
+				t.Fatalf("getting capabilities: %v", err)
+			}
+			if caps.KeyInfo || caps.Attestation || len(caps.PINPolicies) != 0 {
+				t.Errorf("capabilities of generic card report yubico extensions: %+v", caps)
+			}
+			if !caps.SupportsKey(Key{Algorithm: AlgorithmEC256}) {
+				t.Errorf("generic card doesn't support generating keys with default policies")
+			}
+			if caps.SupportsKey(Key{Algorithm: AlgorithmEC256, PINPolicy: PINPolicyNever}) {
+				t.Errorf("generic card supports keys with pin policies")
+			}
+		})
+	}
+}
@@ -0,0 +1,954 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pivtest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-78-4.pdf#page=17
+	alg3DES    = 0x03
+	algAES128  = 0x08
+	algAES192  = 0x0a
+	algAES256  = 0x0c
+	algRSA1024 = 0x06
+	algRSA2048 = 0x07
+	algRSA3072 = 0x05
+	algRSA4096 = 0x16
+	algECCP256 = 0x11
+	algECCP384 = 0x14
+	// YubiKey 5.7 and later.
+	algEd25519 = 0xe0
+	algX25519  = 0xe1
+
+	keyCardManagement = 0x9b
+	keyPIN            = 0x80
+	keyPUK            = 0x81
+	keyOCC            = 0x96
+
+	insVerify             = 0x20
+	insChangeReference    = 0x24
+	insResetRetry         = 0x2c
+	insGenerateAsymmetric = 0x47
+	insAuthenticate       = 0x87
+	insGetData            = 0xcb
+	insPutData            = 0xdb
+	insSelectApplication  = 0xa4
+	insGetResponse        = 0xc0
+
+	// https://developers.yubico.com/PIV/Introduction/Yubico_extensions.html
+	insSetMGMKey   = 0xff
+	insImportKey   = 0xfe
+	insGetVersion  = 0xfd
+	insSetRetries  = 0xfa
+	insReset       = 0xfb
+	insAttest      = 0xf9
+	insGetSerial   = 0xf8
+	insGetMetadata = 0xf7
+	insMoveKey     = 0xf6
+
+	// Instruction of the YubiKey OTP applet that returns the serial number.
+	insOTPGetSerial = 0x01
+
+	// Instruction of the management applet that returns device information.
+	//
+	// https://github.com/Yubico/yubikey-manager/blob/main/yubikit/management.py
+	insGetDeviceInfo = 0x1d
+	insSetDeviceInfo = 0x1c
+
+	pinPolicyNever  = 0x01
+	pinPolicyOnce   = 0x02
+	pinPolicyAlways = 0x03
+
+	touchPolicyNever  = 0x01
+	touchPolicyAlways = 0x02
+	touchPolicyCached = 0x03
+
+	originGenerated = 0x01
+	originImported  = 0x02
+
+	objAttestation       = 0x5fff01
+	objPrintedInfomation = 0x5fc109
+
+	defaultRetries = 3
+)
+
+var (
+	aidPIV        = []byte{0xa0, 0x00, 0x00, 0x03, 0x08, 0x00, 0x00, 0x10, 0x00, 0x01, 0x00}
+	aidManagement = []byte{0xa0, 0x00, 0x00, 0x05, 0x27, 0x47, 0x11, 0x17}
+	aidYubiKey    = []byte{0xa0, 0x00, 0x00, 0x05, 0x27, 0x20, 0x01, 0x01}
+
+	defaultPIN           = []byte{'1', '2', '3', '4', '5', '6', 0xff, 0xff}
+	defaultPUK           = []byte{'1', '2', '3', '4', '5', '6', '7', '8'}
+	defaultManagementKey = []byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	}
+)
+
+// pivState holds the state of the PIV applet.
+type pivState struct {
+	pin           []byte
+	puk           []byte
+	pinRetries    int
+	pukRetries    int
+	pinMaxRetries int
+	pukMaxRetries int
+
+	mgmAlg   byte
+	mgmKey   []byte
+	mgmTouch byte
+
+	keys    map[byte]*slotKey
+	objects map[uint32][]byte
+
+	// Security status of the current session.
+	pinVerified bool
+	// pinFresh indicates that the PIN was verified by the previous command,
+	// as required for keys with PINPolicyAlways.
+	pinFresh         bool
+	mgmAuthenticated bool
+	witness          []byte
+}
+
+// reset restores the applet to its factory state. mgmAlg is the algorithm of
+// the default management key.
+func (s *pivState) reset(mgmAlg byte) {
+	*s = pivState{
+		pin:           append([]byte{}, defaultPIN...),
+		puk:           append([]byte{}, defaultPUK...),
+		pinRetries:    defaultRetries,
+		pukRetries:    defaultRetries,
+		pinMaxRetries: defaultRetries,
+		pukMaxRetries: defaultRetries,
+		mgmAlg:        mgmAlg,
+		mgmKey:        append([]byte{}, defaultManagementKey...),
+		mgmTouch:      touchPolicyNever,
+		keys:          map[byte]*slotKey{},
+		objects:       map[uint32][]byte{},
+	}
+}
+
+func (s *pivState) resetSecurityStatus() {
+	s.pinVerified = false
+	s.pinFresh = false
+	s.mgmAuthenticated = false
+	s.witness = nil
+}
+
+func (c *Card) selectApplication(cmd command) ([]byte, uint16) {
+	if cmd.p1 != 0x04 {
+		return nil, swIncorrectParams
+	}
+	switch {
+	case len(cmd.data) >= 5 && bytes.HasPrefix(aidPIV, cmd.data):
+		c.applet = appletPIV
+		c.piv.resetSecurityStatus()
+		// Application property template.
+		//
+		// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=86
+		return tlv(0x61, append(
+			tlv(0x4f, aidPIV[5:]),
+			tlv(0x79, tlv(0x4f, aidPIV[:5]))...,
+		)), swSuccess
+	case bytes.Equal(cmd.data, aidYubiKey):
+		c.applet = appletOTP
+		return nil, swSuccess
+	case bytes.Equal(cmd.data, aidManagement):
+		c.applet = appletManagement
+		return nil, swSuccess
+	}
+	return nil, swNotFound
+}
+
+func (c *Card) handleOTP(cmd command) ([]byte, uint16) {
+	if cmd.ins == insOTPGetSerial && cmd.p1 == 0x10 {
+		return c.serialBytes(), swSuccess
+	}
+	return nil, swInsNotSupported
+}
+
+// Device information tags returned by the management applet.
+const (
+	deviceInfoUSBSupported     = 0x01
+	deviceInfoSerial           = 0x02
+	deviceInfoUSBEnabled       = 0x03
+	deviceInfoFormfactor       = 0x04
+	deviceInfoVersion          = 0x05
+	deviceInfoAutoEjectTimeout = 0x06
+	deviceInfoChalRespTimeout  = 0x07
+	deviceInfoFlags            = 0x08
+	deviceInfoConfigLock       = 0x0a
+	deviceInfoUnlock           = 0x0b
+	deviceInfoReboot           = 0x0c
+	deviceInfoNFCSupported     = 0x0d
+	deviceInfoNFCEnabled       = 0x0e
+)
+
+// Applications reported in device information.
+const (
+	appOTP     = 0x0001
+	appU2F     = 0x0002
+	appOpenPGP = 0x0008
+	appPIV     = 0x0010
+	appOATH    = 0x0020
+	appFIDO2   = 0x0200
+)
+
+// Form factors of YubiKey Bio keys.
+const (
+	formfactorUSBABio = 0x06
+	formfactorUSBCBio = 0x07
+)
+
+// mgmtState holds the configuration reported by the management applet.
+type mgmtState struct {
+	usbSupported uint16
+	usbEnabled   uint16
+	nfcSupported uint16
+	nfcEnabled   uint16
+
+	configLock       []byte
+	autoEjectTimeout uint16
+	chalRespTimeout  byte
+	flags            byte
+}
+
+// reset restores the management applet's factory configuration for a card
+// with the given form factor.
+func (s *mgmtState) reset(formfactor byte) {
+	apps := uint16(appOTP | appU2F | appOpenPGP | appPIV | appOATH | appFIDO2)
+	var nfc uint16
+	switch formfactor &^ 0xc0 {
+	case formfactorUSBABio, formfactorUSBCBio:
+		apps = appU2F | appPIV | appFIDO2
+	case 0x01:
+		// Keychain form factors include NFC.
+		nfc = apps
+	}
+	*s = mgmtState{
+		usbSupported:    apps,
+		usbEnabled:      apps,
+		nfcSupported:    nfc,
+		nfcEnabled:      nfc,
+		chalRespTimeout: 15,
+	}
+}
+
+func (c *Card) handleManagement(cmd command) ([]byte, uint16) {
+	if !c.supportsVersion(5, 0, 0) {
+		return nil, swInsNotSupported
+	}
+	switch cmd.ins {
+	case insGetDeviceInfo:
+		return c.deviceInfo(), swSuccess
+	case insSetDeviceInfo:
+		return c.setDeviceInfo(cmd)
+	}
+	return nil, swInsNotSupported
+}
+
+// setDeviceInfo applies a configuration change. Rebooting is simulated by
+// ending the session, as if the card had been removed and reinserted.
+func (c *Card) setDeviceInfo(cmd command) ([]byte, uint16) {
+	if len(cmd.data) == 0 || int(cmd.data[0]) != len(cmd.data)-1 {
+		return nil, swWrongLength
+	}
+	objs, err := parseTLVs(cmd.data[1:])
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	s := &c.mgmt
+	if s.configLock != nil && !bytes.Equal(objs[deviceInfoUnlock], s.configLock) {
+		return nil, swSecurityStatus
+	}
+
+	next := *s
+	if b, ok := objs[deviceInfoUSBEnabled]; ok {
+		if len(b) != 2 {
+			return nil, swIncorrectData
+		}
+		next.usbEnabled = binary.BigEndian.Uint16(b)
+		if next.usbEnabled&^s.usbSupported != 0 || next.usbEnabled == 0 {
+			return nil, swIncorrectData
+		}
+	}
+	if b, ok := objs[deviceInfoNFCEnabled]; ok {
+		if len(b) != 2 {
+			return nil, swIncorrectData
+		}
+		next.nfcEnabled = binary.BigEndian.Uint16(b)
+		if next.nfcEnabled&^s.nfcSupported != 0 {
+			return nil, swIncorrectData
+		}
+	}
+	if b, ok := objs[deviceInfoAutoEjectTimeout]; ok {
+		if len(b) != 2 {
+			return nil, swIncorrectData
+		}
+		next.autoEjectTimeout = binary.BigEndian.Uint16(b)
+	}
+	if b, ok := objs[deviceInfoChalRespTimeout]; ok {
+		if len(b) != 1 {
+			return nil, swIncorrectData
+		}
+		next.chalRespTimeout = b[0]
+	}
+	if b, ok := objs[deviceInfoFlags]; ok {
+		if len(b) != 1 {
+			return nil, swIncorrectData
+		}
+		next.flags = b[0]
+	}
+	if b, ok := objs[deviceInfoConfigLock]; ok {
+		if len(b) != 16 {
+			return nil, swIncorrectData
+		}
+		next.configLock = nil
+		if !bytes.Equal(b, make([]byte, 16)) {
+			next.configLock = append([]byte{}, b...)
+		}
+	}
+	*s = next
+
+	if _, ok := objs[deviceInfoReboot]; ok {
+		c.chained = nil
+		c.applet = appletNone
+		c.piv.resetSecurityStatus()
+	}
+	return nil, swSuccess
+}
+
+func uint16Bytes(n uint16) []byte {
+	return []byte{byte(n >> 8), byte(n)}
+}
+
+// deviceInfo encodes the card's device information, prefixed by its length.
+func (c *Card) deviceInfo() []byte {
+	s := &c.mgmt
+	var b []byte
+	b = append(b, tlv(deviceInfoUSBSupported, uint16Bytes(s.usbSupported))...)
+	b = append(b, tlv(deviceInfoSerial, c.serialBytes())...)
+	b = append(b, tlv(deviceInfoUSBEnabled, uint16Bytes(s.usbEnabled))...)
+	b = append(b, tlv(deviceInfoFormfactor, []byte{c.formfactor})...)
+	b = append(b, tlv(deviceInfoVersion, c.version[:])...)
+	b = append(b, tlv(deviceInfoAutoEjectTimeout, uint16Bytes(s.autoEjectTimeout))...)
+	b = append(b, tlv(deviceInfoChalRespTimeout, []byte{s.chalRespTimeout})...)
+	b = append(b, tlv(deviceInfoFlags, []byte{s.flags})...)
+	b = append(b, tlv(deviceInfoConfigLock, []byte{boolByte(s.configLock != nil)})...)
+	if s.nfcSupported != 0 {
+		b = append(b, tlv(deviceInfoNFCSupported, uint16Bytes(s.nfcSupported))...)
+		b = append(b, tlv(deviceInfoNFCEnabled, uint16Bytes(s.nfcEnabled))...)
+	}
+	return append([]byte{byte(len(b))}, b...)
+}
+
+func (c *Card) serialBytes() []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, c.serial)
+	return b
+}
+
+func (c *Card) handlePIV(cmd command) ([]byte, uint16) {
+	// Keys with PINPolicyAlways require the PIN to be verified by the command
+	// immediately preceding their use.
+	fresh := c.piv.pinFresh
+	c.piv.pinFresh = false
+
+	switch cmd.ins {
+	case insVerify:
+		return c.verify(cmd)
+	case insChangeReference:
+		return c.changeReference(cmd)
+	case insResetRetry:
+		return c.resetRetry(cmd)
+	case insAuthenticate:
+		return c.authenticate(cmd, fresh)
+	case insGenerateAsymmetric:
+		return c.generate(cmd)
+	case insGetData:
+		return c.getData(cmd)
+	case insPutData:
+		return c.putData(cmd)
+	case insGetVersion:
+		return c.version[:], swSuccess
+	case insGetSerial:
+		if !c.supportsVersion(5, 0, 0) {
+			return nil, swInsNotSupported
+		}
+		return c.serialBytes(), swSuccess
+	case insImportKey:
+		return c.importKey(cmd)
+	case insAttest:
+		if !c.supportsVersion(4, 3, 0) {
+			return nil, swInsNotSupported
+		}
+		return c.attest(cmd)
+	case insGetMetadata:
+		if !c.supportsVersion(5, 3, 0) {
+			return nil, swInsNotSupported
+		}
+		return c.metadata(cmd)
+	case insMoveKey:
+		if !c.supportsVersion(5, 7, 0) {
+			return nil, swInsNotSupported
+		}
+		return c.moveKey(cmd)
+	case insSetMGMKey:
+		return c.setManagementKey(cmd)
+	case insSetRetries:
+		return c.setRetries(cmd)
+	case insReset:
+		return c.resetApplet()
+	}
+	return nil, swInsNotSupported
+}
+
+// checkReference compares a PIN or PUK against its expected value, updating
+// the retry counter.
+func checkReference(got, want []byte, retries *int, max int) uint16 {
+	if *retries == 0 {
+		return swAuthBlocked
+	}
+	if len(got) != 8 {
+		return swIncorrectData
+	}
+	if !bytes.Equal(got, want) {
+		*retries--
+		return swVerifyFailed | uint16(*retries)
+	}
+	*retries = max
+	return swSuccess
+}
+
+func (c *Card) verify(cmd command) ([]byte, uint16) {
+	switch cmd.p2 {
+	case keyPIN:
+	case keyOCC:
+		// On card biometric comparison is only supported by YubiKey Bio.
+		return nil, swReferenceNotFound
+	default:
+		return nil, swReferenceNotFound
+	}
+	s := &c.piv
+	if len(cmd.data) == 0 {
+		if s.pinVerified {
+			return nil, swSuccess
+		}
+		if s.pinRetries == 0 {
+			return nil, swAuthBlocked
+		}
+		return nil, swVerifyFailed | uint16(s.pinRetries)
+	}
+	sw := checkReference(cmd.data, s.pin, &s.pinRetries, s.pinMaxRetries)
+	if sw != swSuccess {
+		s.pinVerified = false
+		return nil, sw
+	}
+	s.pinVerified = true
+	s.pinFresh = true
+	return nil, swSuccess
+}
+
+func (c *Card) changeReference(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	if len(cmd.data) != 16 {
+		return nil, swIncorrectData
+	}
+	oldRef, newRef := cmd.data[:8], cmd.data[8:]
+	switch cmd.p2 {
+	case keyPIN:
+		if sw := checkReference(oldRef, s.pin, &s.pinRetries, s.pinMaxRetries); sw != swSuccess {
+			return nil, sw
+		}
+		s.pin = append([]byte{}, newRef...)
+	case keyPUK:
+		if sw := checkReference(oldRef, s.puk, &s.pukRetries, s.pukMaxRetries); sw != swSuccess {
+			return nil, sw
+		}
+		s.puk = append([]byte{}, newRef...)
+	default:
+		return nil, swReferenceNotFound
+	}
+	return nil, swSuccess
+}
+
+func (c *Card) resetRetry(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	if cmd.p2 != keyPIN {
+		return nil, swReferenceNotFound
+	}
+	if len(cmd.data) != 16 {
+		return nil, swIncorrectData
+	}
+	if sw := checkReference(cmd.data[:8], s.puk, &s.pukRetries, s.pukMaxRetries); sw != swSuccess {
+		return nil, sw
+	}
+	s.pin = append([]byte{}, cmd.data[8:]...)
+	s.pinRetries = s.pinMaxRetries
+	return nil, swSuccess
+}
+
+func (c *Card) authenticate(cmd command, pinFresh bool) ([]byte, uint16) {
+	tmpl, err := parseTLVs(cmd.data)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	dat, ok := tmpl[0x7c]
+	if !ok {
+		return nil, swIncorrectData
+	}
+	objs, err := parseTLVs(dat)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	if cmd.p2 == keyCardManagement {
+		return c.authenticateManagementKey(cmd.p1, objs)
+	}
+
+	s := &c.piv
+	k, ok := s.keys[cmd.p2]
+	if !ok || k.alg != cmd.p1 {
+		return nil, swIncorrectData
+	}
+	switch k.pinPolicy {
+	case pinPolicyOnce:
+		if !s.pinVerified {
+			return nil, swSecurityStatus
+		}
+	case pinPolicyAlways:
+		if !s.pinVerified || !pinFresh {
+			return nil, swSecurityStatus
+		}
+	}
+
+	var (
+		resp []byte
+		sw   uint16
+	)
+	if challenge, ok := objs[0x81]; ok {
+		resp, sw = c.sign(k, challenge)
+	} else if peer, ok := objs[0x85]; ok {
+		resp, sw = c.sharedKey(k, peer)
+	} else {
+		return nil, swIncorrectData
+	}
+	if sw != swSuccess {
+		return nil, sw
+	}
+	return tlv(0x7c, tlv(0x82, resp)), swSuccess
+}
+
+// authenticateManagementKey implements mutual authentication with the
+// management key.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=92
+func (c *Card) authenticateManagementKey(alg byte, objs map[uint16][]byte) ([]byte, uint16) {
+	s := &c.piv
+	if alg != s.mgmAlg {
+		return nil, swIncorrectParams
+	}
+	var (
+		block cipher.Block
+		err   error
+	)
+	if alg == alg3DES {
+		block, err = des.NewTripleDESCipher(s.mgmKey)
+	} else {
+		block, err = aes.NewCipher(s.mgmKey)
+	}
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	witness, ok := objs[0x80]
+	if !ok {
+		return nil, swIncorrectData
+	}
+
+	if len(witness) == 0 {
+		// Request for a witness. Generate a random value and return it
+		// encrypted, the caller must prove they can decrypt it.
+		s.witness = make([]byte, block.BlockSize())
+		if _, err := io.ReadFull(c.rand, s.witness); err != nil {
+			return nil, swConditionsOfUse
+		}
+		enc := make([]byte, len(s.witness))
+		block.Encrypt(enc, s.witness)
+		return tlv(0x7c, tlv(0x80, enc)), swSuccess
+	}
+
+	want := s.witness
+	s.witness = nil
+	s.mgmAuthenticated = false
+	challenge, ok := objs[0x81]
+	if !ok || len(challenge) != block.BlockSize() {
+		return nil, swIncorrectData
+	}
+	if want == nil || !bytes.Equal(witness, want) {
+		return nil, swSecurityStatus
+	}
+	s.mgmAuthenticated = true
+	resp := make([]byte, len(challenge))
+	block.Encrypt(resp, challenge)
+	return tlv(0x7c, tlv(0x82, resp)), swSuccess
+}
+
+func isKeySlot(slot byte) bool {
+	switch slot {
+	case 0x9a, 0x9c, 0x9d, 0x9e:
+		return true
+	}
+	return slot >= 0x82 && slot <= 0x95
+}
+
+// keyPolicy parses the PIN and touch policy objects of a key generation or
+// import command, applying the slot's defaults for missing values.
+func keyPolicy(slot byte, objs map[uint16][]byte) (pp, tp byte, ok bool) {
+	pp = pinPolicyOnce
+	switch slot {
+	case 0x9c:
+		pp = pinPolicyAlways
+	case 0x9e:
+		pp = pinPolicyNever
+	}
+	tp = touchPolicyNever
+	if v, found := objs[0xaa]; found {
+		if len(v) != 1 || v[0] > pinPolicyAlways {
+			return 0, 0, false
+		}
+		if v[0] != 0x00 {
+			pp = v[0]
+		}
+	}
+	if v, found := objs[0xab]; found {
+		if len(v) != 1 || v[0] > touchPolicyCached {
+			return 0, 0, false
+		}
+		if v[0] != 0x00 {
+			tp = v[0]
+		}
+	}
+	return pp, tp, true
+}
+
+func (c *Card) generate(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	if !s.mgmAuthenticated {
+		return nil, swSecurityStatus
+	}
+	if !isKeySlot(cmd.p2) {
+		return nil, swIncorrectParams
+	}
+	tmpl, err := parseTLVs(cmd.data)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	objs, err := parseTLVs(tmpl[0xac])
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	alg := objs[0x80]
+	if len(alg) != 1 {
+		return nil, swIncorrectData
+	}
+	pp, tp, ok := keyPolicy(cmd.p2, objs)
+	if !ok {
+		return nil, swIncorrectData
+	}
+	priv, err := c.generateKey(alg[0])
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	k := &slotKey{
+		alg:         alg[0],
+		pinPolicy:   pp,
+		touchPolicy: tp,
+		origin:      originGenerated,
+		priv:        priv,
+	}
+	s.keys[cmd.p2] = k
+	return tlv(0x7f49, k.publicKey()), swSuccess
+}
+
+func (c *Card) importKey(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	if !s.mgmAuthenticated {
+		return nil, swSecurityStatus
+	}
+	if !isKeySlot(cmd.p2) {
+		return nil, swIncorrectParams
+	}
+	if !c.supportsAlg(cmd.p1) {
+		return nil, swIncorrectParams
+	}
+	objs, err := parseTLVs(cmd.data)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	pp, tp, ok := keyPolicy(cmd.p2, objs)
+	if !ok {
+		return nil, swIncorrectData
+	}
+	priv, err := parsePrivateKey(cmd.p1, objs)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	s.keys[cmd.p2] = &slotKey{
+		alg:         cmd.p1,
+		pinPolicy:   pp,
+		touchPolicy: tp,
+		origin:      originImported,
+		priv:        priv,
+	}
+	return nil, swSuccess
+}
+
+func (c *Card) attest(cmd command) ([]byte, uint16) {
+	k, ok := c.piv.keys[cmd.p1]
+	if !ok || k.origin != originGenerated {
+		return nil, swIncorrectData
+	}
+	cert, err := c.attestationCertificate(cmd.p1, k)
+	if err != nil {
+		return nil, swConditionsOfUse
+	}
+	return cert, swSuccess
+}
+
+// objectID parses the tag list of a GET DATA or PUT DATA command.
+func objectID(objs map[uint16][]byte) (uint32, bool) {
+	tag, ok := objs[0x5c]
+	if !ok || len(tag) == 0 || len(tag) > 3 {
+		return 0, false
+	}
+	var id uint32
+	for _, b := range tag {
+		id = id<<8 | uint32(b)
+	}
+	return id, true
+}
+
+func (c *Card) getData(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	if cmd.p1 != 0x3f || cmd.p2 != 0xff {
+		return nil, swIncorrectParams
+	}
+	objs, err := parseTLVs(cmd.data)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	id, ok := objectID(objs)
+	if !ok {
+		return nil, swIncorrectData
+	}
+	if id == objPrintedInfomation && !s.pinVerified {
+		return nil, swSecurityStatus
+	}
+	if obj, ok := s.objects[id]; ok {
+		return tlv(0x53, obj), swSuccess
+	}
+	if id == objAttestation {
+		obj := tlv(0x70, c.attCert.Raw)
+		obj = append(obj, tlv(0x71, []byte{0x00})...)
+		obj = append(obj, tlv(0xfe, nil)...)
+		return tlv(0x53, obj), swSuccess
+	}
+	return nil, swNotFound
+}
+
+func (c *Card) putData(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	if cmd.p1 != 0x3f || cmd.p2 != 0xff {
+		return nil, swIncorrectParams
+	}
+	if !s.mgmAuthenticated {
+		return nil, swSecurityStatus
+	}
+	objs, err := parseTLVs(cmd.data)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	id, ok := objectID(objs)
+	if !ok {
+		return nil, swIncorrectData
+	}
+	obj, ok := objs[0x53]
+	if !ok {
+		return nil, swIncorrectData
+	}
+	if len(obj) == 0 {
+		delete(s.objects, id)
+		return nil, swSuccess
+	}
+	s.objects[id] = append([]byte{}, obj...)
+	return nil, swSuccess
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 0x01
+	}
+	return 0x00
+}
+
+func (c *Card) metadata(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	switch cmd.p2 {
+	case keyPIN:
+		return referenceMetadata(bytes.Equal(s.pin, defaultPIN), s.pinMaxRetries, s.pinRetries), swSuccess
+	case keyPUK:
+		return referenceMetadata(bytes.Equal(s.puk, defaultPUK), s.pukMaxRetries, s.pukRetries), swSuccess
+	case keyCardManagement:
+		var resp []byte
+		resp = append(resp, tlv(0x01, []byte{s.mgmAlg})...)
+		resp = append(resp, tlv(0x02, []byte{0xff, s.mgmTouch})...)
+		resp = append(resp, tlv(0x05, []byte{boolByte(bytes.Equal(s.mgmKey, defaultManagementKey))})...)
+		return resp, swSuccess
+	case keyOCC:
+		return nil, swReferenceNotFound
+	}
+	k, ok := s.keys[cmd.p2]
+	if !ok {
+		return nil, swNotFound
+	}
+	var resp []byte
+	resp = append(resp, tlv(0x01, []byte{k.alg})...)
+	resp = append(resp, tlv(0x02, []byte{k.pinPolicy, k.touchPolicy})...)
+	resp = append(resp, tlv(0x03, []byte{k.origin})...)
+	resp = append(resp, tlv(0x04, k.publicKey())...)
+	return resp, swSuccess
+}
+
+func referenceMetadata(isDefault bool, max, remaining int) []byte {
+	var resp []byte
+	resp = append(resp, tlv(0x01, []byte{0xff})...)
+	resp = append(resp, tlv(0x05, []byte{boolByte(isDefault)})...)
+	resp = append(resp, tlv(0x06, []byte{byte(max), byte(remaining)})...)
+	return resp
+}
+
+func (c *Card) setManagementKey(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	if !s.mgmAuthenticated {
+		return nil, swSecurityStatus
+	}
+	if cmd.p1 != 0xff {
+		return nil, swIncorrectParams
+	}
+	touch := byte(touchPolicyNever)
+	switch cmd.p2 {
+	case 0xff:
+	case 0xfe:
+		touch = touchPolicyAlways
+	default:
+		return nil, swIncorrectParams
+	}
+	d := cmd.data
+	if len(d) < 3 || d[1] != keyCardManagement || int(d[2]) != len(d)-3 {
+		return nil, swIncorrectData
+	}
+	var size int
+	switch d[0] {
+	case alg3DES, algAES192:
+		size = 24
+	case algAES128:
+		size = 16
+	case algAES256:
+		size = 32
+	default:
+		return nil, swIncorrectData
+	}
+	if d[0] != alg3DES && !c.supportsVersion(5, 4, 0) {
+		return nil, swIncorrectData
+	}
+	if int(d[2]) != size {
+		return nil, swIncorrectData
+	}
+	s.mgmAlg = d[0]
+	s.mgmKey = append([]byte{}, d[3:]...)
+	s.mgmTouch = touch
+	return nil, swSuccess
+}
+
+// moveKey moves the key in slot P2 to slot P1, or deletes it if P1 is 0xff.
+func (c *Card) moveKey(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	if !s.mgmAuthenticated {
+		return nil, swSecurityStatus
+	}
+	if !isKeySlot(cmd.p2) || (cmd.p1 != 0xff && !isKeySlot(cmd.p1)) {
+		return nil, swIncorrectParams
+	}
+	k, ok := s.keys[cmd.p2]
+	if !ok {
+		return nil, swNotFound
+	}
+	if cmd.p1 == 0xff {
+		delete(s.keys, cmd.p2)
+		return nil, swSuccess
+	}
+	if _, ok := s.keys[cmd.p1]; ok {
+		return nil, swConditionsOfUse
+	}
+	s.keys[cmd.p1] = k
+	delete(s.keys, cmd.p2)
+	return nil, swSuccess
+}
+
+// setRetries configures the number of PIN and PUK retries, resetting both to
+// their default values.
+func (c *Card) setRetries(cmd command) ([]byte, uint16) {
+	s := &c.piv
+	if !s.mgmAuthenticated || !s.pinVerified {
+		return nil, swSecurityStatus
+	}
+	if cmd.p1 == 0 || cmd.p2 == 0 {
+		return nil, swIncorrectParams
+	}
+	s.pin = append([]byte{}, defaultPIN...)
+	s.puk = append([]byte{}, defaultPUK...)
+	s.pinMaxRetries = int(cmd.p1)
+	s.pukMaxRetries = int(cmd.p2)
+	s.pinRetries = s.pinMaxRetries
+	s.pukRetries = s.pukMaxRetries
+	s.pinVerified = false
+	return nil, swSuccess
+}
+
+// defaultManagementKeyAlg returns the algorithm of the factory default
+// management key. YubiKeys with firmware 5.7.0 and later use AES-192.
+func (c *Card) defaultManagementKeyAlg() byte {
+	if c.supportsVersion(5, 7, 0) {
+		return algAES192
+	}
+	return alg3DES
+}
+
+func (c *Card) resetApplet() ([]byte, uint16) {
+	s := &c.piv
+	// The applet can only be reset once both the PIN and PUK are blocked.
+	if s.pinRetries != 0 || s.pukRetries != 0 {
+		return nil, swConditionsOfUse
+	}
+	s.reset(c.defaultManagementKeyAlg())
+	return nil, swSuccess
+}
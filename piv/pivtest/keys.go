@@ -0,0 +1,336 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pivtest
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// YubiKey attestation certificate extensions.
+//
+// https://developers.yubico.com/PIV/Introduction/PIV_attestation.html
+var (
+	extIDFirmwareVersion = asn1.ObjectIdentifier([]int{1, 3, 6, 1, 4, 1, 41482, 3, 3})
+	extIDSerialNumber    = asn1.ObjectIdentifier([]int{1, 3, 6, 1, 4, 1, 41482, 3, 7})
+	extIDKeyPolicy       = asn1.ObjectIdentifier([]int{1, 3, 6, 1, 4, 1, 41482, 3, 8})
+	extIDFormFactor      = asn1.ObjectIdentifier([]int{1, 3, 6, 1, 4, 1, 41482, 3, 9})
+)
+
+var errUnsupportedAlgorithm = errors.New("unsupported algorithm")
+
+// slotKey is a private key held in one of the card's slots.
+type slotKey struct {
+	alg         byte
+	pinPolicy   byte
+	touchPolicy byte
+	origin      byte
+	// priv is an *ecdsa.PrivateKey, *rsa.PrivateKey, ed25519.PrivateKey or an
+	// X25519 *ecdh.PrivateKey.
+	priv privateKey
+}
+
+// privateKey is implemented by the standard library's private key types.
+type privateKey interface {
+	Public() crypto.PublicKey
+}
+
+func curveForAlg(alg byte) (elliptic.Curve, bool) {
+	switch alg {
+	case algECCP256:
+		return elliptic.P256(), true
+	case algECCP384:
+		return elliptic.P384(), true
+	}
+	return nil, false
+}
+
+func rsaBitsForAlg(alg byte) (int, bool) {
+	switch alg {
+	case algRSA1024:
+		return 1024, true
+	case algRSA2048:
+		return 2048, true
+	case algRSA3072:
+		return 3072, true
+	case algRSA4096:
+		return 4096, true
+	}
+	return 0, false
+}
+
+// supportsAlg reports whether the card's firmware implements an algorithm.
+func (c *Card) supportsAlg(alg byte) bool {
+	switch alg {
+	case algRSA3072, algRSA4096, algEd25519, algX25519:
+		return c.supportsVersion(5, 7, 0)
+	}
+	return true
+}
+
+func (c *Card) generateKey(alg byte) (privateKey, error) {
+	if !c.supportsAlg(alg) {
+		return nil, errUnsupportedAlgorithm
+	}
+	switch alg {
+	case algEd25519:
+		_, priv, err := ed25519.GenerateKey(c.rand)
+		return priv, err
+	case algX25519:
+		return ecdh.X25519().GenerateKey(c.rand)
+	}
+	if curve, ok := curveForAlg(alg); ok {
+		return ecdsa.GenerateKey(curve, c.rand)
+	}
+	if bits, ok := rsaBitsForAlg(alg); ok {
+		return rsa.GenerateKey(c.rand, bits)
+	}
+	return nil, errUnsupportedAlgorithm
+}
+
+// parsePrivateKey parses the data objects of an IMPORT ASYMMETRIC KEY command.
+//
+// https://developers.yubico.com/PIV/Introduction/Yubico_extensions.html
+func parsePrivateKey(alg byte, objs map[uint16][]byte) (privateKey, error) {
+	switch alg {
+	case algEd25519:
+		b := objs[0x07]
+		if len(b) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid private key length: %d", len(b))
+		}
+		return ed25519.NewKeyFromSeed(b), nil
+	case algX25519:
+		return ecdh.X25519().NewPrivateKey(objs[0x08])
+	}
+	if curve, ok := curveForAlg(alg); ok {
+		b := objs[0x06]
+		if len(b) != (curve.Params().BitSize+7)/8 {
+			return nil, fmt.Errorf("invalid private key length: %d", len(b))
+		}
+		d := new(big.Int).SetBytes(b)
+		if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+			return nil, fmt.Errorf("invalid private key")
+		}
+		priv := &ecdsa.PrivateKey{D: d}
+		priv.Curve = curve
+		priv.X, priv.Y = curve.ScalarBaseMult(b)
+		return priv, nil
+	}
+
+	bits, ok := rsaBitsForAlg(alg)
+	if !ok {
+		return nil, errUnsupportedAlgorithm
+	}
+	p := new(big.Int).SetBytes(objs[0x01])
+	q := new(big.Int).SetBytes(objs[0x02])
+	one := big.NewInt(1)
+	if p.Cmp(one) <= 0 || q.Cmp(one) <= 0 {
+		return nil, fmt.Errorf("invalid prime")
+	}
+	n := new(big.Int).Mul(p, q)
+	if n.BitLen() != bits {
+		return nil, fmt.Errorf("invalid modulus size: %d", n.BitLen())
+	}
+	// YubiKeys only support a public exponent of 65537.
+	e := big.NewInt(65537)
+	phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+	d := new(big.Int).ModInverse(e, phi)
+	if d == nil {
+		return nil, fmt.Errorf("public exponent not invertible")
+	}
+	priv := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+		D:         d,
+		Primes:    []*big.Int{p, q},
+	}
+	if err := priv.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	priv.Precompute()
+	return priv, nil
+}
+
+// publicKey encodes the public key as returned by GENERATE ASYMMETRIC KEY PAIR.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=95
+func (k *slotKey) publicKey() []byte {
+	switch priv := k.priv.(type) {
+	case *ecdsa.PrivateKey:
+		return tlv(0x86, elliptic.Marshal(priv.Curve, priv.X, priv.Y))
+	case *rsa.PrivateKey:
+		e := big.NewInt(int64(priv.E))
+		return append(tlv(0x81, priv.N.Bytes()), tlv(0x82, e.Bytes())...)
+	case ed25519.PrivateKey:
+		return tlv(0x86, priv.Public().(ed25519.PublicKey))
+	case *ecdh.PrivateKey:
+		return tlv(0x86, priv.PublicKey().Bytes())
+	}
+	return nil
+}
+
+// sign performs the private key operation on a challenge. For ECDSA keys the
+// challenge is a digest, and for Ed25519 keys the message. For RSA keys it's
+// the already padded input to a raw RSA operation.
+func (c *Card) sign(k *slotKey, challenge []byte) ([]byte, uint16) {
+	switch priv := k.priv.(type) {
+	case *ecdsa.PrivateKey:
+		sig, err := ecdsa.SignASN1(c.rand, priv, challenge)
+		if err != nil {
+			return nil, swIncorrectData
+		}
+		return sig, swSuccess
+	case ed25519.PrivateKey:
+		return ed25519.Sign(priv, challenge), swSuccess
+	case *rsa.PrivateKey:
+		size := priv.Size()
+		if len(challenge) != size {
+			return nil, swIncorrectData
+		}
+		m := new(big.Int).SetBytes(challenge)
+		if m.Cmp(priv.N) >= 0 {
+			return nil, swIncorrectData
+		}
+		return m.Exp(m, priv.D, priv.N).FillBytes(make([]byte, size)), swSuccess
+	}
+	return nil, swIncorrectData
+}
+
+// sharedKey performs elliptic curve Diffie-Hellman with the peer's public key,
+// returning the X coordinate of the shared point.
+func (c *Card) sharedKey(k *slotKey, peer []byte) ([]byte, uint16) {
+	if priv, ok := k.priv.(*ecdh.PrivateKey); ok {
+		pub, err := priv.Curve().NewPublicKey(peer)
+		if err != nil {
+			return nil, swIncorrectData
+		}
+		secret, err := priv.ECDH(pub)
+		if err != nil {
+			return nil, swIncorrectData
+		}
+		return secret, swSuccess
+	}
+	priv, ok := k.priv.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, swIncorrectData
+	}
+	x, y := elliptic.Unmarshal(priv.Curve, peer)
+	if x == nil {
+		return nil, swIncorrectData
+	}
+	mx, _ := priv.Curve.ScalarMult(x, y, priv.D.Bytes())
+	size := (priv.Curve.Params().BitSize + 7) / 8
+	return mx.FillBytes(make([]byte, size)), swSuccess
+}
+
+// attestationCertificate issues a certificate for a generated key, signed by
+// the card's attestation certificate.
+func (c *Card) attestationCertificate(slot byte, k *slotKey) ([]byte, error) {
+	serial, err := asn1.Marshal(int64(c.serial))
+	if err != nil {
+		return nil, fmt.Errorf("encoding serial: %v", err)
+	}
+	certSerial := make([]byte, 16)
+	if _, err := c.rand.Read(certSerial); err != nil {
+		return nil, fmt.Errorf("generating certificate serial: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("YubiKey PIV Attestation %02x", slot)},
+		SerialNumber: new(big.Int).SetBytes(certSerial),
+		NotBefore:    c.attCert.NotBefore,
+		NotAfter:     c.attCert.NotAfter,
+		ExtraExtensions: []pkix.Extension{
+			{Id: extIDFirmwareVersion, Value: c.version[:]},
+			{Id: extIDSerialNumber, Value: serial},
+			{Id: extIDKeyPolicy, Value: []byte{k.pinPolicy, k.touchPolicy}},
+			{Id: extIDFormFactor, Value: []byte{c.formfactor}},
+		},
+	}
+	pub := k.priv.Public()
+	if _, ok := pub.(*ecdh.PublicKey); ok {
+		// x509.CreateCertificate doesn't support X25519 keys. Issue the
+		// certificate for a placeholder key, then replace it.
+		der, err := x509.CreateCertificate(c.rand, tmpl, c.attCert, c.attKey.Public(), c.attKey)
+		if err != nil {
+			return nil, err
+		}
+		return c.replacePublicKey(der, pub)
+	}
+	return x509.CreateCertificate(c.rand, tmpl, c.attCert, pub, c.attKey)
+}
+
+// certificate is the ASN.1 structure of an X.509 certificate.
+//
+// https://www.rfc-editor.org/rfc/rfc5280#section-4.1
+type certificate struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm asn1.RawValue
+	Signature          asn1.BitString
+}
+
+// replacePublicKey replaces the public key of a certificate issued by the
+// attestation key, signing the modified certificate again.
+func (c *Card) replacePublicKey(der []byte, pub crypto.PublicKey) ([]byte, error) {
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("encoding public key: %v", err)
+	}
+	var cert certificate
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		return nil, fmt.Errorf("parsing certificate: %v", err)
+	}
+	var fields []asn1.RawValue
+	for rest := cert.TBSCertificate.Bytes; len(rest) > 0; {
+		var v asn1.RawValue
+		if rest, err = asn1.Unmarshal(rest, &v); err != nil {
+			return nil, fmt.Errorf("parsing certificate fields: %v", err)
+		}
+		fields = append(fields, v)
+	}
+	// The version, serial number, signature algorithm, issuer, validity and
+	// subject precede the public key.
+	const spkiField = 6
+	if len(fields) <= spkiField {
+		return nil, fmt.Errorf("certificate has too few fields: %d", len(fields))
+	}
+	fields[spkiField] = asn1.RawValue{FullBytes: spki}
+	var tbs []byte
+	for _, f := range fields {
+		tbs = append(tbs, f.FullBytes...)
+	}
+	tbs, err = asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: tbs})
+	if err != nil {
+		return nil, fmt.Errorf("encoding certificate fields: %v", err)
+	}
+	// The attestation key is a P-256 key, which x509 signs using SHA-256.
+	digest := sha256.Sum256(tbs)
+	sig, err := ecdsa.SignASN1(c.rand, c.attKey, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate: %v", err)
+	}
+	cert.TBSCertificate = asn1.RawValue{FullBytes: tbs}
+	cert.Signature = asn1.BitString{Bytes: sig, BitLength: len(sig) * 8}
+	return asn1.Marshal(cert)
+}
@@ -0,0 +1,364 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pivtest implements an in-memory PIV smart card for testing.
+//
+// The simulated card emulates the PIV applet of a YubiKey, including the
+// Yubico extensions used by the piv package such as attestation, key import,
+// metadata and resets. A Card implements piv.Transport, allowing code built on
+// the piv package to be tested without a physical card:
+//
+//	card := pivtest.New(pivtest.Config{})
+//	yk, err := piv.OpenTransport(card)
+//	if err != nil {
+//		// ...
+//	}
+//	defer yk.Close()
+//
+// Attestations are signed by a certificate authority generated for each card,
+// which is available through the Roots method.
+//
+// Touch policies are recorded, but a simulated card never waits for touch.
+package pivtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Config holds options for a simulated card.
+type Config struct {
+	// Version is the firmware version reported by the card as major, minor and
+	// patch numbers. Features are enabled or disabled based on the firmware
+	// version, the same as a YubiKey.
+	//
+	// If zero, defaults to 5.4.3.
+	Version [3]byte
+
+	// Serial is the serial number reported by the card.
+	//
+	// If zero, defaults to 12345678.
+	Serial uint32
+
+	// Formfactor is the form factor reported in attestation certificates and
+	// by the management applet, encoded as a YubiKey would.
+	//
+	// If zero, defaults to a USB-A Keychain (0x01).
+	Formfactor byte
+
+	// Rand is the source of randomness used for keys and challenges.
+	//
+	// If nil, defaults to crypto/rand.Reader.
+	Rand io.Reader
+}
+
+// Status words returned by the simulated card.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=127
+const (
+	swSuccess           = 0x9000
+	swBytesRemaining    = 0x6100
+	swVerifyFailed      = 0x63c0
+	swWrongLength       = 0x6700
+	swSecurityStatus    = 0x6982
+	swAuthBlocked       = 0x6983
+	swConditionsOfUse   = 0x6985
+	swIncorrectData     = 0x6a80
+	swNotFound          = 0x6a82
+	swIncorrectParams   = 0x6a86
+	swReferenceNotFound = 0x6a88
+	swInsNotSupported   = 0x6d00
+	swClaNotSupported   = 0x6e00
+)
+
+// maxResponseSize is the largest response returned in a single APDU. Larger
+// responses must be read using GET RESPONSE.
+const maxResponseSize = 256
+
+// Card is a simulated smart card. It's safe for concurrent use, though like a
+// physical card, commands from different callers should be serialized using
+// transactions.
+//
+// Close ends the current session, clearing PIN and management key
+// authentication, but the Card retains its keys and data and may be opened
+// again.
+type Card struct {
+	mu sync.Mutex
+
+	version    [3]byte
+	serial     uint32
+	formfactor byte
+	rand       io.Reader
+
+	caCert  *x509.Certificate
+	attKey  *ecdsa.PrivateKey
+	attCert *x509.Certificate
+
+	inTx bool
+
+	// chained holds the data of a chained command that hasn't completed.
+	chained []byte
+	// pending holds response data waiting to be read by GET RESPONSE.
+	pending []byte
+
+	applet applet
+
+	piv  pivState
+	mgmt mgmtState
+}
+
+type applet int
+
+const (
+	appletNone applet = iota
+	appletPIV
+	appletOTP
+	appletManagement
+)
+
+// New initializes a simulated card in its factory state.
+func New(c Config) *Card {
+	card := &Card{
+		version:    c.Version,
+		serial:     c.Serial,
+		formfactor: c.Formfactor,
+		rand:       c.Rand,
+	}
+	if card.version == [3]byte{} {
+		card.version = [3]byte{5, 4, 3}
+	}
+	if card.serial == 0 {
+		card.serial = 12345678
+	}
+	if card.formfactor == 0 {
+		card.formfactor = 0x01
+	}
+	if card.rand == nil {
+		card.rand = rand.Reader
+	}
+	if err := card.initAttestation(); err != nil {
+		// Only possible if the source of randomness fails.
+		panic(fmt.Sprintf("pivtest: initializing attestation certificates: %v", err))
+	}
+	card.piv.reset(card.defaultManagementKeyAlg())
+	card.mgmt.reset(card.formfactor)
+	return card
+}
+
+// initAttestation generates a certificate authority and an attestation
+// certificate signed by it, mirroring the chain used by YubiKeys.
+func (c *Card) initAttestation() error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), c.rand)
+	if err != nil {
+		return fmt.Errorf("generating ca key: %v", err)
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(100 * 365 * 24 * time.Hour)
+	caTmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "pivtest Root CA"},
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(c.rand, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		return fmt.Errorf("creating ca certificate: %v", err)
+	}
+	if c.caCert, err = x509.ParseCertificate(caDER); err != nil {
+		return fmt.Errorf("parsing ca certificate: %v", err)
+	}
+
+	if c.attKey, err = ecdsa.GenerateKey(elliptic.P256(), c.rand); err != nil {
+		return fmt.Errorf("generating attestation key: %v", err)
+	}
+	attTmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Yubico PIV Attestation"},
+		SerialNumber:          big.NewInt(2),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		ExtraExtensions: []pkix.Extension{
+			{Id: extIDFirmwareVersion, Value: c.version[:]},
+		},
+	}
+	attDER, err := x509.CreateCertificate(c.rand, attTmpl, c.caCert, c.attKey.Public(), caKey)
+	if err != nil {
+		return fmt.Errorf("creating attestation certificate: %v", err)
+	}
+	if c.attCert, err = x509.ParseCertificate(attDER); err != nil {
+		return fmt.Errorf("parsing attestation certificate: %v", err)
+	}
+	return nil
+}
+
+// Roots returns a certificate pool holding the certificate authority that
+// signs the card's attestations. It can be used with piv.Verifier to verify
+// attestations produced by the card.
+func (c *Card) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.caCert)
+	return pool
+}
+
+// Begin starts a transaction.
+func (c *Card) Begin() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inTx {
+		return fmt.Errorf("transaction already in progress")
+	}
+	c.inTx = true
+	return nil
+}
+
+// End ends the current transaction.
+func (c *Card) End() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.inTx {
+		return fmt.Errorf("no transaction in progress")
+	}
+	c.inTx = false
+	return nil
+}
+
+// Close ends the session with the card, resetting its security status.
+func (c *Card) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inTx = false
+	c.chained = nil
+	c.pending = nil
+	c.applet = appletNone
+	c.piv.resetSecurityStatus()
+	return nil
+}
+
+// Transmit processes a raw command APDU, returning the response data and
+// status word.
+func (c *Card) Transmit(req []byte) ([]byte, uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(req) < 4 {
+		return nil, 0, fmt.Errorf("command too short: %d bytes", len(req))
+	}
+	cla, ins, p1, p2 := req[0], req[1], req[2], req[3]
+	var data []byte
+	if len(req) > 5 {
+		n := int(req[4])
+		if len(req) < 5+n {
+			return nil, swWrongLength, nil
+		}
+		data = req[5 : 5+n]
+	}
+	if cla&^0x10 != 0x00 {
+		return nil, swClaNotSupported, nil
+	}
+
+	if ins == insGetResponse {
+		return c.getResponse()
+	}
+	c.pending = nil
+
+	if cla&0x10 != 0 {
+		c.chained = append(c.chained, data...)
+		return nil, swSuccess, nil
+	}
+	if c.chained != nil {
+		data = append(c.chained, data...)
+		c.chained = nil
+	}
+
+	resp, sw := c.handle(command{ins, p1, p2, data})
+	if sw != swSuccess {
+		return nil, sw, nil
+	}
+	return c.respond(resp)
+}
+
+// respond returns the first chunk of a response, queuing the rest to be read
+// using GET RESPONSE.
+func (c *Card) respond(resp []byte) ([]byte, uint16, error) {
+	if len(resp) <= maxResponseSize {
+		return resp, swSuccess, nil
+	}
+	c.pending = resp[maxResponseSize:]
+	return resp[:maxResponseSize], remainingStatus(len(c.pending)), nil
+}
+
+func (c *Card) getResponse() ([]byte, uint16, error) {
+	if c.pending == nil {
+		return nil, swConditionsOfUse, nil
+	}
+	resp := c.pending
+	c.pending = nil
+	return c.respond(resp)
+}
+
+// remainingStatus returns the status word indicating n bytes are available to
+// be read using GET RESPONSE.
+func remainingStatus(n int) uint16 {
+	if n > 0xff {
+		// SW2 of zero indicates 256 or more bytes remain.
+		n = 0
+	}
+	return swBytesRemaining | uint16(n)
+}
+
+type command struct {
+	ins  byte
+	p1   byte
+	p2   byte
+	data []byte
+}
+
+func (c *Card) handle(cmd command) ([]byte, uint16) {
+	if cmd.ins == insSelectApplication {
+		return c.selectApplication(cmd)
+	}
+	switch c.applet {
+	case appletPIV:
+		return c.handlePIV(cmd)
+	case appletOTP:
+		return c.handleOTP(cmd)
+	case appletManagement:
+		return c.handleManagement(cmd)
+	}
+	return nil, swInsNotSupported
+}
+
+func (c *Card) supportsVersion(major, minor, patch byte) bool {
+	v := c.version
+	if v[0] != major {
+		return v[0] > major
+	}
+	if v[1] != minor {
+		return v[1] > minor
+	}
+	return v[2] >= patch
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pivtest
+
+import (
+	"errors"
+)
+
+// tlv encodes a BER-TLV data object with a one or two byte tag.
+func tlv(tag uint16, value []byte) []byte {
+	var b []byte
+	if tag > 0xff {
+		b = append(b, byte(tag>>8))
+	}
+	b = append(b, byte(tag))
+	n := len(value)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, value...)
+}
+
+var errInvalidTLV = errors.New("invalid tlv encoding")
+
+// parseTLVs decodes a sequence of BER-TLV data objects, returning the values
+// keyed by tag. Tags may be one or two bytes long.
+func parseTLVs(b []byte) (map[uint16][]byte, error) {
+	objs := map[uint16][]byte{}
+	for len(b) > 0 {
+		tag := uint16(b[0])
+		b = b[1:]
+		if tag&0x1f == 0x1f {
+			// Multi-byte tag.
+			if len(b) == 0 {
+				return nil, errInvalidTLV
+			}
+			tag = tag<<8 | uint16(b[0])
+			b = b[1:]
+		}
+		if len(b) == 0 {
+			return nil, errInvalidTLV
+		}
+		n := int(b[0])
+		b = b[1:]
+		switch n {
+		case 0x81:
+			if len(b) < 1 {
+				return nil, errInvalidTLV
+			}
+			n = int(b[0])
+			b = b[1:]
+		case 0x82:
+			if len(b) < 2 {
+				return nil, errInvalidTLV
+			}
+			n = int(b[0])<<8 | int(b[1])
+			b = b[2:]
+		default:
+			if n >= 0x80 {
+				return nil, errInvalidTLV
+			}
+		}
+		if len(b) < n {
+			return nil, errInvalidTLV
+		}
+		objs[tag] = b[:n]
+		b = b[n:]
+	}
+	return objs, nil
+}
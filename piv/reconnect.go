@@ -0,0 +1,142 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPINRequired is returned when an operation requires the PIN, but the PIN's
+// verification status was lost because the card was reset or removed since it
+// was verified. Callers should verify the PIN again, such as with VerifyPIN,
+// and retry the operation.
+var ErrPINRequired = errors.New("pin must be verified again after the card was reset")
+
+// Return codes indicating the card was reset or removed since the handle was
+// last used.
+const (
+	rcUnpoweredCard = 0x80100067
+	rcResetCard     = 0x80100068
+	rcRemovedCard   = 0x80100069
+)
+
+// isCardResetErr reports whether an error indicates the connection to the card
+// was lost and must be reestablished.
+func isCardResetErr(err error) bool {
+	return isRCErr(err, rcResetCard) ||
+		isRCErr(err, rcRemovedCard) ||
+		isRCErr(err, rcUnpoweredCard)
+}
+
+// reconnecter is implemented by transports that can reestablish their
+// connection after the card was reset or removed.
+type reconnecter interface {
+	Reconnect() error
+}
+
+// Reconnect replaces the handle to the card with a new connection to the same
+// reader.
+func (p *pcscTransport) Reconnect() error {
+	// The old handle may no longer be valid, ignore any errors closing it.
+	p.h.Close()
+	h, err := p.ctx.Connect(p.reader, p.shared)
+	if err != nil {
+		return err
+	}
+	p.h = h
+	return nil
+}
+
+// pinRequiredErr is returned when the card rejects an operation because the
+// PIN's verification status was reset.
+type pinRequiredErr struct {
+	err error
+}
+
+func (e *pinRequiredErr) Error() string {
+	return ErrPINRequired.Error() + ": " + e.err.Error()
+}
+
+func (e *pinRequiredErr) Unwrap() error {
+	return e.err
+}
+
+func (e *pinRequiredErr) Is(target error) bool {
+	return target == ErrPINRequired
+}
+
+// recoverRun calls f with the YubiKey's transaction. If the card was reset or
+// removed, recoverRun reconnects to it and, if retry is set, calls f again.
+func (yk *YubiKey) recoverRun(retry bool, f func(tx *scTx) error) error {
+	if yk.lost != nil {
+		return yk.lost
+	}
+	err := yk.run(f)
+	if isCardResetErr(err) {
+		if rerr := yk.reconnect(); rerr != nil {
+			return fmt.Errorf("%v, reconnecting: %w", err, rerr)
+		}
+		if !retry {
+			return fmt.Errorf("reconnected to card, operation not retried: %w", err)
+		}
+		err = yk.run(f)
+	}
+
+	var e *apduErr
+	if yk.pinReset && errors.As(err, &e) && e.Status() == 0x6982 {
+		// Only report the reset once. Later errors may be caused by a missing
+		// management key or touch instead.
+		yk.pinReset = false
+		return &pinRequiredErr{err}
+	}
+	return err
+}
+
+// reconnect reestablishes the connection to a card that was reset or removed,
+// checking that it's the same card by comparing serial numbers.
+func (yk *YubiKey) reconnect() error {
+	r, ok := yk.t.(reconnecter)
+	if !ok || !yk.hasSerial {
+		return errors.New("transport doesn't support reconnecting")
+	}
+	if err := r.Reconnect(); err != nil {
+		return err
+	}
+	if err := yk.t.Begin(); err != nil {
+		return fmt.Errorf("beginning smart card transaction: %w", err)
+	}
+	err := ykSelectApplication(yk.tx, aidPIV[:])
+	if err != nil {
+		err = fmt.Errorf("selecting piv applet: %w", err)
+	} else {
+		var serial uint32
+		serial, err = ykSerial(yk.tx, yk.version)
+		if err == nil && serial != yk.serial {
+			// Don't risk sending commands meant for one card to another.
+			yk.lost = fmt.Errorf("card was replaced by a card with serial number %d, want %d", serial, yk.serial)
+			err = yk.lost
+		}
+	}
+	if yk.perOp || err != nil {
+		yk.tx.Close()
+	}
+	if err != nil {
+		return err
+	}
+	// Resetting the card clears its security status.
+	yk.pinReset = true
+	return nil
+}
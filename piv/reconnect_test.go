@@ -0,0 +1,199 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
+)
+
+// resetTransport is a Transport to a simulated card that can be reset, after
+// which it fails like a PC/SC handle until reconnected.
+type resetTransport struct {
+	card *pivtest.Card
+	// next, if set, replaces card when reconnecting.
+	next *pivtest.Card
+
+	reset      bool
+	reconnects int
+}
+
+func (r *resetTransport) Begin() error {
+	if r.reset {
+		return &scErr{rcResetCard}
+	}
+	return r.card.Begin()
+}
+
+func (r *resetTransport) End() error {
+	if r.reset {
+		return &scErr{rcResetCard}
+	}
+	return r.card.End()
+}
+
+func (r *resetTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	if r.reset {
+		return nil, 0, &scErr{rcResetCard}
+	}
+	return r.card.Transmit(req)
+}
+
+func (r *resetTransport) Close() error {
+	return r.card.Close()
+}
+
+func (r *resetTransport) Reconnect() error {
+	r.reconnects++
+	r.reset = false
+	if r.next != nil {
+		r.card = r.next
+	}
+	return nil
+}
+
+// resetCard simulates another application resetting the card.
+func (r *resetTransport) resetCard() {
+	r.card.Close()
+	r.reset = true
+}
+
+func openResetTransport(t *testing.T, shared bool) (*YubiKey, *resetTransport) {
+	t.Helper()
+	rt := &resetTransport{card: pivtest.New(pivtest.Config{})}
+	var c Client
+	if shared {
+		c.Transactions = TransactionPerOperation
+	}
+	yk, err := c.OpenTransport(rt)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	t.Cleanup(func() { yk.Close() })
+	return yk, rt
+}
+
+func TestReconnectAfterReset(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		yk, rt := openResetTransport(t, shared)
+		rt.resetCard()
+		if _, err := yk.Serial(); err != nil {
+			t.Fatalf("shared=%v: getting serial after reset: %v", shared, err)
+		}
+		if rt.reconnects != 1 {
+			t.Errorf("shared=%v: reconnected %d times, want 1", shared, rt.reconnects)
+		}
+		if _, err := yk.Retries(); err != nil {
+			t.Errorf("shared=%v: getting retries after reconnecting: %v", shared, err)
+		}
+	}
+}
+
+func TestReconnectPINRequired(t *testing.T) {
+	yk, rt := openResetTransport(t, false)
+	key := Key{
+		Algorithm:   AlgorithmEC256,
+		PINPolicy:   PINPolicyOnce,
+		TouchPolicy: TouchPolicyNever,
+	}
+	pub, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	if err := yk.VerifyPIN(DefaultPIN); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+	priv, err := yk.PrivateKey(SlotAuthentication, pub, KeyAuth{})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	digest := sha256.Sum256([]byte("hello"))
+	signer := priv.(crypto.Signer)
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+
+	rt.resetCard()
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); !errors.Is(err, ErrPINRequired) {
+		t.Fatalf("signing after reset got err=%v, want ErrPINRequired", err)
+	}
+	// Later security status errors aren't attributed to the reset, such as
+	// writing a data object without the management key.
+	err = yk.do(context.Background(), func(tx *scTx) error {
+		cmd := apdu{
+			instruction: insPutData,
+			param1:      0x3f,
+			param2:      0xff,
+			data:        []byte{0x5c, 0x03, 0x5f, 0xc1, 0x05, 0x53, 0x00},
+		}
+		_, err := tx.Transmit(cmd)
+		return err
+	})
+	if err == nil || errors.Is(err, ErrPINRequired) {
+		t.Fatalf("writing object without management key got err=%v, want security status error", err)
+	}
+	if err := yk.VerifyPIN(DefaultPIN); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatalf("signing after verifying pin again: %v", err)
+	}
+
+	// Keys given a PIN verify it again transparently.
+	rt.resetCard()
+	priv, err = yk.PrivateKey(SlotAuthentication, pub, KeyAuth{PIN: DefaultPIN})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	if _, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatalf("signing with pin after reset: %v", err)
+	}
+}
+
+func TestReconnectNotRetried(t *testing.T) {
+	yk, rt := openResetTransport(t, false)
+	rt.resetCard()
+	if err := yk.SetPIN(DefaultPIN, "654321"); err == nil {
+		t.Fatalf("expected changing pin after reset to fail without being retried")
+	}
+	if rt.reconnects != 1 {
+		t.Errorf("reconnected %d times, want 1", rt.reconnects)
+	}
+	// The connection is usable again, and the PIN wasn't changed.
+	if err := yk.VerifyPIN(DefaultPIN); err != nil {
+		t.Errorf("verifying pin: %v", err)
+	}
+}
+
+func TestReconnectDifferentCard(t *testing.T) {
+	yk, rt := openResetTransport(t, false)
+	rt.next = pivtest.New(pivtest.Config{Serial: 87654321})
+	rt.resetCard()
+	if _, err := yk.Serial(); err == nil {
+		t.Fatalf("expected reconnecting to a different card to fail")
+	}
+	if _, err := yk.Retries(); err == nil {
+		t.Errorf("expected operations after reconnecting to a different card to fail")
+	}
+	if rt.reconnects != 1 {
+		t.Errorf("reconnected %d times, want 1", rt.reconnects)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tracer is called after each command is exchanged with the card, allowing
+// callers to log the commands that led to a failure.
+//
+// Tracers are called synchronously and must not use the YubiKey that produced
+// the trace.
+type Tracer func(t *Trace)
+
+// Trace describes a single command sent to the card and its response. Commands
+// split into multiple APDUs through chaining, and responses read using GET
+// RESPONSE, are reported as a single trace.
+//
+// Payloads holding secrets are redacted, only reporting their length. This
+// includes PINs, PUKs, management keys, imported private keys, the protected
+// metadata object, and the results of private key operations, such as decrypted
+// data or shared secrets.
+type Trace struct {
+	// Instruction, Param1 and Param2 identify the command.
+	Instruction byte
+	Param1      byte
+	Param2      byte
+
+	// Data holds the command data. It's nil if DataRedacted is set.
+	Data []byte
+	// DataLength is the length of the command data, even if redacted.
+	DataLength int
+	// DataRedacted indicates the command data was omitted because it
+	// contained secrets.
+	DataRedacted bool
+
+	// Response holds the response data. It's nil if ResponseRedacted is set.
+	Response []byte
+	// ResponseLength is the length of the response data, even if redacted.
+	ResponseLength int
+	// ResponseRedacted indicates the response data was omitted because it
+	// contained secrets.
+	ResponseRedacted bool
+
+	// StatusWord is the status word returned by the card, such as 0x9000 for
+	// success. It's zero if the command couldn't be exchanged with the card.
+	StatusWord uint16
+	// Duration is the time taken to exchange the command and its response.
+	Duration time.Duration
+	// Err holds any error returned for the command.
+	Err error
+}
+
+// String formats the trace for logging.
+func (t *Trace) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ins=0x%02x p1=0x%02x p2=0x%02x", t.Instruction, t.Param1, t.Param2)
+	writePayload := func(name string, d []byte, n int, redacted bool) {
+		if redacted {
+			fmt.Fprintf(&b, " %s=<redacted %d bytes>", name, n)
+		} else if n > 0 {
+			fmt.Fprintf(&b, " %s=%x", name, d)
+		}
+	}
+	writePayload("data", t.Data, t.DataLength, t.DataRedacted)
+	writePayload("resp", t.Response, t.ResponseLength, t.ResponseRedacted)
+	if t.StatusWord != 0 {
+		fmt.Fprintf(&b, " sw=0x%04x", t.StatusWord)
+	}
+	fmt.Fprintf(&b, " took=%s", t.Duration)
+	if t.Err != nil {
+		fmt.Fprintf(&b, " err=%q", t.Err)
+	}
+	return b.String()
+}
+
+// SetTracer registers a function to be called for each command exchanged with
+// the card. Passing nil disables tracing.
+//
+// SetTracer waits for any operation in progress to complete.
+func (yk *YubiKey) SetTracer(f Tracer) {
+	yk.busy <- struct{}{}
+	defer func() { <-yk.busy }()
+	yk.tx.trace = f
+}
+
+// tagProtectedMetadata is the tag list of the PIN protected printed information
+// object, used to store protected metadata.
+var tagProtectedMetadata = []byte{0x5c, 0x03, 0x5f, 0xc1, 0x09}
+
+// redactTrace reports whether the command data and response data of an APDU
+// may contain secrets.
+func redactTrace(d apdu) (data, resp bool) {
+	switch d.instruction {
+	case insVerify:
+		// PINs, and temporary PINs generated by on card biometric
+		// comparison.
+		return true, d.param2 == paramOCCAuth
+	case insChangeReference, insResetRetry:
+		// PINs and PUKs.
+		return true, false
+	case insSetMGMKey, insImportKey:
+		return true, false
+	case insSetDeviceInfo:
+		// Configuration lock codes.
+		return true, false
+	case insAuthenticate:
+		// Management key challenges, decrypted data and shared secrets.
+		return d.param2 == keyCardManagement, true
+	case insGetData:
+		return false, bytes.HasPrefix(d.data, tagProtectedMetadata)
+	case insPutData:
+		return bytes.HasPrefix(d.data, tagProtectedMetadata), false
+	}
+	return false, false
+}
+
+func newTrace(d apdu, resp []byte, err error, dur time.Duration) *Trace {
+	t := &Trace{
+		Instruction:    d.instruction,
+		Param1:         d.param1,
+		Param2:         d.param2,
+		DataLength:     len(d.data),
+		ResponseLength: len(resp),
+		Duration:       dur,
+		Err:            err,
+	}
+	var ae *apduErr
+	if err == nil {
+		t.StatusWord = 0x9000
+	} else if errors.As(err, &ae) {
+		t.StatusWord = ae.Status()
+	}
+	redactData, redactResp := redactTrace(d)
+	if redactData {
+		t.DataRedacted = true
+	} else if len(d.data) > 0 {
+		t.Data = append([]byte{}, d.data...)
+	}
+	if redactResp {
+		t.ResponseRedacted = true
+	} else if len(resp) > 0 {
+		t.Response = append([]byte{}, resp...)
+	}
+	return t
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
+)
+
+func TestTracerOpen(t *testing.T) {
+	var traces []*Trace
+	c := Client{Tracer: func(t *Trace) { traces = append(traces, t) }}
+	yk, err := c.OpenTransport(pivtest.New(pivtest.Config{}))
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	if len(traces) != 2 {
+		t.Fatalf("expected 2 traces while opening, got %d", len(traces))
+	}
+	sel := traces[0]
+	if sel.Instruction != insSelectApplication || sel.Param1 != 0x04 {
+		t.Errorf("first trace got=%s, want select application", sel)
+	}
+	if !bytes.Equal(sel.Data, aidPIV[:]) || sel.DataLength != len(aidPIV) {
+		t.Errorf("select data got=%x, want=%x", sel.Data, aidPIV)
+	}
+	if sel.StatusWord != 0x9000 || sel.Err != nil {
+		t.Errorf("select status got=0x%04x (%v), want=0x9000", sel.StatusWord, sel.Err)
+	}
+	ver := traces[1]
+	if ver.Instruction != insGetVersion {
+		t.Errorf("second trace got=%s, want get version", ver)
+	}
+	if !bytes.Equal(ver.Response, []byte{5, 4, 3}) || ver.ResponseLength != 3 {
+		t.Errorf("version response got=%x, want=050403", ver.Response)
+	}
+}
+
+func TestTracerRedaction(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+
+	var traces []*Trace
+	yk.SetTracer(func(t *Trace) { traces = append(traces, t) })
+	defer yk.SetTracer(nil)
+
+	const badPIN = "654321"
+	if err := yk.VerifyPIN(badPIN); err == nil {
+		t.Fatalf("expected verifying an incorrect pin to fail")
+	}
+	if err := yk.VerifyPIN(DefaultPIN); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+	if err := yk.SetManagementKey(DefaultManagementKey(), DefaultManagementKey()); err != nil {
+		t.Fatalf("setting management key: %v", err)
+	}
+
+	var verify, setKey []*Trace
+	for _, tr := range traces {
+		switch tr.Instruction {
+		case insVerify:
+			verify = append(verify, tr)
+		case insSetMGMKey:
+			setKey = append(setKey, tr)
+		}
+		s := tr.String()
+		if strings.Contains(s, "313233343536") || strings.Contains(s, "363534333231") {
+			t.Errorf("trace contains pin: %s", s)
+		}
+	}
+	if len(verify) != 2 {
+		t.Fatalf("expected 2 verify traces, got %d", len(verify))
+	}
+	for _, tr := range verify {
+		if !tr.DataRedacted || tr.Data != nil || tr.DataLength != 8 {
+			t.Errorf("verify data not redacted: %s", tr)
+		}
+	}
+	var authErr AuthErr
+	if verify[0].StatusWord&0xfff0 != 0x63c0 || !errors.As(verify[0].Err, &authErr) {
+		t.Errorf("failed verify got sw=0x%04x err=%v, want 0x63cX and AuthErr", verify[0].StatusWord, verify[0].Err)
+	}
+	if verify[1].StatusWord != 0x9000 || verify[1].Err != nil {
+		t.Errorf("successful verify got sw=0x%04x err=%v", verify[1].StatusWord, verify[1].Err)
+	}
+
+	if len(setKey) != 1 {
+		t.Fatalf("expected 1 set management key trace, got %d", len(setKey))
+	}
+	if !setKey[0].DataRedacted || setKey[0].Data != nil {
+		t.Errorf("management key not redacted: %s", setKey[0])
+	}
+	if strings.Contains(setKey[0].String(), "0102030405060708") {
+		t.Errorf("trace contains management key: %s", setKey[0])
+	}
+}
+
+func TestTracerRedactionConfigLock(t *testing.T) {
+	var traces []*Trace
+	c := Client{Tracer: func(t *Trace) { traces = append(traces, t) }}
+	yk, err := c.OpenTransport(pivtest.New(pivtest.Config{}))
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	defer yk.Close()
+
+	oldCode := [16]byte{0: 0x01, 15: 0xff}
+	newCode := [16]byte{0: 0x02, 15: 0xfe}
+	if err := yk.SetConfigLock([16]byte{}, oldCode); err != nil {
+		t.Fatalf("setting lock code: %v", err)
+	}
+	if err := yk.SetConfigLock(oldCode, newCode); err != nil {
+		t.Fatalf("changing lock code: %v", err)
+	}
+
+	var n int
+	for _, tr := range traces {
+		if tr.Instruction != insSetDeviceInfo {
+			continue
+		}
+		n++
+		if !tr.DataRedacted || tr.Data != nil {
+			t.Errorf("set device info data not redacted: %s", tr)
+		}
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 set device info traces, got %d", n)
+	}
+}
+
+func TestTraceRedactionTemporaryPIN(t *testing.T) {
+	tempPIN := []byte("0123456789abcdef")
+	cmd := apdu{instruction: insVerify, param2: paramOCCAuth, data: []byte{0x02, 0x00}}
+	tr := newTrace(cmd, tempPIN, nil, 0)
+	if !tr.ResponseRedacted || tr.Response != nil || tr.ResponseLength != len(tempPIN) {
+		t.Errorf("temporary pin not redacted: %s", tr)
+	}
+	if strings.Contains(tr.String(), "30313233") {
+		t.Errorf("trace contains temporary pin: %s", tr)
+	}
+
+	// Responses to PIN verification don't contain secrets.
+	cmd = apdu{instruction: insVerify, param2: paramPINAuth}
+	if tr := newTrace(cmd, nil, nil, 0); tr.ResponseRedacted {
+		t.Errorf("pin verify response redacted: %s", tr)
+	}
+}
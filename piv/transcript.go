@@ -0,0 +1,453 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transcripts record a session with a smart card as text, one event per line:
+//
+//	# Comments and blank lines are ignored.
+//	begin
+//	> 00a4040005a000000308
+//	< 9000 61114f0600001000010079074f05a000000308
+//	rand 8d2e1f6a0b9c3d47
+//	end
+//	close
+//
+// Lines starting with ">" hold a command APDU, followed by a line starting
+// with "<" holding the response's status word and data. Any event may instead
+// be followed by a line starting with "!", holding an error returned by the
+// transport. Errors carrying a smart card status word or PC/SC return code
+// record it before the message, so replayed errors can be inspected with
+// errors.Is and errors.As:
+//
+//	! rc=80100068 the smart card has been reset, so any shared state information is invalid
+//	! sw=6a82 smart card error 6a82: data object or application not found
+//
+// Lines starting with "rand" hold bytes read from the client's source of
+// randomness.
+//
+// Transcripts include all data exchanged with the card, such as PINs and
+// management keys, and should only be recorded using test credentials.
+
+const (
+	transcriptBegin    = "begin"
+	transcriptEnd      = "end"
+	transcriptClose    = "close"
+	transcriptTransmit = ">"
+	transcriptResponse = "<"
+	transcriptError    = "!"
+	transcriptRand     = "rand"
+
+	// Prefixes of the code recorded with an error.
+	transcriptRC = "rc="
+	transcriptSW = "sw="
+)
+
+// Recorder is a Transport that records all commands exchanged with an
+// underlying Transport as a transcript, which can later be replayed using
+// NewReplay.
+//
+//	t, err := piv.OpenPCSC(card)
+//	if err != nil {
+//		// ...
+//	}
+//	rec := piv.NewRecorder(t, f)
+//	yk, err := piv.OpenTransport(rec)
+//
+// Operations that use the client's source of randomness, such as management
+// key authentication, can only be replayed if that randomness is recorded as
+// well using the Rand method.
+type Recorder struct {
+	t Transport
+
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewRecorder returns a Recorder that writes a transcript of the commands sent
+// through t to w.
+func NewRecorder(t Transport, w io.Writer) *Recorder {
+	return &Recorder{t: t, w: w}
+}
+
+// printf writes a line to the transcript, holding on to the first error.
+func (r *Recorder) printf(format string, v ...interface{}) {
+	if r.err != nil {
+		return
+	}
+	if _, err := fmt.Fprintf(r.w, format+"\n", v...); err != nil {
+		r.err = fmt.Errorf("writing transcript: %w", err)
+	}
+}
+
+func (r *Recorder) recordErr(err error) {
+	if err == nil {
+		return
+	}
+	msg := strings.ReplaceAll(err.Error(), "\n", " ")
+	var (
+		se *scErr
+		ae *apduErr
+	)
+	switch {
+	case errors.As(err, &se):
+		r.printf("%s %s%08x %s", transcriptError, transcriptRC, uint32(se.rc), msg)
+	case errors.As(err, &ae):
+		r.printf("%s %s%04x %s", transcriptError, transcriptSW, ae.Status(), msg)
+	default:
+		r.printf("%s %s", transcriptError, msg)
+	}
+}
+
+// Begin begins a transaction on the underlying transport.
+func (r *Recorder) Begin() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.t.Begin()
+	r.printf(transcriptBegin)
+	r.recordErr(err)
+	return err
+}
+
+// End ends the transaction on the underlying transport.
+func (r *Recorder) End() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.t.End()
+	r.printf(transcriptEnd)
+	r.recordErr(err)
+	return err
+}
+
+// Transmit sends a command through the underlying transport.
+func (r *Recorder) Transmit(req []byte) ([]byte, uint16, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resp, sw, err := r.t.Transmit(req)
+	r.printf("%s %x", transcriptTransmit, req)
+	switch {
+	case err != nil:
+		r.recordErr(err)
+	case len(resp) == 0:
+		r.printf("%s %04x", transcriptResponse, sw)
+	default:
+		r.printf("%s %04x %x", transcriptResponse, sw, resp)
+	}
+	return resp, sw, err
+}
+
+// Close closes the underlying transport. If writing the transcript failed at
+// any point, Close returns that error.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.t.Close()
+	r.printf(transcriptClose)
+	r.recordErr(err)
+	if err != nil {
+		return err
+	}
+	return r.err
+}
+
+// Cancel interrupts blocking calls on the underlying transport, if it supports
+// cancellation. Cancellations aren't recorded in the transcript.
+func (r *Recorder) Cancel() error {
+	if c, ok := r.t.(canceler); ok {
+		return c.Cancel()
+	}
+	return nil
+}
+
+// Rand returns a reader that records all bytes read from src in the
+// transcript. It should be used as the client's source of randomness.
+func (r *Recorder) Rand(src io.Reader) io.Reader {
+	return &recordedRand{r: r, src: src}
+}
+
+type recordedRand struct {
+	r   *Recorder
+	src io.Reader
+}
+
+func (rr *recordedRand) Read(b []byte) (int, error) {
+	n, err := rr.src.Read(b)
+	if n > 0 {
+		rr.r.mu.Lock()
+		rr.r.printf("%s %x", transcriptRand, b[:n])
+		rr.r.mu.Unlock()
+	}
+	return n, err
+}
+
+// transcriptEvent is an operation parsed from a transcript.
+type transcriptEvent struct {
+	// line is the line number the event started on.
+	line int
+	kind string
+
+	req  []byte
+	resp []byte
+	sw   uint16
+
+	// err holds the error returned for the operation, if any.
+	err error
+}
+
+func (e *transcriptEvent) String() string {
+	if e.kind == transcriptTransmit {
+		return fmt.Sprintf("command %x", e.req)
+	}
+	return e.kind
+}
+
+// Replay is a Transport that replays a transcript recorded by a Recorder,
+// returning the recorded responses. Any divergence from the recorded session,
+// such as a different command being sent, causes the operation to fail, as
+// does every subsequent operation.
+//
+// Once the session is complete, callers should call Done to ensure the entire
+// transcript was replayed.
+type Replay struct {
+	mu     sync.Mutex
+	events []*transcriptEvent
+	rand   []byte
+	err    error
+}
+
+// NewReplay parses a transcript recorded by a Recorder.
+func NewReplay(r io.Reader) (*Replay, error) {
+	var (
+		rp      Replay
+		last    *transcriptEvent
+		pending *transcriptEvent
+	)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, value := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			kind, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if pending != nil && kind != transcriptResponse && kind != transcriptError {
+			return nil, fmt.Errorf("line %d: expected response to command on line %d", n, pending.line)
+		}
+
+		switch kind {
+		case transcriptBegin, transcriptEnd, transcriptClose:
+			last = &transcriptEvent{line: n, kind: kind}
+			rp.events = append(rp.events, last)
+		case transcriptTransmit:
+			req, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: parsing command: %v", n, err)
+			}
+			last = &transcriptEvent{line: n, kind: kind, req: req}
+			pending = last
+			rp.events = append(rp.events, last)
+		case transcriptResponse:
+			if pending == nil {
+				return nil, fmt.Errorf("line %d: response without a command", n)
+			}
+			fields := strings.Fields(value)
+			if len(fields) == 0 || len(fields) > 2 {
+				return nil, fmt.Errorf("line %d: invalid response", n)
+			}
+			sw, err := strconv.ParseUint(fields[0], 16, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: parsing status word: %v", n, err)
+			}
+			pending.sw = uint16(sw)
+			if len(fields) == 2 {
+				if pending.resp, err = hex.DecodeString(fields[1]); err != nil {
+					return nil, fmt.Errorf("line %d: parsing response: %v", n, err)
+				}
+			}
+			pending = nil
+		case transcriptError:
+			if last == nil || last.err != nil || (last.kind == transcriptTransmit && pending == nil) {
+				return nil, fmt.Errorf("line %d: unexpected error", n)
+			}
+			err, perr := parseTranscriptErr(value)
+			if perr != nil {
+				return nil, fmt.Errorf("line %d: %v", n, perr)
+			}
+			last.err = err
+			pending = nil
+		case transcriptRand:
+			b, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: parsing random bytes: %v", n, err)
+			}
+			rp.rand = append(rp.rand, b...)
+		default:
+			return nil, fmt.Errorf("line %d: unrecognized event %q", n, kind)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("reading transcript: %v", err)
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("line %d: command without a response", pending.line)
+	}
+	return &rp, nil
+}
+
+// parseTranscriptErr rebuilds an error recorded in a transcript. Errors with a
+// recorded status word or return code are returned as the errors the card or
+// PC/SC would have returned, preserving their behavior with errors.Is and
+// errors.As.
+func parseTranscriptErr(value string) (error, error) {
+	var (
+		code string
+		size int
+	)
+	switch {
+	case strings.HasPrefix(value, transcriptRC):
+		code, size = strings.TrimPrefix(value, transcriptRC), 32
+	case strings.HasPrefix(value, transcriptSW):
+		code, size = strings.TrimPrefix(value, transcriptSW), 16
+	default:
+		return errors.New(value), nil
+	}
+	if i := strings.IndexByte(code, ' '); i >= 0 {
+		code = code[:i]
+	}
+	n, err := strconv.ParseUint(code, 16, size)
+	if err != nil {
+		return nil, fmt.Errorf("parsing error code: %v", err)
+	}
+	if size == 32 {
+		return &scErr{int64(n)}, nil
+	}
+	return &apduErr{byte(n >> 8), byte(n)}, nil
+}
+
+// next consumes the next event in the transcript, checking it matches the
+// operation being performed.
+func (r *Replay) next(want *transcriptEvent) (*transcriptEvent, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.events) == 0 {
+		r.err = fmt.Errorf("transcript diverged: unexpected %s after end of transcript", want)
+		return nil, r.err
+	}
+	got := r.events[0]
+	if got.kind != want.kind || string(got.req) != string(want.req) {
+		r.err = fmt.Errorf("transcript diverged: line %d: sent %s, recorded %s", got.line, want, got)
+		return nil, r.err
+	}
+	r.events = r.events[1:]
+	if got.err != nil {
+		return nil, got.err
+	}
+	return got, nil
+}
+
+// Begin replays the beginning of a transaction.
+func (r *Replay) Begin() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.next(&transcriptEvent{kind: transcriptBegin})
+	return err
+}
+
+// End replays the end of a transaction.
+func (r *Replay) End() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.next(&transcriptEvent{kind: transcriptEnd})
+	return err
+}
+
+// Transmit returns the recorded response to a command.
+func (r *Replay) Transmit(req []byte) ([]byte, uint16, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, err := r.next(&transcriptEvent{kind: transcriptTransmit, req: req})
+	if err != nil {
+		return nil, 0, err
+	}
+	return append([]byte{}, e.resp...), e.sw, nil
+}
+
+// Close replays closing the connection.
+func (r *Replay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.next(&transcriptEvent{kind: transcriptClose})
+	return err
+}
+
+// Rand returns a reader that returns the random bytes recorded in the
+// transcript. It should be used as the client's source of randomness.
+func (r *Replay) Rand() io.Reader {
+	return replayRand{r}
+}
+
+type replayRand struct {
+	r *Replay
+}
+
+func (rr replayRand) Read(b []byte) (int, error) {
+	r := rr.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(b) > len(r.rand) {
+		r.err = fmt.Errorf("transcript diverged: read %d random bytes, %d recorded", len(b), len(r.rand))
+		return 0, r.err
+	}
+	n := copy(b, r.rand)
+	r.rand = r.rand[n:]
+	return n, nil
+}
+
+// Done reports whether the transcript was replayed exactly, returning an error
+// if the session diverged from the transcript or if any recorded operations
+// weren't replayed.
+func (r *Replay) Done() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.events) > 0 {
+		e := r.events[0]
+		return fmt.Errorf("transcript not fully replayed: %d operations remaining, starting with %s on line %d", len(r.events), e, e.line)
+	}
+	if len(r.rand) > 0 {
+		return fmt.Errorf("transcript not fully replayed: %d random bytes remaining", len(r.rand))
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-piv/piv-go/piv/pivtest"
+)
+
+// recordTranscripts indicates whether transcript tests should record new
+// transcripts instead of replaying them.
+var recordTranscripts bool
+
+func init() {
+	flag.BoolVar(&recordTranscripts, "record-transcripts", false,
+		"Record transcripts in testdata against the test card instead of replaying them. "+
+			"Combine with --wipe-yubikey to record against a YubiKey")
+}
+
+// runTranscriptTest replays the transcript testdata/<name>.transcript, running
+// f against the replayed card. If --record-transcripts is provided, the
+// transcript is recorded instead.
+func runTranscriptTest(t *testing.T, name string, f func(t *testing.T, yk *YubiKey)) {
+	path := filepath.Join("testdata", name+".transcript")
+	if recordTranscripts {
+		var b bytes.Buffer
+		b.WriteString("# Recorded by: go test ./piv --record-transcripts\n")
+		rec := NewRecorder(newTestTransport(t, pivtest.Config{}), &b)
+		c := Client{Rand: rec.Rand(rand.Reader)}
+		yk, err := c.OpenTransport(rec)
+		if err != nil {
+			t.Fatalf("opening yubikey: %v", err)
+		}
+		f(t, yk)
+		if err := yk.Close(); err != nil {
+			t.Fatalf("closing yubikey: %v", err)
+		}
+		if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+			t.Fatalf("writing transcript: %v", err)
+		}
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening transcript: %v", err)
+	}
+	defer file.Close()
+	rp, err := NewReplay(file)
+	if err != nil {
+		t.Fatalf("parsing transcript: %v", err)
+	}
+	c := Client{Rand: rp.Rand()}
+	yk, err := c.OpenTransport(rp)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	f(t, yk)
+	if err := yk.Close(); err != nil {
+		t.Errorf("closing yubikey: %v", err)
+	}
+	if err := rp.Done(); err != nil {
+		t.Errorf("replaying transcript: %v", err)
+	}
+}
+
+func TestTranscriptOpen(t *testing.T) {
+	runTranscriptTest(t, "open", func(t *testing.T, yk *YubiKey) {
+		if _, err := yk.Serial(); err != nil {
+			t.Errorf("getting serial: %v", err)
+		}
+		if v := yk.Version(); v == (Version{}) {
+			t.Errorf("expected version to be set")
+		}
+	})
+}
+
+func TestTranscriptAttest(t *testing.T) {
+	runTranscriptTest(t, "attest", func(t *testing.T, yk *YubiKey) {
+		key := Key{
+			Algorithm:   AlgorithmEC256,
+			PINPolicy:   PINPolicyNever,
+			TouchPolicy: TouchPolicyNever,
+		}
+		if _, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key); err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		cert, err := yk.AttestationCertificate()
+		if err != nil {
+			t.Fatalf("getting attestation certificate: %v", err)
+		}
+		slotCert, err := yk.Attest(SlotAuthentication)
+		if err != nil {
+			t.Fatalf("attesting key: %v", err)
+		}
+		// Trust the recorded attestation certificate, which may be signed by
+		// a simulated card's CA rather than Yubico's.
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		v := Verifier{Roots: roots}
+		a, err := v.Verify(cert, slotCert)
+		if err != nil {
+			t.Fatalf("verifying attestation: %v", err)
+		}
+		if a.Slot != SlotAuthentication {
+			t.Errorf("attested slot got=%v, want=%v", a.Slot, SlotAuthentication)
+		}
+		if a.PINPolicy != key.PINPolicy || a.TouchPolicy != key.TouchPolicy {
+			t.Errorf("attested policies got=%v/%v, want=%v/%v", a.PINPolicy, a.TouchPolicy, key.PINPolicy, key.TouchPolicy)
+		}
+		if a.Version != yk.Version() {
+			t.Errorf("attested version got=%v, want=%v", a.Version, yk.Version())
+		}
+	})
+}
+
+func TestTranscriptKeyInfo(t *testing.T) {
+	runTranscriptTest(t, "keyinfo", func(t *testing.T, yk *YubiKey) {
+		key := Key{
+			Algorithm:   AlgorithmEC256,
+			PINPolicy:   PINPolicyAlways,
+			TouchPolicy: TouchPolicyNever,
+		}
+		pub, err := yk.GenerateKey(DefaultManagementKey(), SlotSignature, key)
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		ki, err := yk.KeyInfo(SlotSignature)
+		if err != nil {
+			t.Fatalf("getting key info: %v", err)
+		}
+		if ki.Algorithm != key.Algorithm || ki.PINPolicy != key.PINPolicy || ki.TouchPolicy != key.TouchPolicy {
+			t.Errorf("key info got=%+v, want=%+v", ki, key)
+		}
+		if ki.Origin != OriginGenerated {
+			t.Errorf("key origin got=%v, want=%v", ki.Origin, OriginGenerated)
+		}
+		if !pub.(*ecdsa.PublicKey).Equal(ki.PublicKey) {
+			t.Errorf("key info public key doesn't match generated key")
+		}
+	})
+}
+
+func TestTranscriptSign(t *testing.T) {
+	runTranscriptTest(t, "sign", func(t *testing.T, yk *YubiKey) {
+		key := Key{
+			Algorithm:   AlgorithmEC256,
+			PINPolicy:   PINPolicyOnce,
+			TouchPolicy: TouchPolicyNever,
+		}
+		pub, err := yk.GenerateKey(DefaultManagementKey(), SlotAuthentication, key)
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		priv, err := yk.PrivateKey(SlotAuthentication, pub, KeyAuth{PIN: DefaultPIN})
+		if err != nil {
+			t.Fatalf("getting private key: %v", err)
+		}
+		digest := sha256.Sum256([]byte("transcript"))
+		sig, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+			t.Errorf("signature didn't verify")
+		}
+	})
+}
+
+func TestTranscriptRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	rec := NewRecorder(pivtest.New(pivtest.Config{}), &b)
+	c := Client{Rand: rec.Rand(rand.Reader)}
+	yk, err := c.OpenTransport(rec)
+	if err != nil {
+		t.Fatalf("opening yubikey: %v", err)
+	}
+	if err := yk.authManagementKey(DefaultManagementKey()); err != nil {
+		t.Fatalf("authenticating: %v", err)
+	}
+	if err := yk.VerifyPIN("000000"); err == nil {
+		t.Fatalf("expected verifying incorrect pin to fail")
+	}
+	if err := yk.Close(); err != nil {
+		t.Fatalf("closing yubikey: %v", err)
+	}
+
+	transcript := b.String()
+	rp, err := NewReplay(strings.NewReader(transcript))
+	if err != nil {
+		t.Fatalf("parsing transcript: %v\n%s", err, transcript)
+	}
+	c = Client{Rand: rp.Rand()}
+	yk, err = c.OpenTransport(rp)
+	if err != nil {
+		t.Fatalf("opening replayed yubikey: %v", err)
+	}
+	if err := yk.authManagementKey(DefaultManagementKey()); err != nil {
+		t.Fatalf("authenticating: %v", err)
+	}
+	var authErr AuthErr
+	if err := yk.VerifyPIN("000000"); !errors.As(err, &authErr) || authErr.Retries != 2 {
+		t.Fatalf("expected replayed authentication error with 2 retries, got %v", err)
+	}
+	if err := yk.Close(); err != nil {
+		t.Fatalf("closing yubikey: %v", err)
+	}
+	if err := rp.Done(); err != nil {
+		t.Fatalf("replaying transcript: %v", err)
+	}
+}
+
+// errTransport is a Transport that fails every command with err.
+type errTransport struct {
+	Transport
+	err error
+}
+
+func (e *errTransport) Transmit(req []byte) ([]byte, uint16, error) {
+	return nil, 0, e.err
+}
+
+func TestTranscriptErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		check func(err error) bool
+	}{
+		{"CardReset", &scErr{rcResetCard}, isCardResetErr},
+		{"NotFound", fmt.Errorf("reading object: %w", &apduErr{0x6a, 0x82}), func(err error) bool {
+			return errors.Is(err, ErrNotFound)
+		}},
+		{"AuthErr", &apduErr{0x63, 0xc2}, func(err error) bool {
+			var e AuthErr
+			return errors.As(err, &e) && e.Retries == 2
+		}},
+		{"Message", errors.New("reader\nunavailable"), func(err error) bool {
+			return err.Error() == "reader unavailable"
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var b bytes.Buffer
+			rec := NewRecorder(&errTransport{err: test.err}, &b)
+			if _, _, err := rec.Transmit([]byte{0x00, 0xfd, 0x00, 0x00, 0x00}); err != test.err {
+				t.Fatalf("transmit returned %v, want %v", err, test.err)
+			}
+
+			transcript := b.String()
+			rp, err := NewReplay(strings.NewReader(transcript))
+			if err != nil {
+				t.Fatalf("parsing transcript: %v\n%s", err, transcript)
+			}
+			_, _, err = rp.Transmit([]byte{0x00, 0xfd, 0x00, 0x00, 0x00})
+			if err == nil || !test.check(err) {
+				t.Errorf("replayed error %v doesn't match recorded error %v\n%s", err, test.err, transcript)
+			}
+		})
+	}
+}
+
+func TestTranscriptDivergence(t *testing.T) {
+	transcript := `begin
+> 00a4040005a000000308
+< 9000
+> 00fd000000
+< 9000 050403
+> 00f8000000
+< 9000 00bc614e
+close
+`
+	rp, err := NewReplay(strings.NewReader(transcript))
+	if err != nil {
+		t.Fatalf("parsing transcript: %v", err)
+	}
+	yk, err := OpenTransport(rp)
+	if err != nil {
+		t.Fatalf("opening replayed yubikey: %v", err)
+	}
+	if _, err := yk.Retries(); err == nil {
+		t.Errorf("expected command not in transcript to fail")
+	}
+	// Once diverged, the transcript can't be resumed.
+	if _, err := yk.Serial(); err == nil {
+		t.Errorf("expected command after divergence to fail")
+	}
+	yk.Close()
+	if err := rp.Done(); err == nil || !strings.Contains(err.Error(), "line 6") {
+		t.Errorf("expected divergence at line 6, got %v", err)
+	}
+}
+
+func TestTranscriptIncomplete(t *testing.T) {
+	transcript := `begin
+> 00a4040005a000000308
+< 9000
+> 00fd000000
+< 9000 050403
+> 00f8000000
+< 9000 00bc614e
+close
+`
+	rp, err := NewReplay(strings.NewReader(transcript))
+	if err != nil {
+		t.Fatalf("parsing transcript: %v", err)
+	}
+	if _, err := OpenTransport(rp); err != nil {
+		t.Fatalf("opening replayed yubikey: %v", err)
+	}
+	if err := rp.Done(); err == nil {
+		t.Errorf("expected unreplayed operations to be reported")
+	}
+}
+
+func TestParseTranscriptErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		transcript string
+	}{
+		{"missing response", "> 00a4\nbegin\n"},
+		{"trailing command", "> 00a4\n"},
+		{"response without command", "< 9000\n"},
+		{"bad hex", "> zz\n"},
+		{"bad status", "> 00a4\n< 90000\n"},
+		{"unknown event", "reset\n"},
+		{"double error", "begin\n! a\n! b\n"},
+		{"bad return code", "begin\n! rc=zz reset\n"},
+		{"bad status word", "begin\n! sw=90000 error\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewReplay(strings.NewReader(test.transcript)); err == nil {
+				t.Errorf("expected parsing transcript to fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// EventType identifies a change to the readers or cards connected to the
+// system.
+type EventType int
+
+// Events reported by Watch.
+const (
+	// EventReaderAttached indicates a reader was connected. For YubiKeys,
+	// the reader and card are attached and removed together.
+	EventReaderAttached EventType = iota + 1
+	// EventReaderDetached indicates a reader was disconnected.
+	EventReaderDetached
+	// EventCardInserted indicates a card was inserted into a reader.
+	EventCardInserted
+	// EventCardRemoved indicates a card was removed from a reader.
+	EventCardRemoved
+	// EventCardInUse indicates a connection, possibly from this process,
+	// holds exclusive access to a card.
+	EventCardInUse
+	// EventCardReleased indicates a card is no longer held exclusively.
+	EventCardReleased
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventReaderAttached:
+		return "reader attached"
+	case EventReaderDetached:
+		return "reader detached"
+	case EventCardInserted:
+		return "card inserted"
+	case EventCardRemoved:
+		return "card removed"
+	case EventCardInUse:
+		return "card in use"
+	case EventCardReleased:
+		return "card released"
+	}
+	return fmt.Sprintf("EventType(%d)", int(e))
+}
+
+// Event describes a change to a reader or the card inserted in it.
+type Event struct {
+	Type EventType
+	// Reader is the name of the reader, as returned by Cards and accepted by
+	// Open.
+	Reader string
+}
+
+// Reader and card states reported by SCardGetStatusChange.
+//
+// https://pcsclite.apdu.fr/api/group__API.html#ga33247d5d1257d59e55647c3bb717db24
+const (
+	scStateUnaware     = 0x0000
+	scStateChanged     = 0x0002
+	scStateUnknown     = 0x0004
+	scStateUnavailable = 0x0008
+	scStateEmpty       = 0x0010
+	scStatePresent     = 0x0020
+	scStateExclusive   = 0x0080
+	scStateInUse       = 0x0100
+)
+
+// scPnPNotification is a special reader name used to detect readers being
+// attached or detached. The number of readers is reported in the upper 16
+// bits of the event state.
+const scPnPNotification = `\\?PnP?\Notification`
+
+// scReaderState holds the state of a reader passed to GetStatusChange.
+type scReaderState struct {
+	reader       string
+	currentState uint32
+	eventState   uint32
+}
+
+// Return codes for a cancelled or timed out SCardGetStatusChange.
+const (
+	rcCancelled = 0x80100002
+	rcTimeout   = 0x8010000A
+)
+
+func isRCErr(err error, rc int64) bool {
+	var e *scErr
+	return errors.As(err, &e) && e.rc == rc
+}
+
+// watchPollInterval is how often readers are listed on platforms that can't
+// report readers being attached.
+const watchPollInterval = time.Second
+
+// watchCancelInterval is how often a cancelled Watch interrupts the smart card
+// daemon until it returns.
+const watchCancelInterval = 100 * time.Millisecond
+
+// Watch reports changes to the readers and cards connected to the system,
+// sending events to the provided channel until the context is cancelled or an
+// error occurs. Watch blocks until then, and always returns a non-nil error,
+// which is the context's error if it was cancelled.
+//
+// Events are first sent for the readers and cards present when Watch is
+// called. Sends to the channel block, so callers must continue receiving
+// events until Watch returns.
+//
+//	events := make(chan piv.Event)
+//	go func() {
+//		for e := range events {
+//			if e.Type == piv.EventCardInserted {
+//				// Open e.Reader...
+//			}
+//		}
+//	}()
+//	err := piv.Watch(ctx, events)
+//	close(events)
+func Watch(ctx context.Context, events chan<- Event) error {
+	var c Client
+	return c.Watch(ctx, events)
+}
+
+// Watch reports changes to the readers matching the client's ReaderFilter. See
+// the package level Watch function for details.
+func (c *Client) Watch(ctx context.Context, events chan<- Event) error {
+	scCtx, err := newSCContext()
+	if err != nil {
+		return fmt.Errorf("connecting to smart card daemon: %w", err)
+	}
+	defer scCtx.Close()
+
+	// Interrupt any outstanding call to SCardGetStatusChange when the
+	// context is cancelled. Cancel has no effect if a call isn't in progress,
+	// so keep cancelling until Watch returns.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		t := time.NewTicker(watchCancelInterval)
+		defer t.Stop()
+		for {
+			scCtx.Cancel()
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	send := func(t EventType, reader string) error {
+		select {
+		case events <- Event{Type: t, Reader: reader}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Last known state of each reader.
+	known := map[string]uint32{}
+	var pnpState uint32
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		readers, err := scCtx.ListReaders()
+		if err != nil {
+			return fmt.Errorf("listing readers: %w", err)
+		}
+		readers = c.filterReaders(readers)
+		attached := map[string]bool{}
+		for _, r := range readers {
+			attached[r] = true
+			if _, ok := known[r]; !ok {
+				known[r] = scStateUnaware
+				if err := send(EventReaderAttached, r); err != nil {
+					return err
+				}
+			}
+		}
+		var detached []string
+		for r := range known {
+			if !attached[r] {
+				detached = append(detached, r)
+			}
+		}
+		sort.Strings(detached)
+		for _, r := range detached {
+			if known[r]&scStatePresent != 0 {
+				if err := send(EventCardRemoved, r); err != nil {
+					return err
+				}
+			}
+			delete(known, r)
+			if err := send(EventReaderDetached, r); err != nil {
+				return err
+			}
+		}
+
+		states := make([]scReaderState, 0, len(readers)+1)
+		for _, r := range readers {
+			states = append(states, scReaderState{reader: r, currentState: known[r]})
+		}
+		timeout := watchPollInterval
+		if scSupportsPnP {
+			states = append(states, scReaderState{reader: scPnPNotification, currentState: pnpState})
+			timeout = -1
+		}
+		if len(states) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(timeout):
+			}
+			continue
+		}
+		if err := scCtx.GetStatusChange(timeout, states); err != nil {
+			if isRCErr(err, rcTimeout) {
+				continue
+			}
+			if isRCErr(err, rcCancelled) && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("waiting for reader changes: %w", err)
+		}
+
+		for _, s := range states {
+			state := s.eventState &^ scStateChanged
+			if s.reader == scPnPNotification {
+				pnpState = state
+				continue
+			}
+			if state&(scStateUnknown|scStateUnavailable) != 0 {
+				// Reader was detached, picked up on the next iteration.
+				continue
+			}
+			prev := known[s.reader]
+			known[s.reader] = state
+			for _, e := range stateEvents(prev, state) {
+				if err := send(e, s.reader); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// stateEvents returns the events implied by a reader changing state.
+func stateEvents(prev, state uint32) []EventType {
+	var events []EventType
+	wasPresent := prev&scStatePresent != 0
+	isPresent := state&scStatePresent != 0
+	wasInUse := wasPresent && prev&scStateExclusive != 0
+	isInUse := isPresent && state&scStateExclusive != 0
+
+	if wasPresent && isPresent && prev>>16 != state>>16 {
+		// The upper 16 bits of the state count card insertions and removals.
+		// If they changed, the card was replaced between calls.
+		events = append(events, EventCardRemoved, EventCardInserted)
+		return events
+	}
+	if wasInUse && !isInUse {
+		events = append(events, EventCardReleased)
+	}
+	if wasPresent && !isPresent {
+		events = append(events, EventCardRemoved)
+	}
+	if !wasPresent && isPresent {
+		events = append(events, EventCardInserted)
+	}
+	if !wasInUse && isInUse {
+		events = append(events, EventCardInUse)
+	}
+	return events
+}
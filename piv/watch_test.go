@@ -0,0 +1,52 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStateEvents(t *testing.T) {
+	const (
+		empty   = scStateEmpty
+		present = scStatePresent | 1<<16
+		inUse   = scStatePresent | scStateExclusive | scStateInUse | 1<<16
+	)
+	tests := []struct {
+		name        string
+		prev, state uint32
+		want        []EventType
+	}{
+		{"unaware empty", scStateUnaware, empty, nil},
+		{"unaware present", scStateUnaware, present, []EventType{EventCardInserted}},
+		{"unaware in use", scStateUnaware, inUse, []EventType{EventCardInserted, EventCardInUse}},
+		{"inserted", empty, present, []EventType{EventCardInserted}},
+		{"removed", present, empty, []EventType{EventCardRemoved}},
+		{"removed in use", inUse, empty, []EventType{EventCardReleased, EventCardRemoved}},
+		{"in use", present, inUse, []EventType{EventCardInUse}},
+		{"released", inUse, present, []EventType{EventCardReleased}},
+		{"shared", present, present | scStateInUse, nil},
+		{"replaced", present, scStatePresent | 3<<16, []EventType{EventCardRemoved, EventCardInserted}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := stateEvents(test.prev, test.state)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("stateEvents(0x%x, 0x%x) got=%v, want=%v", test.prev, test.state, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rsa
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"hash"
+)
+
+// EMEOAEPDecode is extracted from DecryptOAEP, and is used to remove the OAEP
+// padding from the result of a raw RSA decryption operation. em must be the
+// size of the modulus.
+func EMEOAEPDecode(em []byte, hash, mgfHash hash.Hash, label []byte) ([]byte, error) {
+	k := len(em)
+	if k < hash.Size()*2+2 {
+		return nil, rsa.ErrDecryption
+	}
+	em = append([]byte{}, em...)
+
+	hash.Reset()
+	hash.Write(label)
+	lHash := hash.Sum(nil)
+	hash.Reset()
+
+	firstByteIsZero := subtle.ConstantTimeByteEq(em[0], 0)
+
+	seed := em[1 : hash.Size()+1]
+	db := em[hash.Size()+1:]
+
+	mgf1XOR(seed, mgfHash, db)
+	mgf1XOR(db, mgfHash, seed)
+
+	lHash2 := db[0:hash.Size()]
+
+	// We have to validate the plaintext in constant time in order to avoid
+	// attacks like: J. Manger. A Chosen Ciphertext Attack on RSA Optimal
+	// Asymmetric Encryption Padding (OAEP) as Standardized in PKCS #1
+	// v2.0. In J. Kilian, editor, Advances in Cryptology.
+	lHash2Good := subtle.ConstantTimeCompare(lHash, lHash2)
+
+	// The remainder of the plaintext must be zero or more 0x00, followed
+	// by 0x01, followed by the message.
+	//   lookingForIndex: 1 iff we are still looking for the 0x01
+	//   index: the offset of the first 0x01 byte
+	//   invalid: 1 iff we saw a non-zero byte before the 0x01.
+	var lookingForIndex, index, invalid int
+	lookingForIndex = 1
+	rest := db[hash.Size():]
+
+	for i := 0; i < len(rest); i++ {
+		equals0 := subtle.ConstantTimeByteEq(rest[i], 0)
+		equals1 := subtle.ConstantTimeByteEq(rest[i], 1)
+		index = subtle.ConstantTimeSelect(lookingForIndex&equals1, i, index)
+		lookingForIndex = subtle.ConstantTimeSelect(equals1, 0, lookingForIndex)
+		invalid = subtle.ConstantTimeSelect(lookingForIndex&^equals0, 1, invalid)
+	}
+
+	if firstByteIsZero&lHash2Good&^invalid&^lookingForIndex != 1 {
+		return nil, rsa.ErrDecryption
+	}
+
+	return rest[index+1:], nil
+}
+
+// EMEPKCS1v15Decode is extracted from decryptPKCS1v15, and is used to check the
+// PKCS #1 v1.5 padding of the result of a raw RSA decryption operation in
+// constant time. em must be the size of the modulus.
+//
+// It returns one or zero in valid that indicates whether the plaintext was
+// correctly structured. If the plaintext was valid then index contains the
+// index of the original message in em, to allow constant time padding removal.
+func EMEPKCS1v15Decode(em []byte) (valid int, index int) {
+	if len(em) < 11 {
+		return 0, 0
+	}
+
+	firstByteIsZero := subtle.ConstantTimeByteEq(em[0], 0)
+	secondByteIsTwo := subtle.ConstantTimeByteEq(em[1], 2)
+
+	// The remainder of the plaintext must be a string of non-zero random
+	// octets, followed by a 0, followed by the message.
+	//   lookingForIndex: 1 iff we are still looking for the zero.
+	//   index: the offset of the first zero byte.
+	lookingForIndex := 1
+
+	for i := 2; i < len(em); i++ {
+		equals0 := subtle.ConstantTimeByteEq(em[i], 0)
+		index = subtle.ConstantTimeSelect(lookingForIndex&equals0, i, index)
+		lookingForIndex = subtle.ConstantTimeSelect(equals0, 0, lookingForIndex)
+	}
+
+	// The PS padding must be at least 8 bytes long, and it starts two
+	// bytes into em.
+	validPS := subtle.ConstantTimeLessOrEq(2+8, index)
+
+	valid = firstByteIsZero & secondByteIsTwo & (^lookingForIndex & 1) & validPS
+	index = subtle.ConstantTimeSelect(valid, index+1, 0)
+	return valid, index
+}
+
+// EMEPKCS1v15DecodeSessionKey is extracted from DecryptPKCS1v15SessionKey. If
+// the padding of em is valid and the message is the same length as key, the
+// message is copied into key. Otherwise, key is unchanged. These alternatives
+// occur in constant time.
+func EMEPKCS1v15DecodeSessionKey(em []byte, key []byte) error {
+	k := len(em)
+	if k-(len(key)+3+8) < 0 {
+		return rsa.ErrDecryption
+	}
+
+	valid, index := EMEPKCS1v15Decode(em)
+	valid &= subtle.ConstantTimeEq(int32(len(em)-index), int32(len(key)))
+	subtle.ConstantTimeCopy(valid, key, em[len(em)-len(key):])
+	return nil
+}